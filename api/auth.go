@@ -0,0 +1,324 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Permission 读, 写, 删除三种权限, 可以组合
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+	PermAll = PermRead | PermWrite | PermDelete
+)
+
+var permNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermWrite, "write"},
+	{PermDelete, "delete"},
+}
+
+// ParsePermission 解析以逗号或空格分隔的 read, write, delete, all 为 all 表示所有权限
+func ParsePermission(s string) (perm Permission, err error) {
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if f == "all" {
+			perm |= PermAll
+			continue
+		}
+		found := false
+		for _, p := range permNames {
+			if f == p.name {
+				perm |= p.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, errors.New("Wrong permission: " + f)
+		}
+	}
+	return perm, nil
+}
+
+func (p Permission) String() string {
+	var names []string
+	for _, n := range permNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+var (
+	// ErrUnauthorized 没有凭证或者凭证无效
+	ErrUnauthorized = errors.New("Unauthorized")
+	// ErrForbidden 凭证有效但没有需要的权限, 或者预签名 URL 无效
+	ErrForbidden = errors.New("Forbidden")
+
+	// errNoCredentials 请求中没有这个 Authenticator 能识别的凭证, 由下一个 Authenticator 处理
+	errNoCredentials = fmt.Errorf("%w: no credentials", ErrUnauthorized)
+)
+
+// Authenticator 检查请求中的凭证, 返回它拥有的权限.
+// 凭证无效时返回的错误应该包含 ErrUnauthorized
+type Authenticator interface {
+	Authenticate(r *http.Request) (Permission, error)
+}
+
+// Authenticators 依次尝试每个 Authenticator, 使用第一个识别出凭证的结果
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(r *http.Request) (Permission, error) {
+	for _, a := range as {
+		perm, err := a.Authenticate(r)
+		if err != errNoCredentials {
+			return perm, err
+		}
+	}
+	return 0, errNoCredentials
+}
+
+// bearerToken 取出 Authorization: Bearer 中的 token
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// APIKeys 静态的 API key -> 权限. key 放在 X-API-Key 或 Authorization: Bearer 中
+type APIKeys map[string]Permission
+
+func (keys APIKeys) Authenticate(r *http.Request) (Permission, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return 0, errNoCredentials
+	}
+	for k, perm := range keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return perm, nil
+		}
+	}
+	if r.Header.Get("X-API-Key") != "" {
+		return 0, fmt.Errorf("%w: unknown API key", ErrUnauthorized)
+	}
+	return 0, errNoCredentials // 可能是 JWT
+}
+
+// JWTAuth 验证 Authorization: Bearer 中用 Secret 签名的 HS256 JWT.
+// 权限取自 scope (同 ParsePermission), 支持 exp 和 nbf
+type JWTAuth struct {
+	Secret []byte
+	Leeway time.Duration // 检查 exp 和 nbf 时允许的时钟误差
+}
+
+// Claims JWT 中用到的字段
+type Claims struct {
+	Subject   string `json:"sub,omitempty"`
+	Scope     string `json:"scope"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// NewToken 生成 ttl 后过期, 带 perm 权限的 JWT, ttl 为 0 时不过期
+func NewToken(secret []byte, subject string, perm Permission, ttl time.Duration) (string, error) {
+	claims := Claims{Subject: subject, Scope: perm.String()}
+	if ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signing + "." + base64.RawURLEncoding.EncodeToString(hmacSum(secret, signing)), nil
+}
+
+func (a *JWTAuth) Authenticate(r *http.Request) (Permission, error) {
+	token := bearerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errNoCredentials
+	}
+	claims, err := a.verify(parts)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return ParsePermission(claims.Scope)
+}
+
+func (a *JWTAuth) verify(parts []string) (claims *Claims, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("invalid token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(b, &header) != nil || header.Alg != "HS256" {
+		return nil, errors.New("unsupported token algorithm")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, hmacSum(a.Secret, parts[0]+"."+parts[1])) {
+		return nil, errors.New("invalid token signature")
+	}
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("invalid token payload")
+	}
+	claims = new(Claims)
+	if json.Unmarshal(b, claims) != nil {
+		return nil, errors.New("invalid token payload")
+	}
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(a.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(a.Leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+func hmacSum(secret []byte, s string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// SignURL 生成在 expires 之前可以用 method 访问 rawURL 的预签名 URL, 用 Server.URLSecret 验证.
+// 签名包括 method, 路径和所有的查询参数, 修改任何一个都会失效. GET 的签名也可以用于 HEAD
+func SignURL(secret []byte, method, rawURL string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Del("signature")
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("signature", urlSignature(secret, method, u.Path, q))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// urlSignature 对 method, path 和除了 signature 以外的查询参数签名, HEAD 和 GET 相同
+func urlSignature(secret []byte, method, path string, q url.Values) string {
+	method = strings.ToUpper(method)
+	if method == "HEAD" {
+		method = "GET"
+	}
+	params := make(url.Values, len(q))
+	for k, v := range q {
+		if k != "signature" {
+			params[k] = v
+		}
+	}
+	return hex.EncodeToString(hmacSum(secret, method+"\n"+path+"\n"+params.Encode()))
+}
+
+// verifySignedURL 检查预签名 URL 的签名和过期时间
+func (s *Server) verifySignedURL(r *http.Request) error {
+	if len(s.URLSecret) == 0 {
+		return fmt.Errorf("%w: signed URLs are disabled", ErrForbidden)
+	}
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid expires", ErrForbidden)
+	}
+	if time.Now().Unix() > expires {
+		return fmt.Errorf("%w: URL expired", ErrForbidden)
+	}
+	if !hmac.Equal([]byte(q.Get("signature")), []byte(urlSignature(s.URLSecret, r.Method, r.URL.Path, q))) {
+		return fmt.Errorf("%w: invalid signature", ErrForbidden)
+	}
+	return nil
+}
+
+// methodPermission 按 method 决定需要的权限, 用于 /img 这种一个路径对应多种操作的接口
+func methodPermission(method string) Permission {
+	switch method {
+	case "GET", "HEAD":
+		return PermRead
+	case "DELETE":
+		return PermDelete
+	}
+	return PermWrite
+}
+
+// auth 检查请求是否有 perm 权限, perm 为 0 时按 method 决定. 没有设置 Auth 时不检查.
+// 带 signature 参数的请求按预签名 URL 检查, 不需要其它凭证
+func (s *Server) auth(perm Permission, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Auth == nil {
+			h(w, r)
+			return
+		}
+		need := perm
+		if need == 0 {
+			need = methodPermission(r.Method)
+		}
+		err := s.authorize(r, need)
+		if err != nil {
+			if errors.Is(err, ErrUnauthorized) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="simplefs"`)
+			}
+			writeErr(w, err)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// permitted 请求的凭证是否有 perm 权限, 没有设置 Auth 时总是有.
+// 预签名 URL 只授权签名的那个请求, 不算有其它权限
+func (s *Server) permitted(r *http.Request, perm Permission) bool {
+	if s.Auth == nil {
+		return true
+	}
+	if r.URL.Query().Has("signature") {
+		return false
+	}
+	granted, err := s.Auth.Authenticate(r)
+	return err == nil && granted&perm == perm
+}
+
+func (s *Server) authorize(r *http.Request, perm Permission) error {
+	if r.URL.Query().Has("signature") {
+		return s.verifySignedURL(r)
+	}
+	granted, err := s.Auth.Authenticate(r)
+	if err != nil {
+		if !errors.Is(err, ErrUnauthorized) {
+			err = fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+		return err
+	}
+	if granted&perm != perm {
+		return fmt.Errorf("%w: %s permission required", ErrForbidden, perm)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePermission(t *testing.T) {
+	perm, err := ParsePermission("read, write")
+	assert.NoError(t, err)
+	assert.Equal(t, PermRead|PermWrite, perm)
+	assert.Equal(t, "read write", perm.String())
+	perm, err = ParsePermission("all")
+	assert.NoError(t, err)
+	assert.Equal(t, PermAll, perm)
+	perm, err = ParsePermission("")
+	assert.NoError(t, err)
+	assert.Equal(t, Permission(0), perm)
+	_, err = ParsePermission("read admin")
+	assert.Error(t, err)
+}
+
+func TestJWTAuth(t *testing.T) {
+	secret := []byte("secret")
+	a := &JWTAuth{Secret: secret}
+	authenticate := func(token string) (Permission, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return a.Authenticate(r)
+	}
+
+	token, err := NewToken(secret, "alice", PermRead|PermDelete, time.Hour)
+	assert.NoError(t, err)
+	perm, err := authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, PermRead|PermDelete, perm)
+
+	other, err := NewToken([]byte("other"), "alice", PermAll, time.Hour)
+	assert.NoError(t, err)
+	_, err = authenticate(other)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	expired, err := NewToken(secret, "alice", PermAll, -time.Hour)
+	assert.NoError(t, err)
+	_, err = authenticate(expired)
+	assert.NoError(t, err) // ttl <= 0 不过期
+	claims := `{"scope":"all","exp":1}`
+	_, err = authenticate(jwtHeader + "." + b64(claims) + "." + b64(string(hmacSum(secret, jwtHeader+"."+b64(claims)))))
+	assert.ErrorContains(t, err, "expired")
+
+	none := b64(`{"alg":"none"}`) + "." + b64(`{"scope":"all"}`) + "."
+	_, err = authenticate(none)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	_, err = authenticate("")
+	assert.Equal(t, errNoCredentials, err)
+}
+
+func TestServer_Auth(t *testing.T) {
+	s := newTestServer(t)
+	secret := []byte("jwt secret")
+	s.Auth = Authenticators{APIKeys{"reader": PermRead, "admin": PermAll}, &JWTAuth{Secret: secret}}
+	request := func(method, target, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader([]byte("%PDF-1.4 data")))
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		return serve(s, r)
+	}
+
+	w := request("PUT", "/files/1", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, CodeUnauthorized, decodeError(t, w).Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	w = request("PUT", "/files/1", "reader")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, CodeForbidden, decodeError(t, w).Code)
+	w = request("PUT", "/files/1", "admin")
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = request("GET", "/files/1", "reader")
+	assert.Equal(t, http.StatusOK, w.Code)
+	// 带凭证的响应不能被共享缓存保存, PUT 写入的文件每次都要重新验证
+	assert.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"Authorization", "X-API-Key"}, w.Header().Values("Vary"))
+	w = request("GET", "/img?id=1", "reader")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request("DELETE", "/img?id=1", "reader")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request("GET", "/files/1", "unknown")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	token, err := NewToken(secret, "bob", PermDelete, time.Minute)
+	assert.NoError(t, err)
+	w = request("GET", "/files/1", token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request("DELETE", "/files/1", token)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	r := httptest.NewRequest("GET", "/files/1", nil)
+	r.Header.Set("X-API-Key", "wrong")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestServer_SignedURL(t *testing.T) {
+	s := newTestServer(t)
+	s.Auth = APIKeys{"admin": PermAll}
+	s.URLSecret = []byte("url secret")
+
+	put, err := SignURL(s.URLSecret, "PUT", "/files/1?name=a.pdf", time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	w := serve(s, httptest.NewRequest("PUT", put, bytes.NewReader([]byte("%PDF-1.4 data"))))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	// PUT 的签名不能用于 GET 和 DELETE
+	w = serve(s, httptest.NewRequest("GET", put, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serve(s, httptest.NewRequest("DELETE", put, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	get, err := SignURL(s.URLSecret, "GET", "/files/1", time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	w = serve(s, httptest.NewRequest("GET", get, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "%PDF-1.4 data", w.Body.String())
+	w = serve(s, httptest.NewRequest("HEAD", get, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve(s, httptest.NewRequest("GET", strings.Replace(get, "/files/1", "/files/2", 1), nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serve(s, httptest.NewRequest("GET", get+"&download", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	expired, err := SignURL(s.URLSecret, "GET", "/files/1", time.Now().Add(-time.Second))
+	assert.NoError(t, err)
+	w = serve(s, httptest.NewRequest("GET", expired, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, decodeError(t, w).Message, "expired")
+
+	forged, err := SignURL([]byte("guess"), "GET", "/files/1", time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	w = serve(s, httptest.NewRequest("GET", forged, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func b64(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// MaxBatchSize batch-delete 和 batch-stat 一次最多的 id 数
+const MaxBatchSize = 1000
+
+// BatchRequest batch-delete 和 batch-stat 的请求, id 和上传结果一样用字符串表示
+type BatchRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BatchDeleteResult batch-delete 中一个 id 的结果, 没有 error 表示删除成功 (包括之前已经删除)
+type BatchDeleteResult struct {
+	ID    string `json:"id"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// FileStat batch-stat 中一个 id 的结果, 索引中没有这个 id 时只有 id, exists 和 error
+type FileStat struct {
+	ID      string `json:"id"`
+	Exists  bool   `json:"exists"`
+	Deleted bool   `json:"deleted"`
+	Expired bool   `json:"expired"`
+	*FileInfo
+	Error *Error `json:"error,omitempty"`
+}
+
+// FileInfo 索引中记录的文件元数据
+type FileInfo struct {
+	Size        uint64     `json:"size"`
+	Filename    string     `json:"filename"`
+	Ext         string     `json:"ext"`
+	ContentType string     `json:"content_type"`
+	Checksum    uint32     `json:"checksum"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// 图片的宽, 高和格式 (jpeg, png 或 gif), 上传时记录, 不是图片时没有
+	Width  uint32 `json:"width,omitempty"`
+	Height uint32 `json:"height,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+func newFileInfo(n *core.Needle) *FileInfo {
+	info := &FileInfo{
+		Size:        n.Size,
+		Filename:    n.Filename,
+		Ext:         n.FileExt,
+		ContentType: needleContentType(n),
+		Checksum:    n.Checksum,
+		CreatedAt:   n.CreatedAt,
+		UpdatedAt:   n.UpdatedAt,
+	}
+	if !n.ExpiresAt.IsZero() {
+		info.ExpiresAt = &n.ExpiresAt
+	}
+	if n.Width != 0 {
+		info.Width, info.Height = n.Width, n.Height
+		mediatype, _, _ := mime.ParseMediaType(n.ContentType)
+		info.Format = strings.TrimPrefix(mediatype, "image/")
+	}
+	return info
+}
+
+// BatchUploadResult 批量上传中一个文件的结果, 成功时带 UploadResult 的字段, 失败时带 error.
+// Name 是客户端上传时的文件名, 保存的文件名是清理过的
+type BatchUploadResult struct {
+	Name string `json:"name"`
+	*UploadResult
+	Error *Error `json:"error,omitempty"`
+}
+
+// batchUpload POST /files/batch, body 是 multipart 表单 (每个带文件名的 part 都是一个文件)
+// 或者 Content-Type 为 application/x-tar 的 tar 包 (只取普通文件).
+// 所有文件用 Manager.NewFiles 写入, 主 Volume 放不下的存为 chunk, 返回和上传顺序一致的结果数组.
+func (s *Server) batchUpload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	ttl, ok := parseTTL(w, r.URL.Query().Get("ttl"))
+	if !ok {
+		return
+	}
+	s.limitBody(w, r)
+	var files []core.File
+	var err error
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ctype {
+	case "multipart/form-data":
+		files, err = readMultipartFiles(r)
+	case "application/x-tar":
+		files, err = readTarFiles(r.Body)
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedType, "Unsupported content type: "+ctype)
+		return
+	}
+	if err != nil {
+		status, code := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			status, code = http.StatusBadRequest, CodeBadRequest
+		}
+		writeError(w, status, code, "Upload fail: "+err.Error())
+		return
+	}
+	if len(files) == 0 {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Upload fail: no file")
+		return
+	}
+	// 类型不允许的文件不写入, 其余的一起写入
+	resp := make([]BatchUploadResult, len(files))
+	strip := s.stripMetadata(r)
+	var valid []core.File
+	var index []int
+	for i, f := range files {
+		resp[i].Name = f.Name
+		ctype, err := s.contentType(f.Data, f.ContentType)
+		if err != nil {
+			resp[i].Error = newError(err)
+			continue
+		}
+		data, meta, err := processImage(f.Data, strip)
+		if err != nil {
+			resp[i].Error = newError(err)
+			continue
+		}
+		valid = append(valid, core.File{
+			Name:        SanitizeFilename(f.Name),
+			Data:        data,
+			ContentType: ctype,
+			Width:       meta.Width,
+			Height:      meta.Height,
+		})
+		index = append(index, i)
+	}
+	results, err := s.Manager.NewFiles(s.Volume, valid, &core.FileOptions{TTL: ttl})
+	if err != nil {
+		log.Println("File storing err: ", err)
+		writeErr(w, err)
+		return
+	}
+	for j, res := range results {
+		i := index[j]
+		if res.Err != nil {
+			resp[i].Error = newError(res.Err)
+			continue
+		}
+		resp[i].UploadResult = newUploadResult(res.Needle)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func readMultipartFiles(r *http.Request) (files []core.File, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, core.File{Name: part.FileName(), Data: data, ContentType: part.Header.Get("Content-Type")})
+	}
+}
+
+func readTarFiles(r io.Reader) (files []core.File, err error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, core.File{Name: hdr.Name, Data: data})
+	}
+}
+
+// readBatchRequest 解析 batch-delete 和 batch-stat 的请求, 失败时直接返回 400.
+// 返回的 ids 中格式错误的 id 为 0, 对应的 errs 不为 nil.
+func readBatchRequest(w http.ResponseWriter, r *http.Request) (req BatchRequest, ids []uint64, errs []*Error, ok bool) {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		status, code := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			status, code = http.StatusBadRequest, CodeBadRequest
+		}
+		writeError(w, status, code, "Wrong request: "+err.Error())
+		return
+	}
+	if len(req.IDs) > MaxBatchSize {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Too many ids, max "+strconv.Itoa(MaxBatchSize))
+		return
+	}
+	ids = make([]uint64, len(req.IDs))
+	errs = make([]*Error, len(req.IDs))
+	for i, s := range req.IDs {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			errs[i] = &Error{Code: CodeBadRequest, Message: "Wrong format id: " + s}
+			continue
+		}
+		ids[i] = id
+	}
+	return req, ids, errs, true
+}
+
+// batchDelete POST /files/batch-delete, 所有合法的 id 在一个 Batch 中删除
+func (s *Server) batchDelete(w http.ResponseWriter, r *http.Request) {
+	req, ids, errs, ok := readBatchRequest(w, r)
+	if !ok {
+		return
+	}
+	var valid []uint64
+	for i, id := range ids {
+		if errs[i] == nil {
+			valid = append(valid, id)
+		}
+	}
+	delErrs, err := s.Manager.DelFiles(s.Volume, valid)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	resp := make([]BatchDeleteResult, len(ids))
+	j := 0
+	for i := range ids {
+		resp[i].ID = req.IDs[i]
+		if errs[i] != nil {
+			resp[i].Error = errs[i]
+			continue
+		}
+		if err := delErrs[j]; err != nil {
+			resp[i].Error = newError(err)
+		}
+		j++
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// batchStat POST /files/batch-stat, 只查索引, 不读文件内容
+func (s *Server) batchStat(w http.ResponseWriter, r *http.Request) {
+	req, ids, errs, ok := readBatchRequest(w, r)
+	if !ok {
+		return
+	}
+	// 所有 id 在同一个快照中读取, 读完后再查 Manifest
+	needles, err := core.GetNeedles(s.Volume.Directory, ids)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	now := time.Now()
+	resp := make([]FileStat, len(ids))
+	for i, n := range needles {
+		resp[i].ID = req.IDs[i]
+		if errs[i] != nil {
+			resp[i].Error = errs[i]
+			continue
+		}
+		if n == nil {
+			resp[i].Error = newError(core.ErrNeedleNotFound)
+			continue
+		}
+		s.statNeedle(&resp[i], n, now)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// statNeedle 按索引中的 n 填充 stat, 大文件的 size 取自 Manifest
+func (s *Server) statNeedle(stat *FileStat, n *core.Needle, now time.Time) {
+	stat.Deleted = n.Deleted()
+	stat.Expired = n.Expired(now)
+	stat.Exists = !stat.Deleted && !stat.Expired
+	stat.FileInfo = newFileInfo(n)
+	if n.IsManifest() && stat.Exists {
+		manifest, err := s.Manager.ReadManifest(s.Volume, n.ID)
+		if err != nil {
+			stat.Error = newError(err)
+			return
+		}
+		stat.Size = manifest.Size
+	}
+}
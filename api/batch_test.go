@@ -0,0 +1,158 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func decodeBatch(t *testing.T, w *httptest.ResponseRecorder) []BatchUploadResult {
+	var results []BatchUploadResult
+	err := json.NewDecoder(w.Body).Decode(&results)
+	assert.NoError(t, err)
+	return results
+}
+
+func TestServer_BatchUpload_Multipart(t *testing.T) {
+	s := newTestServer(t)
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("comment", "not a file")
+	for _, name := range []string{"a.png", "b.pdf"} {
+		fw, err := mw.CreateFormFile("files", name)
+		assert.NoError(t, err)
+		fw.Write([]byte("data of " + name))
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/files/batch", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	results := decodeBatch(t, w)
+	assert.Len(t, results, 2)
+	for i, name := range []string{"a.png", "b.pdf"} {
+		assert.Equal(t, name, results[i].Name)
+		assert.Nil(t, results[i].Error)
+		assert.NotNil(t, results[i].UploadResult)
+		w = serve(s, httptest.NewRequest("GET", results[i].URL, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "data of "+name, w.Body.String())
+	}
+}
+
+func TestServer_BatchUpload_Tar(t *testing.T) {
+	s := newTestServer(t)
+	body := new(bytes.Buffer)
+	tw := tar.NewWriter(body)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	files := map[string]string{"dir/a.txt": "aaa", "dir/b.json": "{}"}
+	for _, name := range []string{"dir/a.txt", "dir/b.json"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))})
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	r := httptest.NewRequest("POST", "/files/batch", body)
+	r.Header.Set("Content-Type", "application/x-tar")
+	w := serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	results := decodeBatch(t, w)
+	assert.Len(t, results, 2)
+	for _, res := range results {
+		assert.Nil(t, res.Error)
+		data, _, err := s.Volume.GetFile(res.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, files[res.Name], string(data))
+	}
+}
+
+func TestServer_BatchUpload_Errors(t *testing.T) {
+	s := newTestServer(t)
+	w := serve(s, httptest.NewRequest("POST", "/files/batch", bytes.NewReader([]byte("raw"))))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, CodeUnsupportedType, decodeError(t, w).Code)
+
+	r := httptest.NewRequest("POST", "/files/batch", new(bytes.Buffer))
+	r.Header.Set("Content-Type", "application/x-tar")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func batchRequest(t *testing.T, s *Server, target string, ids ...string) *httptest.ResponseRecorder {
+	body, err := json.Marshal(BatchRequest{IDs: ids})
+	assert.NoError(t, err)
+	return serve(s, httptest.NewRequest("POST", target, bytes.NewReader(body)))
+}
+
+func TestServer_BatchDeleteAndStat(t *testing.T) {
+	s := newTestServer(t)
+	id1, err := s.Volume.NewFile([]byte("one"), "1.png")
+	assert.NoError(t, err)
+	id2, err := s.Volume.NewFile([]byte("two"), "2.pdf")
+	assert.NoError(t, err)
+	fid1, fid2 := strconv.FormatUint(id1, 10), strconv.FormatUint(id2, 10)
+
+	w := batchRequest(t, s, "/files/batch-delete", fid1, "404", "xyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var deleted []BatchDeleteResult
+	err = json.NewDecoder(w.Body).Decode(&deleted)
+	assert.NoError(t, err)
+	assert.Len(t, deleted, 3)
+	assert.Nil(t, deleted[0].Error)
+	assert.Equal(t, CodeNotFound, deleted[1].Error.Code)
+	assert.Equal(t, CodeBadRequest, deleted[2].Error.Code)
+
+	w = batchRequest(t, s, "/files/batch-stat", fid1, fid2, "404")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats []FileStat
+	err = json.NewDecoder(w.Body).Decode(&stats)
+	assert.NoError(t, err)
+	assert.Len(t, stats, 3)
+	assert.Equal(t, fid1, stats[0].ID)
+	assert.False(t, stats[0].Exists)
+	assert.True(t, stats[0].Deleted)
+	assert.True(t, stats[1].Exists)
+	assert.Equal(t, uint64(3), stats[1].Size)
+	assert.Equal(t, "pdf", stats[1].Ext)
+	assert.Equal(t, "2.pdf", stats[1].Filename)
+	assert.Nil(t, stats[1].ExpiresAt)
+	assert.False(t, stats[2].Exists)
+	assert.Nil(t, stats[2].FileInfo)
+	assert.Equal(t, CodeNotFound, stats[2].Error.Code)
+}
+
+func TestServer_BatchRequest_Errors(t *testing.T) {
+	s := newTestServer(t)
+	w := serve(s, httptest.NewRequest("POST", "/files/batch-stat", bytes.NewReader([]byte("{"))))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	ids := make([]string, MaxBatchSize+1)
+	w = batchRequest(t, s, "/files/batch-delete", ids...)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_BatchUpload_Types(t *testing.T) {
+	s := newTestServer(t)
+	s.AllowedTypes = []string{"image/png"}
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("files", "a.png")
+	fw.Write(pngHeader)
+	fw, _ = mw.CreateFormFile("files", "b.png")
+	fw.Write([]byte("text"))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/files/batch", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	results := decodeBatch(t, w)
+	assert.Len(t, results, 2)
+	assert.Nil(t, results[0].Error)
+	assert.NotNil(t, results[0].UploadResult)
+	assert.Equal(t, CodeUnsupportedType, results[1].Error.Code)
+	assert.Nil(t, results[1].UploadResult)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// discardWriter 丢弃所有内容的 http.ResponseWriter, 只测 handler 本身的开销
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+// copyGetFile 改成 io.SectionReader 之前的实现: volume -> []byte -> string -> response
+func (s *Server) copyGetFile(w http.ResponseWriter, r *http.Request, id uint64) {
+	data, ext, err := s.Volume.GetFile(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType(ext))
+	fmt.Fprint(w, string(data))
+}
+
+func benchmarkGetFile(b *testing.B, size int, get func(s *Server, w http.ResponseWriter, r *http.Request, id uint64)) {
+	s := NewServer(0, b.TempDir())
+	data := make([]byte, size)
+	rand.Read(data)
+	id, err := s.Volume.NewFile(data, "bench.bin")
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", fileURL(id), nil)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		get(s, &discardWriter{header: make(http.Header)}, r, id)
+	}
+}
+
+func BenchmarkGetFile_Copy(b *testing.B) {
+	for _, size := range []int{4 << 10, 1 << 20, 16 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			benchmarkGetFile(b, size, (*Server).copyGetFile)
+		})
+	}
+}
+
+func BenchmarkGetFile_Section(b *testing.B) {
+	for _, size := range []int{4 << 10, 1 << 20, 16 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			benchmarkGetFile(b, size, (*Server).getFile)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hmli/simplefs/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_Cache(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("jpeg data")
+	w := doUpload(t, s.Mux.ServeHTTP, "/files", "a.jpg", data)
+	var up UploadResult
+	err := json.NewDecoder(w.Body).Decode(&up)
+	assert.NoError(t, err)
+
+	w = serve(s, httptest.NewRequest("GET", up.URL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	tag := fmt.Sprintf(`"%x-%08x"`, len(data), utils.Checksum(data))
+	assert.Equal(t, tag, w.Header().Get("ETag"))
+	assert.Equal(t, "public, max-age=31536000", w.Header().Get("Cache-Control"))
+	modified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), modified, 2*time.Second)
+
+	r := httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("If-None-Match", tag)
+	w = serve(s, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	r = httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("If-None-Match", `"other"`)
+	w = serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r = httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	w = serve(s, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	r = httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	w = serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(data), w.Body.String())
+
+	s.CacheMaxAge = 0
+	w = serve(s, httptest.NewRequest("GET", up.URL, nil))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	// PUT 写入的文件可以被替换, 每次都要重新验证
+	s.CacheMaxAge = DefaultCacheMaxAge
+	w = serve(s, httptest.NewRequest("PUT", "/files/42?name=b.jpg", bytes.NewReader(data)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/42", nil))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, tag, w.Header().Get("ETag"))
+}
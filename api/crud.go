@@ -1,110 +1,491 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime"
+	"net"
 	"net/http"
-	"github.com/hmli/simplefs/core"
-	"github.com/hmli/simplefs/utils"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+	"github.com/hmli/simplefs/manager"
 )
 
+// DefaultCacheMaxAge needle 写入后不会再改变, 默认让客户端和 CDN 缓存一年
+const DefaultCacheMaxAge = 365 * 24 * time.Hour
+
+// DefaultShutdownTimeout 默认等待进行中的请求完成的时间
+const DefaultShutdownTimeout = 30 * time.Second
+
+// DefaultReapInterval 默认给过期文件打删除标记的间隔
+const DefaultReapInterval = 10 * time.Minute
+
 type Server struct {
-	Mux    *http.ServeMux
-	Port   int
-	Volume *core.Volume
+	Mux         *http.ServeMux
+	Port        int
+	Addr        string // 监听的地址, 比如 127.0.0.1:8008, 为空时监听所有地址的 Port
+	Volume      *core.Volume
+	Manager     *manager.Manager // 管理存放大文件 chunk 的 Volume, Volume 也在其中
+	CacheMaxAge time.Duration    // 文件的 Cache-Control max-age, 0 表示每次都要重新验证
+	// UploadTimeout 可续传上传超过这个时间没有新数据就会被清理
+	UploadTimeout time.Duration
+	// MaxUploadSize 一次上传请求 body 的上限, 批量上传时是所有文件加起来的上限, 0 表示不限制
+	MaxUploadSize int64
+	// MaxResumableSize 可续传上传的文件大小上限, 0 表示不限制
+	MaxResumableSize int64
+	// AllowedTypes 和 DeniedTypes 按内容判断的 MIME 类型, 支持 image/* 这样的通配.
+	// AllowedTypes 为空时允许所有类型
+	AllowedTypes []string
+	DeniedTypes  []string
+	// CacheThumbnails 把生成的缩略图保存为原图的衍生 needle, 同样的请求不用再生成
+	CacheThumbnails bool
+	// ThumbnailSizes 任何人都可以保存的缩略图尺寸, 格式为 宽x高, 比如 200x200, 200x0. 见 ParseThumbnailSize.
+	// 其它尺寸只在请求有写权限时保存, 否则每次重新生成, 只有读权限的请求不能创建任意多的 needle
+	ThumbnailSizes []string
+	// StripMetadata 所有上传的图片都去掉 EXIF/XMP 等元数据, 否则只有请求带 strip=1 时才去掉
+	StripMetadata bool
+	// Auth 检查请求的凭证和权限, nil 时不检查. 见 APIKeys 和 JWTAuth
+	Auth Authenticator
+	// URLSecret 验证 SignURL 生成的预签名 URL, 为空时不接受预签名 URL. 只在设置了 Auth 时使用
+	URLSecret []byte
+	// TLS 不为 nil 时使用 HTTPS 和 HTTP/2
+	TLS *TLSConfig
+	// ShutdownTimeout Run 收到 SIGINT 或 SIGTERM 后等待进行中的请求完成的最长时间
+	ShutdownTimeout time.Duration
+	// SyncInterval 定期把所有 Volume 刷到磁盘的间隔, 0 表示不定期刷. 见 core.VolumeConfig.SyncWrites
+	SyncInterval time.Duration
+	// ReapInterval 定期给所有 Volume 中过期的文件打删除标记的间隔, 0 表示不清理. 见 core.Volume.Reap
+	ReapInterval time.Duration
+
+	uploads     *uploadStore
+	lock        sync.Mutex
+	srv         *http.Server
+	stopCleaner func()
+	stopSyncer  func()
+	stopReaper  func()
+	shutdown    sync.Once
+	done        chan struct{} // Shutdown 完成后关闭
+}
+
+// UploadResult 上传成功后返回的 JSON
+type UploadResult struct {
+	ID       uint64 `json:"id,string"`
+	Size     uint64 `json:"size"`
+	Checksum uint32 `json:"checksum"`
+	URL      string `json:"url"`
+}
+
+// Options 创建 Server 时的存储配置
+type Options struct {
+	Dir        string             // 主 Volume 的目录, 为空时为 core.DefaultDir
+	VolumesDir string             // 存放大文件 chunk 的 Volume 的目录, 为空时为 Dir/volumes
+	Volume     *core.VolumeConfig // 打开和新建 Volume 的配置
+	VolumeSize uint64             // Volume 的大小, 0 表示 core.MaxVolumeSize
+	ChunkSize  uint64             // 大文件切分的 chunk 大小, 0 表示 manager.DefaultChunkSize
 }
 
-// TODO 把 fmt.Print 改成 log
 func NewServer(port int, dir string) *Server {
-	v, err := core.NewVolume(1, dir)
+	s, err := NewServerWithOptions(&Options{Dir: dir})
 	if err != nil {
-		if err != io.EOF {
-			panic(err)
-		}
+		panic(err)
+	}
+	s.Port = port
+	return s
+}
+
+// NewServerWithOptions 按 opt 打开 Volume, 返回的 Server 使用默认的配置
+func NewServerWithOptions(opt *Options) (s *Server, err error) {
+	v, err := core.NewVolumeWithConfig(1, opt.Dir, opt.Volume)
+	if err != nil {
+		return nil, err
+	}
+	if opt.VolumeSize > 0 {
+		v.Size = opt.VolumeSize
+	}
+	volumesDir := opt.VolumesDir
+	if volumesDir == "" {
+		volumesDir = filepath.Join(v.Path, "volumes")
+	}
+	m, err := manager.New(volumesDir, opt.Volume)
+	if err == nil {
+		err = m.AddVolume(v)
 	}
-	return &Server{
-		Mux:    http.NewServeMux(),
-		Port:   port,
-		Volume: v,
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+	m.VolumeSize = opt.VolumeSize
+	if opt.ChunkSize > 0 {
+		m.ChunkSize = opt.ChunkSize
+	}
+	uploads, err := newUploadStore(filepath.Join(v.Path, "uploads"))
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	s = &Server{
+		Mux:              http.NewServeMux(),
+		Volume:           v,
+		Manager:          m,
+		CacheMaxAge:      DefaultCacheMaxAge,
+		UploadTimeout:    DefaultUploadTimeout,
+		MaxUploadSize:    DefaultMaxUploadSize,
+		MaxResumableSize: DefaultMaxResumableSize,
+		CacheThumbnails:  true,
+		ShutdownTimeout:  DefaultShutdownTimeout,
+		ReapInterval:     DefaultReapInterval,
+		uploads:          uploads,
+		done:             make(chan struct{}),
 	}
+	s.routes()
+	return s, nil
 }
 
-func (s *Server) Run() {
-	s.Mux.HandleFunc("/img", s.FileHandler)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", s.Port), s.Mux)
+// Run 在 Addr 或 Port 上启动服务, 见 Serve
+func (s *Server) Run() (err error) {
+	ln, err := net.Listen("tcp", s.addr())
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return s.Serve(ln)
 }
 
-func (s *Server) FileHandler(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	fmt.Println(r.Method)
-	switch r.Method {
-	case "GET": // TODO cache with E-Tag
-		r.ParseForm()
-		id := r.Form.Get("id")
-		idInt, err := strconv.Atoi(id)
-		if err != nil {
-			fmt.Fprint(w, "Wrong format id: ", id)
-			return
+// Serve 在 ln 上提供服务, 收到 SIGINT 或 SIGTERM 后调用 Shutdown, 最多等待 ShutdownTimeout.
+// 其它地方调用了 Shutdown 时等它完成后返回 nil. 服务出错时关闭所有 Volume 并返回错误
+func (s *Server) Serve(ln net.Listener) (err error) {
+	srv, err := s.httpServer()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	s.lock.Lock()
+	select {
+	case <-s.done:
+		s.lock.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	default:
+	}
+	s.srv = srv
+	s.stopCleaner = s.StartUploadCleaner(s.UploadTimeout / 4)
+	if s.SyncInterval > 0 {
+		s.stopSyncer = s.Manager.StartSyncer(s.SyncInterval)
+	}
+	if s.ReapInterval > 0 {
+		s.stopReaper = s.Manager.StartReaper(s.ReapInterval)
+	}
+	s.lock.Unlock()
+
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(ln, "", "")
+		} else {
+			errc <- srv.Serve(ln)
 		}
-		data, ext, err := s.Volume.GetFile(uint64(idInt))
-		if err != nil {
-			fmt.Fprint(w, "No file")
-			return
+	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err = <-errc:
+		if err == http.ErrServerClosed {
+			<-s.done
+			return nil
 		}
-		fmt.Println("Ext: ", ext, "lendata: ", len(data))
-		w.Header().Set("Content-Type", ContentType(ext))
-		fmt.Fprint(w, string(data))
-		return
-	case "POST":
-		r.ParseMultipartForm(32 << 20)
-		fmt.Println(r.MultipartForm)
-		fmt.Println(r.Form)
-		file, header, err := r.FormFile("file")
-		fmt.Printf("file: %+v, %+v, err %s", file, header, err)
-		if err != nil {
-			fmt.Println(err)
-			fmt.Fprint(w, "Upload fail")
-			return
+		s.Shutdown(context.Background())
+		return err
+	case <-ctx.Done():
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+		defer cancel()
+		return s.Shutdown(ctx)
+	}
+}
+
+// Shutdown 停止接受新的请求, 等待进行中的请求 (包括上传) 完成, 停止后台任务, 然后把所有 Volume 刷到磁盘并关闭.
+// ctx 结束时强制关闭还没完成的连接, 依然会关闭 Volume, 返回 ctx 的错误. 只有第一次调用生效
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.shutdown.Do(func() {
+		s.lock.Lock()
+		srv, stopCleaner, stopSyncer, stopReaper := s.srv, s.stopCleaner, s.stopSyncer, s.stopReaper
+		s.lock.Unlock()
+		if srv != nil {
+			err = srv.Shutdown(ctx)
+			if err != nil {
+				srv.Close()
+			}
 		}
-		filename := header.Filename
-		fmt.Println("Filename:", filename)
-		data, err := ioutil.ReadAll(file)
-		if err != nil {
-			fmt.Fprint(w, "File content err")
-			return
+		if stopCleaner != nil {
+			stopCleaner()
 		}
-		id, err := s.Volume.NewFile(data, filename)
-		if err != nil {
-			fmt.Fprint(w, "File storing err")
-			return
+		if stopSyncer != nil {
+			stopSyncer()
 		}
-		fmt.Fprint(w, id)
-	case "DELETE":
-		r.ParseForm()
-		id := r.Form.Get("id")
-		idInt, err := strconv.Atoi(id)
+		if stopReaper != nil {
+			stopReaper()
+		}
+		if e := s.Manager.Close(); err == nil {
+			err = e
+		}
+		close(s.done)
+	})
+	return err
+}
+
+func (s *Server) addr() string {
+	if s.Addr != "" {
+		return s.Addr
+	}
+	return fmt.Sprintf(":%d", s.Port)
+}
+
+// httpServer 按配置生成 http.Server, 配置了 TLS 时带上 TLSConfig
+func (s *Server) httpServer() (srv *http.Server, err error) {
+	srv = &http.Server{Addr: s.addr(), Handler: s.Mux}
+	if s.TLS != nil {
+		srv.TLSConfig, err = s.TLS.Build()
 		if err != nil {
-			fmt.Fprint(w, "Wrong format id: ", id)
+			return nil, err
+		}
+	}
+	return srv, nil
+}
+
+// FileHandler 兼容老的 /img?id= 接口
+func (s *Server) FileHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "GET", "HEAD":
+		id, ok := parseID(w, r.FormValue("id"))
+		if !ok {
 			return
 		}
-		err = s.Volume.DelNeedle(uint64(idInt))
-		if err != nil {
-			fmt.Fprint(w, err)
+		s.getFile(w, r, id)
+	case "POST":
+		s.uploadFile(w, r)
+	case "DELETE":
+		id, ok := parseID(w, r.FormValue("id"))
+		if !ok {
 			return
 		}
-		fmt.Fprint(w, id)
+		s.deleteFile(w, r, id)
 	default:
-		fmt.Fprint(w, "Invalid method")
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Invalid method: "+r.Method)
+	}
+}
+
+// getFile 通过 io.SectionReader 直接从 Volume 文件返回内容, 不经过中间的 []byte.
+// 支持 HEAD, Range 和 If-None-Match / If-Modified-Since, 不校验 checksum.
+// 带 w 或 h 参数时返回缩略图.
+func (s *Server) getFile(w http.ResponseWriter, r *http.Request, id uint64) {
+	if isThumbnail(r.URL.Query()) {
+		s.getThumbnail(w, r, id)
+		return
+	}
+	n, err := s.Volume.GetNeedle(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	defer n.Close()
+	if n.Parent != 0 {
+		// 生成的 needle 只能通过原图的缩略图参数访问, 原图替换后就不会再被读到
+		writeErr(w, core.ErrNeedleNotFound)
+		return
+	}
+	content, closer, err := s.openContent(n)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	defer closer.Close()
+	s.serveNeedle(w, r, n, content)
+}
+
+// openContent needle 的内容, 大文件按 Manifest 从各个 chunk 中读取. 读完后调用 closer.Close 释放 chunk
+func (s *Server) openContent(n *core.Needle) (content *io.SectionReader, closer io.Closer, err error) {
+	if !n.IsManifest() {
+		return n.Section(), n, nil
+	}
+	manifest, err := s.Manager.ReadManifest(s.Volume, n.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr, err := s.Manager.OpenManifest(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NewSectionReader(cr, 0, cr.Size()), cr, nil
+}
+
+// serveNeedle 按 n 的元数据设置 header, 返回 content
+func (s *Server) serveNeedle(w http.ResponseWriter, r *http.Request, n *core.Needle, content io.ReadSeeker) {
+	filename := n.Filename
+	if name := r.PathValue("filename"); name != "" {
+		filename = name
+	}
+	ctype := needleContentType(n)
+	passive := isPassiveType(ctype)
+	disposition := "inline"
+	if r.URL.Query().Has("download") || !passive {
+		disposition = "attachment"
+	}
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	} else if disposition == "attachment" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	if !passive {
+		// HTML, SVG 这样可以执行脚本的内容即使被直接打开也不能访问这个域名下的数据
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag(n))
+	s.setCacheControl(w, n.Replaceable())
+	http.ServeContent(w, r, "", n.UpdatedAt, content)
+}
+
+// etag 由 needle 的大小和 checksum 组成
+func etag(n *core.Needle) string {
+	return fmt.Sprintf(`"%x-%08x"`, n.Size, n.Checksum)
+}
+
+// setCacheControl 设置文件的 Cache-Control. 开启了认证时响应只能由客户端自己缓存,
+// 不能让 CDN 和共享代理把带凭证的响应返回给其它人. replaceable 的文件每次都要用 ETag 重新验证
+func (s *Server) setCacheControl(w http.ResponseWriter, replaceable bool) {
+	cc := "no-cache"
+	if s.CacheMaxAge > 0 && !replaceable {
+		cc = "max-age=" + strconv.FormatInt(int64(s.CacheMaxAge/time.Second), 10)
 	}
+	if s.Auth != nil {
+		w.Header().Set("Cache-Control", "private, "+cc)
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+		return
+	}
+	if s.CacheMaxAge > 0 && !replaceable {
+		cc = "public, " + cc
+	}
+	w.Header().Set("Cache-Control", cc)
 }
 
+// uploadFile 从 multipart 表单的 file 字段上传
+func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		status, code := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			status, code = http.StatusBadRequest, CodeBadRequest
+		}
+		writeError(w, status, code, "Upload fail: "+err.Error())
+		return
+	}
+	ttl, ok := parseTTL(w, r.FormValue("ttl"))
+	if !ok {
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Upload fail: "+err.Error())
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	ctype, err := s.contentType(data, header.Header.Get("Content-Type"))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	data, meta, err := processImage(data, s.stripMetadata(r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	id, err := s.Manager.NewFile(s.Volume, bytes.NewReader(data), uint64(len(data)), SanitizeFilename(header.Filename), &core.FileOptions{TTL: ttl, ContentType: ctype, Width: meta.Width, Height: meta.Height})
+	if err != nil {
+		log.Println("File storing err: ", err)
+		writeErr(w, err)
+		return
+	}
+	s.writeUploadResult(w, http.StatusCreated, id)
+}
+
+func (s *Server) writeUploadResult(w http.ResponseWriter, status int, id uint64) {
+	n, err := s.Volume.GetNeedle(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	n.Close() // 只用到 header
+	writeJSON(w, status, newUploadResult(n))
+}
+
+func newUploadResult(n *core.Needle) *UploadResult {
+	return &UploadResult{
+		ID:       n.ID,
+		Size:     n.Size,
+		Checksum: n.Checksum,
+		URL:      fileURL(n.ID),
+	}
+}
+
+func (s *Server) deleteFile(w http.ResponseWriter, r *http.Request, id uint64) {
+	errs, err := s.Manager.DelFiles(s.Volume, []uint64{id})
+	if err == nil {
+		err = errs[0]
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseID 解析 id, 失败时直接返回 400
+func parseID(w http.ResponseWriter, s string) (id uint64, ok bool) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Wrong format id: "+s)
+		return 0, false
+	}
+	return id, true
+}
+
+// parseTTL 解析上传时的 ttl 参数 (比如 24h), 为空时返回 0, 使用 Volume 的 TTL
+func parseTTL(w http.ResponseWriter, s string) (ttl time.Duration, ok bool) {
+	if s == "" {
+		return 0, true
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Wrong ttl: "+s)
+		return 0, false
+	}
+	return ttl, true
+}
+
+// ContentType 按扩展名判断 MIME 类型, 不在下面的表中时查 mime 包的表, 都没有时返回 application/octet-stream
 func ContentType(ext string) (ctype string) {
-	switch ext {
+	switch strings.ToLower(ext) {
 	case "jpg", "jpeg":
 		return "image/jpeg"
 	case "pdf":
@@ -114,10 +495,37 @@ func ContentType(ext string) (ctype string) {
 	case "json":
 		return "application/json"
 	case "js":
-		return "applicaton/javascript"
+		return "application/javascript"
 	case "gif":
 		return "image/gif"
-	default:
-		return "application/octet-sream"
 	}
+	if ext != "" {
+		if ctype = mime.TypeByExtension("." + ext); ctype != "" {
+			return ctype
+		}
+	}
+	return "application/octet-stream"
+}
+
+// isPassiveType 浏览器直接打开时不会执行脚本的类型: 位图, PDF, 音视频和纯文本.
+// 其它类型 (包括 SVG 和 HTML) 只能作为附件下载
+func isPassiveType(ctype string) bool {
+	mediatype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	switch mediatype {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "image/avif",
+		"application/pdf", "text/plain":
+		return true
+	}
+	return strings.HasPrefix(mediatype, "audio/") || strings.HasPrefix(mediatype, "video/")
+}
+
+// needleContentType 优先使用上传时记录的类型
+func needleContentType(n *core.Needle) string {
+	if n.ContentType != "" {
+		return n.ContentType
+	}
+	return ContentType(n.FileExt)
 }
@@ -1,10 +1,21 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hmli/simplefs/core"
+	"github.com/hmli/simplefs/utils"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestNewServer(t *testing.T) {
@@ -35,3 +46,244 @@ func TestServer_FileHandler(t *testing.T) {
 	t.Log(data, ext, err)
 
 }
+
+func newTestServer(t *testing.T) *Server {
+	s := NewServer(0, t.TempDir())
+	assert.NotNil(t, s.Volume)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func doUpload(t *testing.T, h http.HandlerFunc, target string, filename string, data []byte) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", filename)
+	assert.NoError(t, err)
+	fw.Write(data)
+	mw.Close()
+	r := httptest.NewRequest("POST", target, body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) Error {
+	var resp errorResponse
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	assert.NoError(t, err)
+	return resp.Error
+}
+
+func TestServer_FileHandler_Status(t *testing.T) {
+	s := newTestServer(t)
+	w := doUpload(t, s.FileHandler, "/img", "a.png", []byte("png data"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var up UploadResult
+	err := json.NewDecoder(w.Body).Decode(&up)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8), up.Size)
+	assert.Equal(t, utils.Checksum([]byte("png data")), up.Checksum)
+	assert.Equal(t, fmt.Sprintf("/files/%d", up.ID), up.URL)
+	img := fmt.Sprintf("/img?id=%d", up.ID)
+
+	w = httptest.NewRecorder()
+	s.FileHandler(w, httptest.NewRequest("GET", img, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "png data", w.Body.String())
+
+	cases := []struct {
+		method string
+		target string
+		status int
+		code   string
+	}{
+		{"GET", "/img?id=abc", http.StatusBadRequest, CodeBadRequest},
+		{"GET", "/img?id=1", http.StatusNotFound, CodeNotFound},
+		{"POST", "/img", http.StatusBadRequest, CodeBadRequest},
+		{"PUT", "/img", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{"DELETE", "/img?id=1", http.StatusNotFound, CodeNotFound},
+		{"DELETE", img, http.StatusNoContent, ""},
+		{"GET", img, http.StatusGone, CodeDeleted},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		s.FileHandler(w, httptest.NewRequest(c.method, c.target, nil))
+		assert.Equal(t, c.status, w.Code, c.method+" "+c.target)
+		if c.code != "" {
+			assert.Equal(t, c.code, decodeError(t, w).Code, c.method+" "+c.target)
+		}
+	}
+}
+
+func TestServer_Upload_VolumeFull(t *testing.T) {
+	// 主 Volume 只剩下放 Manifest 的空间, 所有上传方式的文件内容都存到其它 Volume 中
+	s := newTestServer(t)
+	s.Volume.Size = s.Volume.CurrentOffset + 2000
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	var urls []string
+	decode := func(w *httptest.ResponseRecorder) {
+		var up UploadResult
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&up))
+		urls = append(urls, up.URL)
+	}
+	w := doUpload(t, s.FileHandler, "/img", "a.txt", data)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	decode(w)
+	w = doUpload(t, s.Mux.ServeHTTP, "/files", "b.txt", data)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	decode(w)
+	w = serve(s, httptest.NewRequest("PUT", "/files/1000?name=c.txt", bytes.NewReader(data)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	decode(w)
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for _, name := range []string{"d.txt", "e.txt"} {
+		fw, err := mw.CreateFormFile("files", name)
+		assert.NoError(t, err)
+		fw.Write(data)
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/files/batch", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w = serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, res := range decodeBatch(t, w) {
+		assert.Nil(t, res.Error)
+		if res.UploadResult != nil {
+			urls = append(urls, res.URL)
+		}
+	}
+
+	assert.Len(t, urls, 5)
+	assert.Greater(t, len(s.Manager.Volumes()), 1)
+	for _, u := range urls {
+		w = serve(s, httptest.NewRequest("GET", u, nil))
+		assert.Equal(t, http.StatusOK, w.Code, u)
+		assert.Equal(t, data, w.Body.Bytes(), u)
+	}
+}
+
+func TestServer_Upload_TTL(t *testing.T) {
+	s := newTestServer(t)
+	w := doUpload(t, s.Mux.ServeHTTP, "/files?ttl=1h", "a.txt", []byte("data"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var up UploadResult
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&up))
+	n, err := s.Volume.Directory.Get(up.ID)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), n.ExpiresAt, 2*time.Second)
+
+	w = serve(s, httptest.NewRequest("PUT", "/files/1000?name=b.txt&ttl=1h", bytes.NewReader([]byte("data"))))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	n, err = s.Volume.Directory.Get(1000)
+	assert.NoError(t, err)
+	assert.False(t, n.ExpiresAt.IsZero())
+
+	for _, target := range []string{"/files?ttl=abc", "/files?ttl=-1h", "/files/batch?ttl=0"} {
+		w = doUpload(t, s.Mux.ServeHTTP, target, "a.txt", []byte("data"))
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		assert.Equal(t, CodeBadRequest, decodeError(t, w).Code, target)
+	}
+	w = serve(s, httptest.NewRequest("PUT", "/files/1001?ttl=1x", bytes.NewReader([]byte("data"))))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestErrorStatus(t *testing.T) {
+	status, code := errorStatus(fmt.Errorf("Get needle: %w", core.ErrLeakSpace))
+	assert.Equal(t, http.StatusInsufficientStorage, status)
+	assert.Equal(t, CodeNoSpace, code)
+	status, code = errorStatus(&http.MaxBytesError{Limit: 1})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, CodeTooLarge, code)
+	status, code = errorStatus(core.ErrExpired)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, CodeExpired, code)
+	status, code = errorStatus(&typeError{"text/html"})
+	assert.Equal(t, http.StatusUnsupportedMediaType, status)
+	assert.Equal(t, CodeUnsupportedType, code)
+	status, code = errorStatus(fmt.Errorf("%w: URL expired", ErrForbidden))
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, CodeForbidden, code)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer(0, dir)
+	started, release := make(chan struct{}), make(chan struct{})
+	s.Mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := "http://" + ln.Addr().String()
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(addr + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		slow <- result{string(body), err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	// 不再接受新的连接, 但会等进行中的请求完成
+	assert.Eventually(t, func() bool {
+		_, err := net.Dial("tcp", ln.Addr().String())
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the request finished")
+	default:
+	}
+	close(release)
+	res := <-slow
+	assert.NoError(t, res.err)
+	assert.Equal(t, "done", res.body)
+	assert.NoError(t, <-shutdown)
+	assert.NoError(t, <-served)
+
+	_, err = s.Volume.GetNeedle(1)
+	assert.ErrorIs(t, err, core.ErrClosed)
+	// Volume 和 Directory 都已关闭, 可以重新打开
+	v, err := core.NewVolume(1, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, v.Close())
+}
+
+func TestServer_Shutdown_Timeout(t *testing.T) {
+	s := NewServer(0, t.TempDir())
+	started := make(chan struct{})
+	s.Mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Serve(ln)
+	go http.Get("http://" + ln.Addr().String() + "/slow")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = s.Volume.GetNeedle(1)
+	assert.ErrorIs(t, err, core.ErrClosed)
+}
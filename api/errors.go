@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// 错误码, 客户端应该按 code 而不是 message 判断错误
+const (
+	CodeBadRequest       = "bad_request"
+	CodeNotFound         = "not_found"
+	CodeExpired          = "expired"
+	CodeDeleted          = "deleted"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeConflict         = "conflict"
+	CodeTooLarge         = "too_large"
+	CodeUnsupportedType  = "unsupported_type"
+	CodeNameTooLong      = "name_too_long"
+	CodeNoSpace          = "no_space"
+	CodeChecksum         = "checksum_mismatch"
+	CodeInternal         = "internal"
+	CodeUnavailable      = "unavailable"
+)
+
+// Error 返回给客户端的错误
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error Error `json:"error"`
+}
+
+// coreErrors core 中的错误 -> HTTP status 和错误码
+var coreErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{core.ErrNeedleNotFound, http.StatusNotFound, CodeNotFound},
+	{core.ErrExpired, http.StatusNotFound, CodeExpired},
+	{core.ErrDeleted, http.StatusGone, CodeDeleted},
+	{core.ErrLeakSpace, http.StatusInsufficientStorage, CodeNoSpace},
+	{core.ErrLongName, http.StatusBadRequest, CodeNameTooLong},
+	{core.ErrWrongCheckSum, http.StatusInternalServerError, CodeChecksum},
+	{core.ErrClosed, http.StatusServiceUnavailable, CodeUnavailable},
+	{core.ErrWrongCursor, http.StatusBadRequest, CodeBadRequest},
+	{core.ErrTTLMismatch, http.StatusBadRequest, CodeBadRequest},
+	{core.ErrConflict, http.StatusConflict, CodeConflict},
+}
+
+// errorStatus 找出 err 对应的 HTTP status 和错误码
+func errorStatus(err error) (status int, code string) {
+	for _, e := range coreErrors {
+		if errors.Is(err, e.err) {
+			return e.status, e.code
+		}
+	}
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return http.StatusRequestEntityTooLarge, CodeTooLarge
+	}
+	if errors.Is(err, errTypeNotAllowed) || errors.Is(err, errNotImage) {
+		return http.StatusUnsupportedMediaType, CodeUnsupportedType
+	}
+	if errors.Is(err, errImageTooLarge) {
+		return http.StatusRequestEntityTooLarge, CodeTooLarge
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		return http.StatusUnauthorized, CodeUnauthorized
+	}
+	if errors.Is(err, ErrForbidden) {
+		return http.StatusForbidden, CodeForbidden
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, errorResponse{Error{Code: code, Message: message}})
+}
+
+// newError 按 err 的类型生成 Error, 用于批量接口中单个文件的结果
+func newError(err error) *Error {
+	_, code := errorStatus(err)
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// writeErr 按 err 的类型返回对应的错误
+func writeErr(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	writeError(w, status, code, err.Error())
+}
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// StripQuality 按 EXIF 方向旋转后重新编码 JPEG 的质量
+	StripQuality = 95
+	// metaLen 读取图片信息时最多看的字节数, EXIF 最大 64KB, 尺寸一般紧随其后
+	metaLen = 256 << 10
+)
+
+// imageMeta 上传时读到的图片信息, 旋转过的 JPEG 是旋转后的宽高
+type imageMeta struct {
+	Width  uint32
+	Height uint32
+}
+
+// stripMetadata 请求带 strip=1 或者开启了 StripMetadata 时, 上传的图片要去掉元数据
+func (s *Server) stripMetadata(r *http.Request) bool {
+	strip, err := strconv.ParseBool(r.URL.Query().Get("strip"))
+	if err != nil {
+		return s.StripMetadata
+	}
+	return strip
+}
+
+// processImage 读取 JPEG, PNG 或 GIF 的宽高, 不是这几种图片时原样返回 data.
+// strip 为 true 时去掉 JPEG 和 PNG 中的 EXIF, XMP 和文本信息, 保留颜色配置;
+// JPEG 的方向不是 1 时按方向旋转后重新编码, 这样去掉方向信息后依然显示正确.
+// 像素太多的 JPEG 不解码旋转, 只保留 EXIF 中的方向.
+func processImage(data []byte, strip bool) (out []byte, meta imageMeta, err error) {
+	conf, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, meta, nil
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	meta = imageMeta{uint32(conf.Width), uint32(conf.Height)}
+	if orientation >= 5 {
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+	if !strip {
+		return data, meta, nil
+	}
+	switch format {
+	case "jpeg":
+		if orientation == 1 {
+			return stripJPEG(data), meta, nil
+		}
+		if conf.Width*conf.Height > MaxImagePixels {
+			return insertSegments(stripJPEG(data), orientationSegment(orientation)), meta, nil
+		}
+		src, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, meta, errNotImage
+		}
+		buf := new(bytes.Buffer)
+		err = jpeg.Encode(buf, orient(src, orientation), &jpeg.Options{Quality: StripQuality})
+		if err != nil {
+			return nil, meta, err
+		}
+		// 重新编码会丢掉颜色配置, 从原图复制过来
+		return insertSegments(buf.Bytes(), iccSegments(data)...), meta, nil
+	case "png":
+		return stripPNG(data), meta, nil
+	}
+	return data, meta, nil
+}
+
+// imageMetaHead 同 processImage 但不修改图片, 只需要文件开头的一部分
+func imageMetaHead(head []byte) (meta imageMeta) {
+	_, meta, _ = processImage(head, false)
+	return meta
+}
+
+// jpegSegments 依次调用 fn 处理 SOS 之前的每个段 (包括段的标记和长度), fn 返回 false 时停止.
+// 返回 SOS 开始的位置, 格式不对时返回 -1
+func jpegSegments(data []byte, fn func(marker byte, seg []byte) bool) int {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return -1
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return -1
+		}
+		marker := data[i+1]
+		if marker == 0xff { // 填充
+			i++
+			continue
+		}
+		if marker == 0xda {
+			return i
+		}
+		l := int(binary.BigEndian.Uint16(data[i+2:]))
+		if l < 2 || i+2+l > len(data) {
+			return -1
+		}
+		if !fn(marker, data[i:i+2+l]) {
+			return i
+		}
+		i += 2 + l
+	}
+	return -1
+}
+
+// jpegOrientation 读取 EXIF 中的方向 (1-8), 没有时返回 1
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, seg []byte) bool {
+		if marker != 0xe1 || !bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")) {
+			return true
+		}
+		if o := exifOrientation(seg[10:]); o >= 1 && o <= 8 {
+			orientation = o
+		}
+		return false
+	})
+	return orientation
+}
+
+// exifOrientation 在 TIFF 结构的 IFD0 中找方向 (0x0112), 没有时返回 0
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 { // SHORT
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// stripJPEG 去掉 APP1 (EXIF, XMP), APP13 (IPTC) 和注释, 不重新编码
+func stripJPEG(data []byte) []byte {
+	out := []byte{0xff, 0xd8}
+	sos := jpegSegments(data, func(marker byte, seg []byte) bool {
+		if marker != 0xe1 && marker != 0xed && marker != 0xfe {
+			out = append(out, seg...)
+		}
+		return true
+	})
+	if sos < 0 {
+		return data
+	}
+	return append(out, data[sos:]...)
+}
+
+// iccSegments JPEG 中保存 ICC 颜色配置的 APP2 段
+func iccSegments(data []byte) (segs [][]byte) {
+	jpegSegments(data, func(marker byte, seg []byte) bool {
+		if marker == 0xe2 && bytes.HasPrefix(seg[4:], []byte("ICC_PROFILE\x00")) {
+			segs = append(segs, seg)
+		}
+		return true
+	})
+	return segs
+}
+
+// orientationSegment 只有方向的 EXIF 段
+func orientationSegment(orientation int) []byte {
+	seg := []byte("\xff\xe1\x00\x22Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01")
+	seg = binary.BigEndian.AppendUint16(seg, uint16(orientation))
+	return append(seg, 0, 0, 0, 0, 0, 0)
+}
+
+// insertSegments 把 segs 插到 JPEG 的 SOI 之后
+func insertSegments(data []byte, segs ...[]byte) []byte {
+	if len(segs) == 0 || len(data) < 2 {
+		return data
+	}
+	out := append([]byte{}, data[:2]...)
+	for _, seg := range segs {
+		out = append(out, seg...)
+	}
+	return append(out, data[2:]...)
+}
+
+// stripPNG 去掉 eXIf 和文本块 (XMP 在 iTXt 中), 不重新编码
+func stripPNG(data []byte) []byte {
+	const sigLen = 8
+	if len(data) < sigLen {
+		return data
+	}
+	out := append([]byte{}, data[:sigLen]...)
+	for i := sigLen; i < len(data); {
+		if i+8 > len(data) {
+			return data
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return data
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out
+}
+
+// orient 按 EXIF 方向把 src 转成正常显示的方向
+func orient(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := sw, sh
+	if orientation >= 5 {
+		w, h = sh, sw
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = sw-1-x, y
+			case 3:
+				sx, sy = sw-1-x, sh-1-y
+			case 4:
+				sx, sy = x, sh-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, sh-1-x
+			case 7:
+				sx, sy = sw-1-y, sh-1-x
+			case 8:
+				sx, sy = sw-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// exifJPEG 编码 img, 在 SOI 后插入带方向和一段 GPS 文本的 EXIF 段
+func exifJPEG(t *testing.T, img image.Image, orientation uint16) []byte {
+	buf := new(bytes.Buffer)
+	assert.NoError(t, jpeg.Encode(buf, img, nil))
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01")
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	tiff = append(tiff, "GPS 31.2304N 121.4737E"...)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xff, 0xe1}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	seg = append(seg, payload...)
+	data := buf.Bytes()
+	return append(append([]byte{0xff, 0xd8}, seg...), data[2:]...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	for o := uint16(1); o <= 8; o++ {
+		assert.Equal(t, int(o), jpegOrientation(exifJPEG(t, testImage(4, 2), o)))
+	}
+	buf := new(bytes.Buffer)
+	assert.NoError(t, jpeg.Encode(buf, testImage(4, 2), nil))
+	assert.Equal(t, 1, jpegOrientation(buf.Bytes()))
+	assert.Equal(t, 1, jpegOrientation([]byte("not a jpeg")))
+}
+
+func TestProcessImage_JPEG(t *testing.T) {
+	data := exifJPEG(t, testImage(40, 20), 1)
+	out, meta, err := processImage(data, false)
+	assert.NoError(t, err)
+	assert.Equal(t, data, out)
+	assert.Equal(t, imageMeta{40, 20}, meta)
+
+	out, meta, err = processImage(data, true)
+	assert.NoError(t, err)
+	assert.Equal(t, imageMeta{40, 20}, meta)
+	assert.NotContains(t, string(out), "GPS")
+	assert.Equal(t, len(data)-len(out), bytes.Index(data, []byte{0xff, 0xdb})-2) // 只去掉了 EXIF 段
+	_, err = jpeg.Decode(bytes.NewReader(out))
+	assert.NoError(t, err)
+
+	// 方向 6 顺时针旋转 90 度后显示
+	data = exifJPEG(t, testImage(40, 20), 6)
+	out, meta, err = processImage(data, false)
+	assert.NoError(t, err)
+	assert.Equal(t, imageMeta{20, 40}, meta)
+	out, meta, err = processImage(data, true)
+	assert.NoError(t, err)
+	assert.Equal(t, imageMeta{20, 40}, meta)
+	assert.NotContains(t, string(out), "GPS")
+	assert.Equal(t, 1, jpegOrientation(out))
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 20, 40), img.Bounds())
+
+	// 旋转后保留 ICC 颜色配置
+	icc := []byte("\xff\xe2\x00\x14ICC_PROFILE\x00\x01\x01fake")
+	out, _, err = processImage(insertSegments(data, icc), true)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{icc}, iccSegments(out))
+	_, err = jpeg.Decode(bytes.NewReader(out))
+	assert.NoError(t, err)
+
+	// 像素太多时不旋转, 依然去掉元数据, 只保留方向
+	sof := bytes.Index(data, []byte{0xff, 0xc0})
+	binary.BigEndian.PutUint16(data[sof+5:], 10000)
+	binary.BigEndian.PutUint16(data[sof+7:], 10000)
+	out, meta, err = processImage(data, true)
+	assert.NoError(t, err)
+	assert.Equal(t, imageMeta{10000, 10000}, meta)
+	assert.NotContains(t, string(out), "GPS")
+	assert.Equal(t, 6, jpegOrientation(out))
+	assert.Equal(t, data[sof:], out[len(out)-len(data)+sof:])
+}
+
+func TestProcessImage_PNG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, testImage(8, 6)))
+	data := buf.Bytes()
+	// 在 IHDR 之后插入一个 tEXt 块
+	text := []byte("tEXtComment\x00GPS 31.2304N")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(text))
+	data = append(append(append([]byte{}, data[:33]...), chunk...), data[33:]...)
+
+	out, meta, err := processImage(data, true)
+	assert.NoError(t, err)
+	assert.Equal(t, imageMeta{8, 6}, meta)
+	assert.Equal(t, buf.Bytes(), out)
+
+	out, meta, err = processImage([]byte("plain text"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, imageMeta{}, meta)
+	assert.Equal(t, []byte("plain text"), out)
+}
+
+func TestOrient(t *testing.T) {
+	src := testImage(3, 2)
+	for o := 1; o <= 8; o++ {
+		dst := orient(src, o)
+		if o >= 5 {
+			assert.Equal(t, image.Rect(0, 0, 2, 3), dst.Bounds(), "%d", o)
+		} else {
+			assert.Equal(t, image.Rect(0, 0, 3, 2), dst.Bounds(), "%d", o)
+		}
+	}
+	// 方向 6: 原图左下角转到左上角
+	assert.Equal(t, rgba(src.At(0, 1)), rgba(orient(src, 6).At(0, 0)))
+	// 方向 8: 原图右上角转到左上角
+	assert.Equal(t, rgba(src.At(2, 0)), rgba(orient(src, 8).At(0, 0)))
+}
+
+func rgba(c interface{ RGBA() (r, g, b, a uint32) }) [4]uint32 {
+	r, g, b, a := c.RGBA()
+	return [4]uint32{r, g, b, a}
+}
+
+func TestServer_Upload_StripMetadata(t *testing.T) {
+	s := newTestServer(t)
+	data := exifJPEG(t, testImage(40, 20), 6)
+	w := serve(s, httptest.NewRequest("PUT", "/files/1?name=a.jpg&strip=1", bytes.NewReader(data)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("PUT", "/files/2?name=b.jpg", bytes.NewReader(data)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = serve(s, httptest.NewRequest("GET", "/files/1", nil))
+	assert.NotContains(t, w.Body.String(), "GPS")
+	w = serve(s, httptest.NewRequest("GET", "/files/2", nil))
+	assert.Contains(t, w.Body.String(), "GPS")
+
+	w = batchRequest(t, s, "/files/batch-stat", "1", "2")
+	var stats []FileStat
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+	for _, stat := range stats {
+		assert.Equal(t, uint32(20), stat.Width)
+		assert.Equal(t, uint32(40), stat.Height)
+		assert.Equal(t, "jpeg", stat.Format)
+	}
+}
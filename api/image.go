@@ -0,0 +1,279 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hmli/simplefs/core"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// MaxThumbnailSize 缩略图的宽和高的上限
+	MaxThumbnailSize = 4096
+	// MaxImagePixels 原图像素数的上限, 防止解码时占用太多内存
+	MaxImagePixels = 50 * 1000 * 1000
+	// DefaultQuality 没有指定 q 时 JPEG 的质量
+	DefaultQuality = 85
+)
+
+// 缩放模式
+const (
+	ModeFit  = "fit"  // 等比缩放到 w x h 以内
+	ModeFill = "fill" // 等比缩放到覆盖 w x h, 再从中间裁剪
+)
+
+var (
+	errNotImage      = errors.New("Not a JPEG, PNG or GIF image")
+	errImageTooLarge = errors.New("Image has too many pixels")
+)
+
+// thumbnailOptions 缩略图的参数
+type thumbnailOptions struct {
+	Width   int
+	Height  int
+	Mode    string
+	Quality int
+}
+
+// isThumbnail 请求中带 w 或 h 时返回缩略图
+func isThumbnail(q url.Values) bool {
+	return q.Get("w") != "" || q.Get("h") != ""
+}
+
+func parseThumbnailOptions(q url.Values) (opt thumbnailOptions, err error) {
+	opt.Mode = ModeFit
+	opt.Quality = DefaultQuality
+	for _, p := range []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"w", &opt.Width, 0, MaxThumbnailSize},
+		{"h", &opt.Height, 0, MaxThumbnailSize},
+		{"q", &opt.Quality, 1, 100},
+	} {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		*p.value, err = strconv.Atoi(s)
+		if err != nil || *p.value < p.min || *p.value > p.max {
+			return opt, fmt.Errorf("Wrong %s: %s, should be in [%d, %d]", p.name, s, p.min, p.max)
+		}
+	}
+	if opt.Width == 0 && opt.Height == 0 {
+		return opt, errors.New("w or h is required")
+	}
+	switch mode := q.Get("mode"); mode {
+	case "", ModeFit:
+	case ModeFill:
+		opt.Mode = ModeFill
+	default:
+		return opt, errors.New("Wrong mode: " + mode)
+	}
+	return opt, nil
+}
+
+// ParseThumbnailSize 解析 宽x高 格式的缩略图尺寸, 其中一个可以为 0, 表示按原图比例计算
+func ParseThumbnailSize(s string) (width, height int, err error) {
+	ws, hs, ok := strings.Cut(s, "x")
+	if ok {
+		width, err = strconv.Atoi(ws)
+	}
+	if ok && err == nil {
+		height, err = strconv.Atoi(hs)
+	}
+	if !ok || err != nil || width < 0 || height < 0 || width > MaxThumbnailSize || height > MaxThumbnailSize || width == 0 && height == 0 {
+		return 0, 0, fmt.Errorf("Wrong thumbnail size: %q, should be WIDTHxHEIGHT", s)
+	}
+	return width, height, nil
+}
+
+// cacheThumbnail 是否保存 opt 的缩略图: 尺寸在 ThumbnailSizes 中, 或者请求有写权限
+func (s *Server) cacheThumbnail(r *http.Request, opt thumbnailOptions) bool {
+	if !s.CacheThumbnails {
+		return false
+	}
+	for _, size := range s.ThumbnailSizes {
+		w, h, err := ParseThumbnailSize(size)
+		if err == nil && w == opt.Width && h == opt.Height {
+			return true
+		}
+	}
+	return s.permitted(r, PermWrite)
+}
+
+// thumbnailID 缩略图 needle 的 id 由原图和参数决定, 同样的请求总是得到同一个 needle.
+// 原图被 PUT 替换后 checksum 变了, 不会再用到之前的缩略图
+func thumbnailID(parent *core.Needle, opt thumbnailOptions) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%x/%dx%d/%s/%d", parent.ID, parent.Checksum, opt.Width, opt.Height, opt.Mode, opt.Quality)
+	return h.Sum64()
+}
+
+// getThumbnail 返回 id 的缩略图. cacheThumbnail 时缩略图作为 Parent 为原图的 needle 保存,
+// 之后同样的请求直接返回保存的 needle. 缩略图的 id 与上传的文件共用, 只覆盖不存在的或者同一个原图的缩略图
+func (s *Server) getThumbnail(w http.ResponseWriter, r *http.Request, id uint64) {
+	opt, err := parseThumbnailOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	parent, err := s.Volume.GetNeedle(id)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	defer parent.Close()
+	tid := thumbnailID(parent, opt)
+	if n, err := s.Volume.GetNeedle(tid); err == nil {
+		defer n.Close()
+		if n.Parent == id {
+			s.serveNeedle(w, r, n, n.Section())
+			return
+		}
+	}
+	content, closer, err := s.openContent(parent)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	defer closer.Close()
+	data, ctype, err := makeThumbnail(content, opt)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if !s.cacheThumbnail(r, opt) {
+		s.serveThumbnail(w, r, parent, data, ctype)
+		return
+	}
+	// 只有 tid 不存在, 或者是这个原图已删除或过期的缩略图时才写入, 检查和写入是原子的
+	old, err := s.Volume.Directory.Get(tid)
+	if errors.Is(err, core.ErrNeedleNotFound) {
+		old, err = nil, nil
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if old != nil && old.Parent != id {
+		s.serveThumbnail(w, r, parent, data, ctype)
+		return
+	}
+	err = s.Volume.CompareAndPutFile(tid, old, data, parent.Filename, &core.FileOptions{ContentType: ctype, Parent: id, Replaceable: parent.Replaceable()})
+	if errors.Is(err, core.ErrConflict) {
+		s.serveThumbnail(w, r, parent, data, ctype)
+		return
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	n, err := s.Volume.GetNeedle(tid)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	defer n.Close()
+	s.serveNeedle(w, r, n, n.Section())
+}
+
+// serveThumbnail 返回没有保存的缩略图
+func (s *Server) serveThumbnail(w http.ResponseWriter, r *http.Request, parent *core.Needle, data []byte, ctype string) {
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	s.setCacheControl(w, parent.Replaceable())
+	http.ServeContent(w, r, "", parent.UpdatedAt, bytes.NewReader(data))
+}
+
+// makeThumbnail 解码 JPEG, PNG 或 GIF (第一帧), 缩放后按原来的格式编码
+func makeThumbnail(r io.ReadSeeker, opt thumbnailOptions) (data []byte, ctype string, err error) {
+	conf, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	if conf.Width*conf.Height > MaxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	dst := resize(src, opt)
+	buf := new(bytes.Buffer)
+	switch format {
+	case "jpeg":
+		ctype = "image/jpeg"
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: opt.Quality})
+	case "png":
+		ctype = "image/png"
+		err = png.Encode(buf, dst)
+	case "gif":
+		ctype = "image/gif"
+		paletted := image.NewPaletted(dst.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), dst, dst.Bounds().Min)
+		err = gif.Encode(buf, paletted, nil)
+	default:
+		return nil, "", errNotImage
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ctype, nil
+}
+
+// resize 按 opt 缩放 src, 不会放大
+func resize(src image.Image, opt thumbnailOptions) image.Image {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	if sw == 0 || sh == 0 {
+		return src
+	}
+	tw, th := opt.Width, opt.Height
+	if tw == 0 {
+		tw = sw * th / sh
+	}
+	if th == 0 {
+		th = sh * tw / sw
+	}
+	var w, h int
+	crop := sb
+	if opt.Mode == ModeFill {
+		// 缩放到刚好覆盖 tw x th, 从原图中间裁出和目标相同比例的部分
+		scale := max(float64(tw)/float64(sw), float64(th)/float64(sh))
+		cropW, cropH := max(int(float64(tw)/scale+0.5), 1), max(int(float64(th)/scale+0.5), 1)
+		x0, y0 := sb.Min.X+(sw-cropW)/2, sb.Min.Y+(sh-cropH)/2
+		crop = image.Rect(x0, y0, x0+cropW, y0+cropH).Intersect(sb)
+		w, h = tw, th
+		if scale > 1 { // 不放大, 只裁剪
+			w, h = crop.Dx(), crop.Dy()
+		}
+	} else {
+		scale := min(float64(tw)/float64(sw), float64(th)/float64(sh), 1)
+		w, h = max(int(float64(sw)*scale+0.5), 1), max(int(float64(sh)*scale+0.5), 1)
+	}
+	if w == sw && h == sh && crop == sb {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hmli/simplefs/core"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return img
+}
+
+func putImage(t *testing.T, s *Server, target string, format string, img image.Image) {
+	buf := new(bytes.Buffer)
+	switch format {
+	case "png":
+		assert.NoError(t, png.Encode(buf, img))
+	case "jpeg":
+		assert.NoError(t, jpeg.Encode(buf, img, nil))
+	case "gif":
+		assert.NoError(t, gif.Encode(buf, img, nil))
+	}
+	w := serve(s, httptest.NewRequest("PUT", target, buf))
+	assert.Contains(t, []int{http.StatusCreated, http.StatusOK}, w.Code)
+}
+
+func TestParseThumbnailOptions(t *testing.T) {
+	opt, err := parseThumbnailOptions(url.Values{"w": {"200"}})
+	assert.NoError(t, err)
+	assert.Equal(t, thumbnailOptions{Width: 200, Mode: ModeFit, Quality: DefaultQuality}, opt)
+	opt, err = parseThumbnailOptions(url.Values{"w": {"10"}, "h": {"20"}, "mode": {"fill"}, "q": {"50"}})
+	assert.NoError(t, err)
+	assert.Equal(t, thumbnailOptions{Width: 10, Height: 20, Mode: ModeFill, Quality: 50}, opt)
+	for _, q := range []url.Values{
+		{"w": {"0"}},
+		{"w": {"-1"}},
+		{"w": {"99999"}},
+		{"w": {"abc"}},
+		{"w": {"10"}, "q": {"0"}},
+		{"w": {"10"}, "mode": {"stretch"}},
+	} {
+		_, err = parseThumbnailOptions(q)
+		assert.Error(t, err, q.Encode())
+	}
+}
+
+func TestResize(t *testing.T) {
+	src := testImage(400, 200)
+	cases := []struct {
+		opt  thumbnailOptions
+		w, h int
+	}{
+		{thumbnailOptions{Width: 100, Height: 100, Mode: ModeFit}, 100, 50},
+		{thumbnailOptions{Width: 100, Height: 100, Mode: ModeFill}, 100, 100},
+		{thumbnailOptions{Height: 50, Mode: ModeFit}, 100, 50},
+		{thumbnailOptions{Width: 800, Height: 800, Mode: ModeFit}, 400, 200},  // 不放大
+		{thumbnailOptions{Width: 300, Height: 300, Mode: ModeFill}, 200, 200}, // 只裁剪
+		{thumbnailOptions{Width: 40, Height: 10, Mode: ModeFill}, 40, 10},
+	}
+	for _, c := range cases {
+		b := resize(src, c.opt).Bounds()
+		assert.Equal(t, c.w, b.Dx(), "%+v", c.opt)
+		assert.Equal(t, c.h, b.Dy(), "%+v", c.opt)
+	}
+}
+
+func TestServer_Thumbnail(t *testing.T) {
+	s := newTestServer(t)
+	for _, format := range []string{"png", "jpeg", "gif"} {
+		putImage(t, s, "/files/1?name=a."+format, format, testImage(64, 32))
+		w := serve(s, httptest.NewRequest("GET", "/img?id=1&w=16&h=16&mode=fit&q=60", nil))
+		assert.Equal(t, http.StatusOK, w.Code, format)
+		assert.Equal(t, "image/"+format, w.Header().Get("Content-Type"))
+		img, got, err := image.Decode(w.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, format, got)
+		assert.Equal(t, image.Rect(0, 0, 16, 8), img.Bounds())
+	}
+
+	// 第二次直接返回保存的缩略图
+	w := serve(s, httptest.NewRequest("GET", "/files/1?w=16&h=16&mode=fill", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	parent, err := s.Volume.GetNeedle(1)
+	assert.NoError(t, err)
+	tid := thumbnailID(parent, thumbnailOptions{Width: 16, Height: 16, Mode: ModeFill, Quality: DefaultQuality})
+	n, err := s.Volume.GetNeedle(tid)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), n.Parent)
+	assert.Equal(t, etag(n), w.Header().Get("ETag"))
+	r := httptest.NewRequest("GET", "/files/1?w=16&h=16&mode=fill", nil)
+	r.Header.Set("If-None-Match", etag(n))
+	w = serve(s, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = serve(s, httptest.NewRequest("DELETE", "/files/1", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/1?w=16&h=16&mode=fill", nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+}
+
+func TestServer_Thumbnail_Errors(t *testing.T) {
+	s := newTestServer(t)
+	w := serve(s, httptest.NewRequest("PUT", "/files/1?name=a.txt", bytes.NewReader([]byte("not an image"))))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/img?id=1&w=10", nil))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/img?id=1&w=x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	s.CacheThumbnails = false
+	putImage(t, s, "/files/2?name=b.png", "png", testImage(20, 20))
+	w = serve(s, httptest.NewRequest("GET", "/img?id=2&w=10", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	parent, err := s.Volume.GetNeedle(2)
+	assert.NoError(t, err)
+	_, err = s.Volume.GetNeedle(thumbnailID(parent, thumbnailOptions{Width: 10, Mode: ModeFit, Quality: DefaultQuality}))
+	assert.ErrorIs(t, err, core.ErrNeedleNotFound)
+}
+
+func TestParseThumbnailSize(t *testing.T) {
+	w, h, err := ParseThumbnailSize("200x0")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{200, 0}, []int{w, h})
+	for _, s := range []string{"", "200", "0x0", "-1x10", "ax10", "10x99999"} {
+		_, _, err = ParseThumbnailSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestServer_Thumbnail_Keyspace(t *testing.T) {
+	s := newTestServer(t)
+	putImage(t, s, "/files/1?name=a.png", "png", testImage(20, 20))
+	parent, err := s.Volume.GetNeedle(1)
+	assert.NoError(t, err)
+	opt := thumbnailOptions{Width: 10, Mode: ModeFit, Quality: DefaultQuality}
+	tid := thumbnailID(parent, opt)
+
+	// 不覆盖同一个 id 的用户文件
+	w := serve(s, httptest.NewRequest("PUT", fmt.Sprintf("/files/%d?name=b.txt", tid), bytes.NewReader([]byte("user data"))))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/1?w=10", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	_, data, err := s.Volume.ReadFile(tid)
+	assert.NoError(t, err)
+	assert.Equal(t, "user data", string(data))
+
+	// 保存的缩略图不能直接访问, 原图替换后用新的缩略图
+	tid = thumbnailID(parent, thumbnailOptions{Width: 8, Mode: ModeFit, Quality: DefaultQuality})
+	w = serve(s, httptest.NewRequest("GET", "/files/1?w=8", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	n, err := s.Volume.GetNeedle(tid)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), n.Parent)
+	w = serve(s, httptest.NewRequest("GET", fmt.Sprintf("/files/%d", tid), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	putImage(t, s, "/files/1?name=a.png", "png", testImage(32, 16))
+	w = serve(s, httptest.NewRequest("GET", "/files/1?w=8", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	img, _, err := image.Decode(w.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 8, 4), img.Bounds())
+}
+
+func TestServer_Thumbnail_Permission(t *testing.T) {
+	s := newTestServer(t)
+	putImage(t, s, "/files/1?name=a.png", "png", testImage(20, 20))
+	s.Auth = APIKeys{"reader": PermRead, "writer": PermAll}
+	s.ThumbnailSizes = []string{"10x0"}
+	parent, err := s.Volume.GetNeedle(1)
+	assert.NoError(t, err)
+	cases := []struct {
+		key    string
+		width  int
+		stored bool
+	}{
+		{"reader", 12, false},
+		{"reader", 10, true},
+		{"writer", 14, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/files/1?w=%d", c.width), nil)
+		r.Header.Set("X-API-Key", c.key)
+		w := serve(s, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		_, err = s.Volume.GetNeedle(thumbnailID(parent, thumbnailOptions{Width: c.width, Mode: ModeFit, Quality: DefaultQuality}))
+		assert.Equal(t, c.stored, err == nil, "%+v", c)
+	}
+}
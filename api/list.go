@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// FileList GET /files 的结果, cursor 为空表示没有下一页
+type FileList struct {
+	Files  []FileStat `json:"files"`
+	Cursor string     `json:"cursor,omitempty"`
+}
+
+// listFiles GET /files, 按 filename, ext, created_after 和 created_before 分页列出文件.
+// 默认跳过已删除, 已过期和生成的 needle (比如缩略图), 带 all 时返回已删除和已过期的文件.
+// 被跳过的文件也占每页的数量, 所以一页可能少于 limit 但仍然有下一页.
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	all := r.URL.Query().Has("all")
+	needles, cursor, err := s.Volume.Directory.List(q)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	now := time.Now()
+	resp := FileList{Files: []FileStat{}, Cursor: cursor}
+	for _, n := range needles {
+		if n.Parent != 0 || !all && (n.Deleted() || n.Expired(now)) {
+			continue
+		}
+		stat := FileStat{ID: strconv.FormatUint(n.ID, 10)}
+		s.statNeedle(&stat, n, now)
+		resp.Files = append(resp.Files, stat)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseQuery 解析 GET /files 的参数, 时间为 RFC 3339 格式, limit 最大为 MaxBatchSize
+func parseQuery(values url.Values) (q *core.Query, err error) {
+	q = &core.Query{
+		Filename: values.Get("filename"),
+		Ext:      values.Get("ext"),
+		Cursor:   values.Get("cursor"),
+	}
+	if v := values.Get("created_after"); v != "" {
+		q.CreatedAfter, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("Wrong created_after: " + v)
+		}
+	}
+	if v := values.Get("created_before"); v != "" {
+		q.CreatedBefore, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("Wrong created_before: " + v)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit <= 0 || q.Limit > MaxBatchSize {
+			return nil, errors.New("Wrong limit: " + v)
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listFiles(t *testing.T, s *Server, target string) (list FileList) {
+	w := serve(s, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	return
+}
+
+func TestServer_ListFiles(t *testing.T) {
+	s := newTestServer(t)
+	var ids []string
+	for _, name := range []string{"a.png", "b.pdf", "c.png", "d.png"} {
+		id, err := s.Volume.NewFile([]byte("data of "+name), name)
+		assert.NoError(t, err)
+		ids = append(ids, strconv.FormatUint(id, 10))
+	}
+	id, _ := strconv.ParseUint(ids[3], 10, 64)
+	assert.NoError(t, s.Volume.DelNeedle(id))
+
+	list := listFiles(t, s, "/files")
+	assert.Len(t, list.Files, 3)
+	assert.Empty(t, list.Cursor)
+	assert.Equal(t, ids[0], list.Files[0].ID)
+	assert.True(t, list.Files[0].Exists)
+	assert.Equal(t, "a.png", list.Files[0].Filename)
+	assert.Equal(t, uint64(len("data of a.png")), list.Files[0].Size)
+
+	list = listFiles(t, s, "/files?all")
+	assert.Len(t, list.Files, 4)
+	assert.True(t, list.Files[3].Deleted)
+
+	list = listFiles(t, s, "/files?ext=png")
+	assert.Len(t, list.Files, 2)
+	list = listFiles(t, s, "/files?filename=b.pdf")
+	assert.Len(t, list.Files, 1)
+	assert.Equal(t, ids[1], list.Files[0].ID)
+	list = listFiles(t, s, "/files?created_before="+time.Now().Add(-time.Hour).Format(time.RFC3339))
+	assert.Empty(t, list.Files)
+
+	// 分页
+	var got []string
+	cursor := ""
+	for {
+		list = listFiles(t, s, "/files?limit=2&cursor="+cursor)
+		for _, f := range list.Files {
+			got = append(got, f.ID)
+		}
+		if list.Cursor == "" {
+			break
+		}
+		cursor = list.Cursor
+	}
+	assert.Equal(t, ids[:3], got)
+
+	for _, target := range []string{"/files?limit=0", "/files?limit=x", "/files?created_after=yesterday", "/files?cursor=!!"} {
+		w := serve(s, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		assert.Equal(t, CodeBadRequest, decodeError(t, w).Code)
+	}
+}
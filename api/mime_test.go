@@ -0,0 +1,65 @@
+package api
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContentType(t *testing.T) {
+	assert.Equal(t, "image/jpeg", ContentType("JPG"))
+	assert.Equal(t, "application/javascript", ContentType("js"))
+	assert.Equal(t, "image/svg+xml", ContentType("svg"))
+	assert.Equal(t, "application/octet-stream", ContentType(""))
+	assert.Equal(t, "application/octet-stream", ContentType("no-such-ext"))
+}
+
+func TestServer_ContentType(t *testing.T) {
+	s := newTestServer(t)
+	// 按内容判断
+	w := serve(s, httptest.NewRequest("PUT", "/files/1?name=photo", bytes.NewReader(pngHeader)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/1", nil))
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, `inline; filename=photo`, w.Header().Get("Content-Disposition"))
+	assert.Empty(t, w.Header().Get("Content-Security-Policy"))
+
+	// 客户端声明的类型
+	r := httptest.NewRequest("PUT", "/files/2?name=data.bin", bytes.NewReader([]byte("a,b\n1,2\n")))
+	r.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/2?download=1", nil))
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=data.bin`, w.Header().Get("Content-Disposition"))
+
+	// 内容认不出来时按扩展名
+	w = serve(s, httptest.NewRequest("PUT", "/files/3?name=a.svg", bytes.NewReader([]byte{0, 1, 2, 3})))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/3/%E4%B8%AD%E6%96%87.svg", nil))
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+	// SVG 可以执行脚本, 只能作为附件下载
+	assert.Equal(t, `attachment; filename*=utf-8''%E4%B8%AD%E6%96%87.svg`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+
+	// 声明为 HTML 的文件同样不能在浏览器中直接打开
+	r = httptest.NewRequest("PUT", "/files/5", bytes.NewReader([]byte("<script>alert(1)</script>")))
+	r.Header.Set("Content-Type", "text/html")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/5", nil))
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment", w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "sandbox", w.Header().Get("Content-Security-Policy"))
+
+	// 声明的类型也要检查
+	s.DeniedTypes = []string{"text/html"}
+	r = httptest.NewRequest("PUT", "/files/4?name=a.txt", bytes.NewReader([]byte("plain text")))
+	r.Header.Set("Content-Type", "text/html")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+}
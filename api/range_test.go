@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer_Range(t *testing.T) {
+	s := newTestServer(t)
+	w := doUpload(t, s.Mux.ServeHTTP, "/files", "digits.txt", []byte("0123456789"))
+	var up UploadResult
+	err := json.NewDecoder(w.Body).Decode(&up)
+	assert.NoError(t, err)
+
+	w = serve(s, httptest.NewRequest("HEAD", up.URL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Content-Length"))
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	assert.Empty(t, w.Body.String())
+
+	// 老的 /img 接口同样支持 HEAD
+	w = serve(s, httptest.NewRequest("HEAD", fmt.Sprintf("/img?id=%d", up.ID), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Content-Length"))
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	assert.Empty(t, w.Body.String())
+	w = serve(s, httptest.NewRequest("PUT", "/img", nil))
+	assert.Equal(t, "GET, HEAD, POST, DELETE", w.Header().Get("Allow"))
+
+	w = serve(s, httptest.NewRequest("GET", up.URL, nil))
+	assert.Equal(t, "10", w.Header().Get("Content-Length"))
+	assert.Equal(t, "0123456789", w.Body.String())
+
+	r := httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("Range", "bytes=2-5")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 2-5/10", w.Header().Get("Content-Range"))
+	assert.Equal(t, "2345", w.Body.String())
+
+	r = httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("Range", "bytes=-3")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "789", w.Body.String())
+
+	r = httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("Range", "bytes=0-1,8-")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(b))
+	}
+	assert.Equal(t, []string{"bytes 0-1/10 01", "bytes 8-9/10 89"}, parts)
+
+	r = httptest.NewRequest("GET", up.URL, nil)
+	r.Header.Set("Range", "bytes=20-30")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// routes 注册所有接口, 接口的说明见 openapi.yaml
+func (s *Server) routes() {
+	s.Mux.HandleFunc("/img", s.auth(0, s.FileHandler))
+	s.Mux.HandleFunc("GET /files", s.auth(PermRead, s.listFiles))
+	s.Mux.HandleFunc("POST /files", s.auth(PermWrite, s.postFiles))
+	s.Mux.HandleFunc("POST /files/batch", s.auth(PermWrite, s.batchUpload))
+	s.Mux.HandleFunc("POST /files/batch-delete", s.auth(PermDelete, s.batchDelete))
+	s.Mux.HandleFunc("POST /files/batch-stat", s.auth(PermRead, s.batchStat))
+	s.Mux.HandleFunc("GET /files/{fid}", s.auth(PermRead, s.getFiles))
+	s.Mux.HandleFunc("PUT /files/{fid}", s.auth(PermWrite, s.putFiles))
+	s.Mux.HandleFunc("DELETE /files/{fid}", s.auth(PermDelete, s.deleteFiles))
+	s.Mux.HandleFunc("GET /files/{fid}/{filename}", s.auth(PermRead, s.getFiles))
+	s.Mux.HandleFunc("OPTIONS /uploads", tusHandler(s.optionsUploads))
+	s.Mux.HandleFunc("POST /uploads", tusHandler(s.auth(PermWrite, s.createUpload)))
+	s.Mux.HandleFunc("HEAD /uploads/{uid}", tusHandler(s.auth(PermWrite, s.headUpload)))
+	s.Mux.HandleFunc("PATCH /uploads/{uid}", tusHandler(s.auth(PermWrite, s.patchUpload)))
+	s.Mux.HandleFunc("DELETE /uploads/{uid}", tusHandler(s.auth(PermWrite, s.deleteUpload)))
+}
+
+func fileURL(id uint64) string {
+	return "/files/" + strconv.FormatUint(id, 10)
+}
+
+func (s *Server) postFiles(w http.ResponseWriter, r *http.Request) {
+	s.uploadFile(w, r)
+}
+
+// getFiles GET 和 HEAD /files/{fid}, 带 {filename} 时下载的文件名用它而不是上传时的文件名
+func (s *Server) getFiles(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r.PathValue("fid"))
+	if !ok {
+		return
+	}
+	s.getFile(w, r, id)
+}
+
+// putFiles 把请求的 body 作为 {fid} 的内容, 文件名取自 ?name=. 只能替换之前用 PUT 写入的文件
+func (s *Server) putFiles(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	id, ok := parseID(w, r.PathValue("fid"))
+	if !ok {
+		return
+	}
+	ttl, ok := parseTTL(w, r.URL.Query().Get("ttl"))
+	if !ok {
+		return
+	}
+	s.limitBody(w, r)
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	ctype, err := s.contentType(data, r.Header.Get("Content-Type"))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	data, meta, err := processImage(data, s.stripMetadata(r))
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	// 只替换用 PUT 写入的文件, 其它文件的内容不会改变, 可以长期缓存.
+	// 其它文件删除或过期后 id 也不能重新使用, 以免缓存和引用它的地方拿到不同的内容.
+	// 检查和写入在同一个 Batch 中完成, 期间被其它请求修改时返回 409
+	old, err := s.Volume.Directory.Get(id)
+	if errors.Is(err, core.ErrNeedleNotFound) {
+		old, err = nil, nil
+	}
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if old != nil && (!old.Replaceable() || old.Parent != 0) {
+		writeError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("File %d is not replaceable", id))
+		return
+	}
+	status := http.StatusCreated
+	if old != nil && !old.Deleted() && !old.Expired(time.Now()) {
+		status = http.StatusOK
+	}
+	err = s.Manager.CompareAndPutFile(s.Volume, id, old, data, SanitizeFilename(r.URL.Query().Get("name")), &core.FileOptions{TTL: ttl, ContentType: ctype, Width: meta.Width, Height: meta.Height, Replaceable: true})
+	if err != nil {
+		log.Println("File storing err: ", err)
+		writeErr(w, err)
+		return
+	}
+	s.writeUploadResult(w, status, id)
+}
+
+func (s *Server) deleteFiles(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r.PathValue("fid"))
+	if !ok {
+		return
+	}
+	s.deleteFile(w, r, id)
+}
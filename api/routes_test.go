@@ -0,0 +1,87 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.Mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestServer_Routes(t *testing.T) {
+	s := newTestServer(t)
+	w := doUpload(t, s.Mux.ServeHTTP, "/files", "a.pdf", []byte("%PDF-1.4 data"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var up UploadResult
+	err := json.NewDecoder(w.Body).Decode(&up)
+	assert.NoError(t, err)
+
+	w = serve(s, httptest.NewRequest("GET", up.URL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "%PDF-1.4 data", w.Body.String())
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+
+	w = serve(s, httptest.NewRequest("HEAD", up.URL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(s, httptest.NewRequest("GET", up.URL+"/report%202017.pdf", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `inline; filename="report 2017.pdf"`, w.Header().Get("Content-Disposition"))
+
+	w = serve(s, httptest.NewRequest("GET", "/img?id="+up.URL[len("/files/"):], nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "%PDF-1.4 data", w.Body.String())
+
+	w = serve(s, httptest.NewRequest("GET", "/files/xyz", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(s, httptest.NewRequest("DELETE", up.URL, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(s, httptest.NewRequest("GET", up.URL, nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+}
+
+func TestServer_PutFiles(t *testing.T) {
+	s := newTestServer(t)
+	w := serve(s, httptest.NewRequest("PUT", "/files/42?name=a.png", bytes.NewReader([]byte("v1"))))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var up UploadResult
+	err := json.NewDecoder(w.Body).Decode(&up)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), up.ID)
+	assert.Equal(t, "/files/42", up.URL)
+
+	r := httptest.NewRequest("PUT", "/files/42?name=a.png", bytes.NewReader([]byte("v2")))
+	r.Header.Set("Content-Type", "image/png")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve(s, httptest.NewRequest("GET", "/files/42", nil))
+	assert.Equal(t, "v2", w.Body.String())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+
+	// POST 上传的文件不能替换
+	w = doUpload(t, s.Mux.ServeHTTP, "/files", "a.txt", []byte("posted"))
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&up))
+	w = serve(s, httptest.NewRequest("PUT", up.URL, bytes.NewReader([]byte("v2"))))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, CodeConflict, decodeError(t, w).Code)
+	w = serve(s, httptest.NewRequest("GET", up.URL, nil))
+	assert.Equal(t, "posted", w.Body.String())
+	// 删除后也不能重新使用它的 id
+	w = serve(s, httptest.NewRequest("DELETE", up.URL, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(s, httptest.NewRequest("PUT", up.URL, bytes.NewReader([]byte("v2"))))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	// PUT 写入的文件删除后可以重新写入
+	w = serve(s, httptest.NewRequest("DELETE", "/files/42", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(s, httptest.NewRequest("PUT", "/files/42", bytes.NewReader([]byte("v3"))))
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval 默认检查证书文件是否变化的最小间隔
+const DefaultReloadInterval = 10 * time.Second
+
+// TLSConfig HTTPS 的配置. 证书, 私钥和 CA 文件变化后自动重新加载, 新的连接使用新的证书.
+// 使用 TLS 时同时支持 HTTP/2 和 HTTP/1.1
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile 不为空时用其中的 CA 验证客户端证书, 用于节点之间和管理的请求, 见 ClientCerts
+	ClientCAFile string
+	// RequireClientCert 拒绝没有有效客户端证书的连接, 否则只验证客户端提供了的证书
+	RequireClientCert bool
+	// ReloadInterval 检查证书文件是否变化的最小间隔, 0 表示 DefaultReloadInterval
+	ReloadInterval time.Duration
+}
+
+// Build 加载证书, 返回的 tls.Config 会在证书文件变化后重新加载
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("TLS cert file and key file are required")
+	}
+	if c.RequireClientCert && c.ClientCAFile == "" {
+		return nil, errors.New("TLS client CA file is required to verify client certificates")
+	}
+	r := &certReloader{conf: *c}
+	if r.conf.ReloadInterval == 0 {
+		r.conf.ReloadInterval = DefaultReloadInterval
+	}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.get(), nil
+		},
+	}, nil
+}
+
+// certReloader 保存当前的 tls.Config, 超过 ReloadInterval 后检查文件的修改时间
+type certReloader struct {
+	conf    TLSConfig
+	lock    sync.Mutex
+	current *tls.Config
+	mtimes  []time.Time
+	checked time.Time
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.conf.CertFile, r.conf.KeyFile}
+	if r.conf.ClientCAFile != "" {
+		files = append(files, r.conf.ClientCAFile)
+	}
+	return files
+}
+
+// modTimes 返回所有文件的修改时间
+func (r *certReloader) modTimes() (mtimes []time.Time, err error) {
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		mtimes = append(mtimes, info.ModTime())
+	}
+	return mtimes, nil
+}
+
+// load 读取所有文件, 生成新的 tls.Config
+func (r *certReloader) load() error {
+	mtimes, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.conf.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.conf.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificate in %s", r.conf.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.conf.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	r.current, r.mtimes, r.checked = config, mtimes, time.Now()
+	return nil
+}
+
+// get 返回当前的 tls.Config, 文件变化时先重新加载. 加载失败时继续使用之前的证书
+func (r *certReloader) get() *tls.Config {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.checked) < r.conf.ReloadInterval {
+		return r.current
+	}
+	r.checked = time.Now()
+	mtimes, err := r.modTimes()
+	if err != nil {
+		log.Println("Check TLS certificate: ", err)
+		return r.current
+	}
+	for i := range mtimes {
+		if !mtimes[i].Equal(r.mtimes[i]) {
+			err = r.load()
+			if err != nil {
+				log.Println("Reload TLS certificate: ", err)
+			}
+			break
+		}
+	}
+	return r.current
+}
+
+// ClientCerts 按验证过的客户端证书的 CommonName 授权, "*" 匹配所有验证过的证书.
+// 需要在 TLSConfig 中配置 ClientCAFile. 没有匹配的证书时交给下一个 Authenticator
+type ClientCerts map[string]Permission
+
+func (certs ClientCerts) Authenticate(r *http.Request) (Permission, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return 0, errNoCredentials
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if perm, ok := certs[cn]; ok {
+		return perm, nil
+	}
+	if perm, ok := certs["*"]; ok {
+		return perm, nil
+	}
+	return 0, errNoCredentials
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert 生成 parent 签名的证书, parent 为 nil 时生成自签名的 CA
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert, key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	assert.NoError(t, err)
+	return cert
+}
+
+// writeCert 写入证书和私钥, 修改时间设为 mtime
+func writeCert(t *testing.T, conf *TLSConfig, c *testCert, mtime time.Time) {
+	assert.NoError(t, os.WriteFile(conf.CertFile, c.certPEM(), 0600))
+	assert.NoError(t, os.WriteFile(conf.KeyFile, c.keyPEM(t), 0600))
+	assert.NoError(t, os.Chtimes(conf.CertFile, mtime, mtime))
+	assert.NoError(t, os.Chtimes(conf.KeyFile, mtime, mtime))
+}
+
+// serveTLS 在随机端口上启动 s, 返回地址. newTestServer 会在测试结束时 Shutdown
+func serveTLS(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Serve(ln)
+	return "https://" + ln.Addr().String()
+}
+
+func tlsClient(ca *testCert, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+		ForceAttemptHTTP2: true,
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil)
+	s := newTestServer(t)
+	s.TLS = &TLSConfig{
+		CertFile:       filepath.Join(dir, "cert.pem"),
+		KeyFile:        filepath.Join(dir, "key.pem"),
+		ReloadInterval: time.Millisecond,
+	}
+	writeCert(t, s.TLS, newTestCert(t, "server", 10, ca), time.Now().Add(-time.Minute))
+	addr := serveTLS(t, s)
+
+	client := tlsClient(ca)
+	resp, err := client.Get(addr + "/files/1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, int64(10), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// 替换证书后新的连接使用新证书
+	writeCert(t, s.TLS, newTestCert(t, "server", 11, ca), time.Now())
+	time.Sleep(5 * time.Millisecond)
+	resp, err = client.Get(addr + "/files/1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(11), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// 新证书有问题时继续使用之前的
+	assert.NoError(t, os.WriteFile(s.TLS.KeyFile, []byte("broken"), 0600))
+	assert.NoError(t, os.Chtimes(s.TLS.KeyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	time.Sleep(5 * time.Millisecond)
+	resp, err = client.Get(addr + "/files/1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(11), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil)
+	other := newTestCert(t, "other ca", 2, nil)
+	s := newTestServer(t)
+	s.TLS = &TLSConfig{
+		CertFile:          filepath.Join(dir, "cert.pem"),
+		KeyFile:           filepath.Join(dir, "key.pem"),
+		ClientCAFile:      filepath.Join(dir, "ca.pem"),
+		RequireClientCert: true,
+	}
+	writeCert(t, s.TLS, newTestCert(t, "server", 10, ca), time.Now())
+	assert.NoError(t, os.WriteFile(s.TLS.ClientCAFile, ca.certPEM(), 0600))
+	s.Auth = ClientCerts{"node1": PermAll}
+	addr := serveTLS(t, s)
+
+	_, err := tlsClient(ca).Get(addr + "/files/1")
+	assert.Error(t, err)
+	_, err = tlsClient(ca, newTestCert(t, "node1", 20, other).tlsCert(t)).Get(addr + "/files/1")
+	assert.Error(t, err)
+
+	resp, err := tlsClient(ca, newTestCert(t, "node1", 21, ca).tlsCert(t)).Get(addr + "/files/1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, err = tlsClient(ca, newTestCert(t, "node2", 22, ca).tlsCert(t)).Get(addr + "/files/1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestTLSConfig_Build(t *testing.T) {
+	_, err := (&TLSConfig{}).Build()
+	assert.Error(t, err)
+	_, err = (&TLSConfig{CertFile: "a", KeyFile: "b", RequireClientCert: true}).Build()
+	assert.Error(t, err)
+	_, err = (&TLSConfig{CertFile: "/not/exist", KeyFile: "/not/exist"}).Build()
+	assert.Error(t, err)
+}
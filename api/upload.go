@@ -0,0 +1,460 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// 可续传上传, 兼容 tus 1.0.0 的 core, creation, termination 和 expiration 扩展.
+// 上传的数据先暂存在 Volume 目录下的 uploads 目录中, 全部收到后再写入 Volume.
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,termination,expiration"
+
+	// DefaultUploadTimeout 超过这个时间没有新数据的上传会被清理掉
+	DefaultUploadTimeout = 24 * time.Hour
+)
+
+var (
+	errUploadNotFound = errors.New("Upload not found")
+	errUploadOffset   = errors.New("Upload-Offset mismatch")
+)
+
+// upload 一个上传的状态, 保存在 <id>.json 中, 数据保存在 <id>.part 中
+type upload struct {
+	ID       string `json:"id"`
+	Length   uint64 `json:"length"`
+	Offset   uint64 `json:"offset"`
+	Filename string `json:"filename"`
+	// ContentType 客户端在 Upload-Metadata 的 filetype 中声明的类型
+	ContentType string `json:"content_type,omitempty"`
+	// TTL 客户端在 Upload-Metadata 的 ttl 中指定的存活时间, 0 表示使用 Volume 的 TTL
+	TTL       time.Duration `json:"ttl,omitempty"`
+	FileID    uint64        `json:"file_id,omitempty"` // 上传完成后写入 Volume 的文件 id
+	UpdatedAt time.Time     `json:"updated_at"`
+
+	lock sync.Mutex
+}
+
+func (u *upload) done() bool {
+	return u.FileID != 0
+}
+
+// uploadStore 管理暂存中的上传
+type uploadStore struct {
+	dir     string
+	lock    sync.Mutex
+	uploads map[string]*upload
+}
+
+// newUploadStore 打开 dir, 并加载之前未清理的上传
+func newUploadStore(dir string) (store *uploadStore, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	store = &uploadStore{dir: dir, uploads: make(map[string]*upload)}
+	infos, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		data, err := os.ReadFile(info)
+		if err != nil {
+			return nil, err
+		}
+		u := new(upload)
+		if err := json.Unmarshal(data, u); err != nil {
+			log.Println("Skip broken upload: ", info, err)
+			continue
+		}
+		store.uploads[u.ID] = u
+	}
+	return store, nil
+}
+
+func (store *uploadStore) infoPath(id string) string {
+	return filepath.Join(store.dir, id+".json")
+}
+
+func (store *uploadStore) dataPath(id string) string {
+	return filepath.Join(store.dir, id+".part")
+}
+
+// create 新建一个长度为 length 的上传
+func (store *uploadStore) create(length uint64, filename string, ctype string, ttl time.Duration) (u *upload, err error) {
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	u = &upload{
+		ID:          hex.EncodeToString(b),
+		Length:      length,
+		Filename:    filename,
+		ContentType: ctype,
+		TTL:         ttl,
+		UpdatedAt:   time.Now(),
+	}
+	f, err := os.Create(store.dataPath(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	err = store.save(u)
+	if err != nil {
+		os.Remove(store.dataPath(u.ID))
+		return nil, err
+	}
+	store.lock.Lock()
+	store.uploads[u.ID] = u
+	store.lock.Unlock()
+	return u, nil
+}
+
+func (store *uploadStore) get(id string) (u *upload, err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	u, ok := store.uploads[id]
+	if !ok {
+		return nil, errUploadNotFound
+	}
+	return u, nil
+}
+
+// save 保存 u 的状态, 调用者需要持有 u.lock
+func (store *uploadStore) save(u *upload) (err error) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return
+	}
+	tmp := store.infoPath(u.ID) + ".temp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, store.infoPath(u.ID))
+}
+
+// write 把 r 的数据追加到 offset 处, 返回新的 offset. 出错时已写入的数据仍然保留.
+func (store *uploadStore) write(u *upload, offset uint64, r io.Reader) (newOffset uint64, err error) {
+	if offset != u.Offset {
+		return u.Offset, errUploadOffset
+	}
+	f, err := os.OpenFile(store.dataPath(u.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return u.Offset, err
+	}
+	defer f.Close()
+	w := io.NewOffsetWriter(f, int64(offset))
+	n, err := io.Copy(w, io.LimitReader(r, int64(u.Length-offset)))
+	if n > 0 {
+		u.Offset += uint64(n)
+		u.UpdatedAt = time.Now()
+		if err := store.save(u); err != nil {
+			return u.Offset, err
+		}
+	}
+	return u.Offset, err
+}
+
+// remove 删除 u 和它的数据
+func (store *uploadStore) remove(u *upload) (err error) {
+	store.lock.Lock()
+	delete(store.uploads, u.ID)
+	store.lock.Unlock()
+	err = os.Remove(store.dataPath(u.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	return os.Remove(store.infoPath(u.ID))
+}
+
+// expired 找出 before 之前就没有更新过的上传
+func (store *uploadStore) expired(before time.Time) (uploads []*upload) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, u := range store.uploads {
+		if u.UpdatedAt.Before(before) {
+			uploads = append(uploads, u)
+		}
+	}
+	return
+}
+
+// CleanUploads 清理超过 UploadTimeout 没有更新的上传, 包括已经完成的上传的记录
+func (s *Server) CleanUploads() (count int, err error) {
+	before := time.Now().Add(-s.UploadTimeout)
+	for _, u := range s.uploads.expired(before) {
+		u.lock.Lock()
+		if !u.UpdatedAt.Before(before) { // 等锁的时候又有新数据写入
+			u.lock.Unlock()
+			continue
+		}
+		err = s.uploads.remove(u)
+		u.lock.Unlock()
+		if err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
+
+// StartUploadCleaner 每隔 interval 调用一次 CleanUploads, 调用返回的 stop 停止
+func (s *Server) StartUploadCleaner(interval time.Duration) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if count, err := s.CleanUploads(); err != nil {
+					log.Println("Clean uploads err: ", err)
+				} else if count > 0 {
+					log.Printf("Cleaned %d uploads", count)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+func uploadURL(id string) string {
+	return "/uploads/" + id
+}
+
+// tusHandler 给所有响应加上 Tus-Resumable, 并拒绝不支持的协议版本
+func tusHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+		if v := r.Header.Get("Tus-Resumable"); v != "" && v != TusVersion && r.Method != "OPTIONS" {
+			w.Header().Set("Tus-Version", TusVersion)
+			writeError(w, http.StatusPreconditionFailed, CodeBadRequest, "Unsupported Tus-Resumable: "+v)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// optionsUploads OPTIONS /uploads, 返回服务端支持的协议
+func (s *Server) optionsUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	if s.MaxResumableSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.MaxResumableSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createUpload POST /uploads, 长度取自 Upload-Length, 文件名和类型取自 Upload-Metadata 的 filename 和 filetype
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseUint(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Wrong Upload-Length: "+r.Header.Get("Upload-Length"))
+		return
+	}
+	if s.MaxResumableSize > 0 && length > uint64(s.MaxResumableSize) {
+		writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, "Upload-Length exceeds Tus-Max-Size")
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Wrong Upload-Metadata: "+err.Error())
+		return
+	}
+	ttl, ok := parseTTL(w, meta["ttl"])
+	if !ok {
+		return
+	}
+	u, err := s.uploads.create(length, SanitizeFilename(meta["filename"]), meta["filetype"], ttl)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.Header().Set("Location", uploadURL(u.ID))
+	w.Header().Set("Upload-Expires", u.UpdatedAt.Add(s.UploadTimeout).UTC().Format(http.TimeFormat))
+	if length == 0 {
+		u.lock.Lock()
+		err = s.completeUpload(u)
+		u.lock.Unlock()
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headUpload HEAD /uploads/{uid}, 查询已经上传了多少
+func (s *Server) headUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.findUpload(w, r)
+	if !ok {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	s.writeUploadHeaders(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchUpload PATCH /uploads/{uid}, 从 Upload-Offset 处追加一段数据, 收到全部数据后写入 Volume
+func (s *Server) patchUpload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseUint(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "Wrong Upload-Offset: "+r.Header.Get("Upload-Offset"))
+		return
+	}
+	u, ok := s.findUpload(w, r)
+	if !ok {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.done() {
+		s.writeUploadHeaders(w, u)
+		writeError(w, http.StatusConflict, CodeConflict, "Upload is already complete")
+		return
+	}
+	_, err = s.uploads.write(u, offset, r.Body)
+	if err == errUploadOffset {
+		s.writeUploadHeaders(w, u)
+		writeError(w, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Upload err: ", err)
+		writeErr(w, err)
+		return
+	}
+	if u.Offset == u.Length {
+		err = s.completeUpload(u)
+		if err != nil {
+			log.Println("File storing err: ", err)
+			writeErr(w, err)
+			return
+		}
+	}
+	s.writeUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUpload DELETE /uploads/{uid}, 放弃上传
+func (s *Server) deleteUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.findUpload(w, r)
+	if !ok {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	err := s.uploads.remove(u)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) findUpload(w http.ResponseWriter, r *http.Request) (u *upload, ok bool) {
+	u, err := s.uploads.get(r.PathValue("uid"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, err.Error())
+		return nil, false
+	}
+	return u, true
+}
+
+// completeUpload 把暂存的数据写入 Volume, 大文件会切成多个 chunk. 保留上传的记录直到被清理, 以便客户端查询结果.
+// 类型不允许时直接删掉这个上传. 调用者需要持有 u.lock
+func (s *Server) completeUpload(u *upload) (err error) {
+	f, err := os.Open(s.uploads.dataPath(u.ID))
+	if err != nil {
+		return
+	}
+	ctype, err := s.contentTypeReader(f, u.ContentType)
+	if errors.Is(err, errTypeNotAllowed) {
+		f.Close()
+		s.uploads.remove(u)
+		return err
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	// 可续传上传的文件可能很大, 只记录图片的宽高, 不去掉元数据
+	head := make([]byte, metaLen)
+	l, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return
+	}
+	meta := imageMetaHead(head[:l])
+	id, err := s.Manager.NewFile(s.Volume, f, u.Length, u.Filename, &core.FileOptions{TTL: u.TTL, ContentType: ctype, Width: meta.Width, Height: meta.Height})
+	f.Close()
+	if err != nil {
+		return
+	}
+	u.FileID = id
+	err = s.uploads.save(u)
+	if err != nil {
+		return
+	}
+	os.Remove(s.uploads.dataPath(u.ID))
+	return nil
+}
+
+// writeUploadHeaders 返回上传的进度, 完成后用 Content-Location 指向文件
+func (s *Server) writeUploadHeaders(w http.ResponseWriter, u *upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatUint(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatUint(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.UpdatedAt.Add(s.UploadTimeout).UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	if u.done() {
+		w.Header().Set("Content-Location", fileURL(u.FileID))
+	}
+}
+
+// parseUploadMetadata 解析 "key base64value,key2 base64value2" 格式的 Upload-Metadata
+func parseUploadMetadata(header string) (meta map[string]string, err error) {
+	meta = make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tusRequest(method, target string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", TusVersion)
+	return r
+}
+
+func createTestUpload(t *testing.T, s *Server, length int, filename string) string {
+	r := tusRequest("POST", "/uploads", nil)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))
+	w := serve(s, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, TusVersion, w.Header().Get("Tus-Resumable"))
+	return w.Header().Get("Location")
+}
+
+func patchUpload(s *Server, location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	r := tusRequest("PATCH", location, chunk)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return serve(s, r)
+}
+
+func TestServer_Uploads(t *testing.T) {
+	s := newTestServer(t)
+	w := serve(s, tusRequest("OPTIONS", "/uploads", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, TusExtensions, w.Header().Get("Tus-Extension"))
+
+	data := []byte("%PDF-1.4 abcdefg")
+	location := createTestUpload(t, s, len(data), "big.pdf")
+
+	w = patchUpload(s, location, 0, data[:10])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+
+	// 断线后重新查询进度
+	w = serve(s, tusRequest("HEAD", location, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, "16", w.Header().Get("Upload-Length"))
+	assert.Empty(t, w.Header().Get("Content-Location"))
+
+	w = patchUpload(s, location, 4, data[4:])
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = patchUpload(s, location, 10, data[10:])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "16", w.Header().Get("Upload-Offset"))
+	fileURL := w.Header().Get("Content-Location")
+	assert.NotEmpty(t, fileURL)
+
+	w = serve(s, httptest.NewRequest("GET", fileURL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+
+	w = patchUpload(s, location, 16, []byte("more"))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestServer_Uploads_Abort(t *testing.T) {
+	s := newTestServer(t)
+	location := createTestUpload(t, s, 10, "a.txt")
+	w := patchUpload(s, location, 0, []byte("12345"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(s, tusRequest("DELETE", location, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(s, tusRequest("HEAD", location, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	r := tusRequest("POST", "/uploads", nil)
+	r.Header.Set("Tus-Resumable", "0.2.2")
+	r.Header.Set("Upload-Length", "10")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = serve(s, tusRequest("POST", "/uploads", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_CleanUploads(t *testing.T) {
+	s := newTestServer(t)
+	location := createTestUpload(t, s, 10, "a.txt")
+	count, err := s.CleanUploads()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// 重新打开后还能继续上传
+	uploads, err := newUploadStore(s.uploads.dir)
+	assert.NoError(t, err)
+	s.uploads = uploads
+	w := serve(s, tusRequest("HEAD", location, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 等锁的时候有新数据写入的不清理
+	s.UploadTimeout = time.Minute
+	u := s.uploads.uploads[strings.TrimPrefix(location, "/uploads/")]
+	u.lock.Lock()
+	s.uploads.lock.Lock()
+	u.UpdatedAt = time.Now().Add(-time.Hour)
+	s.uploads.lock.Unlock()
+	done := make(chan int)
+	go func() {
+		count, err := s.CleanUploads()
+		assert.NoError(t, err)
+		done <- count
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.uploads.lock.Lock()
+	u.UpdatedAt = time.Now()
+	s.uploads.lock.Unlock()
+	u.lock.Unlock()
+	assert.Equal(t, 0, <-done)
+
+	s.UploadTimeout = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	count, err = s.CleanUploads()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	w = serve(s, tusRequest("HEAD", location, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServer_Uploads_Chunked(t *testing.T) {
+	s := newTestServer(t)
+	s.Manager.ChunkSize = 4
+	data := []byte("0123456789abcdefghij")
+	location := createTestUpload(t, s, len(data), "video.mp4")
+	w := patchUpload(s, location, 0, data)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	fileURL := w.Header().Get("Content-Location")
+
+	w = serve(s, httptest.NewRequest("GET", fileURL, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+
+	r := httptest.NewRequest("GET", fileURL, nil)
+	r.Header.Set("Range", "bytes=2-9")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "23456789", w.Body.String())
+
+	w = serve(s, httptest.NewRequest("DELETE", fileURL, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(s, httptest.NewRequest("GET", fileURL, nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxUploadSize 一次上传请求 body 的默认上限
+	DefaultMaxUploadSize int64 = 32 << 20 // 32MB
+	// DefaultMaxResumableSize 可续传上传的文件默认的大小上限
+	DefaultMaxResumableSize int64 = 4 << 30 // 4GB
+	// MaxFilenameLength 清理后的文件名最长的字节数
+	MaxFilenameLength = 255
+	// sniffLen http.DetectContentType 最多看的字节数
+	sniffLen = 512
+)
+
+var errTypeNotAllowed = errors.New("Content type not allowed")
+
+// limitBody 按 MaxUploadSize 限制请求 body 的大小, 超过时读取 body 会返回 *http.MaxBytesError
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	if s.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+	}
+}
+
+// contentType 决定文件的 MIME 类型: 客户端声明了具体的类型时用声明的, 否则按内容判断,
+// 都判断不出时返回空字符串.
+// 按内容 (而不是扩展名) 判断出的类型和声明的类型都要通过 AllowedTypes 和 DeniedTypes 的检查,
+// 不允许时返回的错误包含 errTypeNotAllowed.
+func (s *Server) contentType(head []byte, declared string) (ctype string, err error) {
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	ctype = http.DetectContentType(head)
+	err = s.checkType(ctype)
+	if err != nil {
+		return "", err
+	}
+	mediatype, params, err := mime.ParseMediaType(declared)
+	if err != nil || mediatype == "application/octet-stream" {
+		if ctype == "application/octet-stream" {
+			return "", nil // 内容认不出来, 下载时按扩展名判断
+		}
+		return ctype, nil
+	}
+	err = s.checkType(mediatype)
+	if err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType(mediatype, params), nil
+}
+
+// contentTypeReader 同 contentType, 只读取 r 开头的一部分
+func (s *Server) contentTypeReader(r io.ReaderAt, declared string) (ctype string, err error) {
+	head := make([]byte, sniffLen)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return s.contentType(head[:n], declared)
+}
+
+// checkType 检查 ctype 是否在 AllowedTypes 中并且不在 DeniedTypes 中
+func (s *Server) checkType(ctype string) (err error) {
+	mediatype, _, _ := mime.ParseMediaType(ctype)
+	if len(s.AllowedTypes) > 0 && !matchType(s.AllowedTypes, mediatype) {
+		return &typeError{mediatype}
+	}
+	if matchType(s.DeniedTypes, mediatype) {
+		return &typeError{mediatype}
+	}
+	return nil
+}
+
+type typeError struct {
+	ctype string
+}
+
+func (e *typeError) Error() string {
+	return errTypeNotAllowed.Error() + ": " + e.ctype
+}
+
+func (e *typeError) Unwrap() error {
+	return errTypeNotAllowed
+}
+
+// matchType patterns 中是否有和 ctype 匹配的, 支持 image/* 这样的通配
+func matchType(patterns []string, ctype string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == ctype || p == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(p, "/*") && strings.HasPrefix(ctype, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// SanitizeFilename 去掉客户端文件名中的目录, 控制字符和非法 UTF-8,
+// 太长时保留扩展名截断到 MaxFilenameLength 字节. 清理后什么都不剩时返回空字符串.
+func SanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if strings.Trim(name, ".") == "" {
+		return ""
+	}
+	if len(name) <= MaxFilenameLength {
+		return name
+	}
+	ext := ""
+	if i := strings.LastIndex(name, "."); i > 0 && len(name)-i <= 16 {
+		ext = name[i:]
+	}
+	base := name[:MaxFilenameLength-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + ext
+}
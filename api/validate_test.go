@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestSanitizeFilename(t *testing.T) {
+	cases := map[string]string{
+		"a.png":                 "a.png",
+		"../../etc/passwd":      "passwd",
+		`C:\Users\me\photo.jpg`: "photo.jpg",
+		" report\x00\n.pdf ":    "report.pdf",
+		"..":                    "",
+		"":                      "",
+		"bad\xffname.txt":       "badname.txt",
+	}
+	for name, want := range cases {
+		assert.Equal(t, want, SanitizeFilename(name), name)
+	}
+	long := SanitizeFilename(strings.Repeat("文", 100) + ".jpeg")
+	assert.True(t, len(long) <= MaxFilenameLength)
+	assert.True(t, strings.HasSuffix(long, "文.jpeg"))
+}
+
+func TestMatchType(t *testing.T) {
+	assert.True(t, matchType([]string{"image/*"}, "image/png"))
+	assert.True(t, matchType([]string{"text/plain", "application/pdf"}, "application/pdf"))
+	assert.False(t, matchType([]string{"image/*"}, "text/plain"))
+	assert.False(t, matchType(nil, "text/plain"))
+}
+
+func TestServer_UploadLimits(t *testing.T) {
+	s := newTestServer(t)
+	s.MaxUploadSize = 1024
+	w := doUpload(t, s.Mux.ServeHTTP, "/files", "big.bin", bytes.Repeat([]byte("x"), 2048))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, CodeTooLarge, decodeError(t, w).Code)
+
+	w = serve(s, httptest.NewRequest("PUT", "/files/1?name=a.txt", bytes.NewReader(bytes.Repeat([]byte("x"), 2048))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	s.MaxResumableSize = 10
+	r := tusRequest("POST", "/uploads", nil)
+	r.Header.Set("Upload-Length", "11")
+	w = serve(s, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestServer_UploadTypes(t *testing.T) {
+	s := newTestServer(t)
+	s.AllowedTypes = []string{"image/*"}
+	// 扩展名是 png, 内容是文本
+	w := doUpload(t, s.Mux.ServeHTTP, "/files", "fake.png", []byte("just some text"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, CodeUnsupportedType, decodeError(t, w).Code)
+
+	w = doUpload(t, s.Mux.ServeHTTP, "/files", "../real.txt", pngHeader)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var up UploadResult
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&up))
+	n, err := s.Volume.GetNeedle(up.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "real.txt", n.Filename)
+
+	s.AllowedTypes = nil
+	s.DeniedTypes = []string{"text/html"}
+	w = serve(s, httptest.NewRequest("PUT", "/files/7?name=a.jpg", strings.NewReader("<html><script>alert(1)</script>")))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	location := createTestUpload(t, s, 6, "page.txt")
+	w = patchUpload(s, location, 0, []byte("<html>"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	w = serve(s, tusRequest("HEAD", location, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/hmli/simplefs/api"
+)
+
+// BatchFile BatchPut 中的一个文件
+type BatchFile struct {
+	Name        string
+	Reader      io.Reader
+	ContentType string // 为空时由服务端按内容判断
+}
+
+// PutResult BatchPut 中一个文件的结果, 失败时只有 Err
+type PutResult struct {
+	*api.UploadResult
+	Err error
+}
+
+// StatResult BatchStat 中一个 id 的结果, 索引中没有这个 id 时只有 Err
+type StatResult struct {
+	*Stat
+	Err error
+}
+
+// BatchPut 在一个请求中上传多个文件, 服务端一次写入. 返回的结果和 files 的顺序一致,
+// 单个文件的错误 (比如类型不允许) 在它的 Err 中, 不影响其它文件.
+// 所有文件加起来的大小受服务端 max_upload_size 的限制, opt 中的 ContentType 不生效
+func (c *Client) BatchPut(ctx context.Context, files []BatchFile, opt *PutOptions) (results []PutResult, err error) {
+	rws := make([]*rewinder, len(files))
+	for i, f := range files {
+		rws[i] = newRewinder(f.Reader)
+	}
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		for _, rw := range rws {
+			err := rw.rewind()
+			if err != nil {
+				return nil, err
+			}
+		}
+		boundary := multipart.NewWriter(nil).Boundary()
+		body := pipe(func(w io.Writer) error {
+			mw := multipart.NewWriter(w)
+			mw.SetBoundary(boundary)
+			for i, f := range files {
+				ctype := f.ContentType
+				if ctype == "" {
+					ctype = "application/octet-stream"
+				}
+				h := make(textproto.MIMEHeader)
+				h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "files", "filename": f.Name}))
+				h.Set("Content-Type", ctype)
+				pw, err := mw.CreatePart(h)
+				if err == nil {
+					_, err = io.Copy(pw, rws[i])
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		}, rws...)
+		req, err := c.newRequest(ctx, "POST", "/files/batch", opt.query(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp2 []api.BatchUploadResult
+	err = decodeJSON(resp, &resp2)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp2) != len(files) {
+		return nil, fmt.Errorf("got %d results for %d files", len(resp2), len(files))
+	}
+	results = make([]PutResult, len(files))
+	for i, res := range resp2 {
+		results[i] = PutResult{UploadResult: res.UploadResult, Err: itemError(res.Error)}
+	}
+	return results, nil
+}
+
+func formatIDs(ids []uint64) []string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatUint(id, 10)
+	}
+	return s
+}
+
+// BatchStat 查询多个文件的元数据, 超过 api.MaxBatchSize 个时分多次请求.
+// 返回的结果和 ids 的顺序一致, 已删除和已过期的文件也返回元数据, 这时 Exists 为 false
+func (c *Client) BatchStat(ctx context.Context, ids []uint64) (results []StatResult, err error) {
+	for start := 0; start < len(ids); start += api.MaxBatchSize {
+		batch := ids[start:min(start+api.MaxBatchSize, len(ids))]
+		var stats []api.FileStat
+		err = c.doJSON(ctx, "POST", "/files/batch-stat", nil, api.BatchRequest{IDs: formatIDs(batch)}, &stats)
+		if err != nil {
+			return nil, err
+		}
+		if len(stats) != len(batch) {
+			return nil, fmt.Errorf("got %d results for %d ids", len(stats), len(batch))
+		}
+		for i := range stats {
+			res := StatResult{Err: itemError(stats[i].Error)}
+			if stats[i].FileInfo != nil {
+				res.Stat, err = newStat(&stats[i])
+				if err != nil {
+					return nil, err
+				}
+			} else if res.Err == nil {
+				res.Err = &Error{Code: api.CodeNotFound, Message: "Needle not found"}
+			}
+			results = append(results, res)
+		}
+	}
+	return results, nil
+}
+
+// BatchDelete 删除多个文件, 超过 api.MaxBatchSize 个时分多次请求.
+// errs 和 ids 的顺序一致, 之前已经删除的文件没有错误
+func (c *Client) BatchDelete(ctx context.Context, ids []uint64) (errs []error, err error) {
+	for start := 0; start < len(ids); start += api.MaxBatchSize {
+		batch := ids[start:min(start+api.MaxBatchSize, len(ids))]
+		var results []api.BatchDeleteResult
+		err = c.doJSON(ctx, "POST", "/files/batch-delete", nil, api.BatchRequest{IDs: formatIDs(batch)}, &results)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) != len(batch) {
+			return nil, fmt.Errorf("got %d results for %d ids", len(results), len(batch))
+		}
+		for _, res := range results {
+			errs = append(errs, itemError(res.Error))
+		}
+	}
+	return errs, nil
+}
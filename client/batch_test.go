@@ -0,0 +1,91 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/core"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	c, s := newTestClient(t, nil, nil)
+	s.AllowedTypes = []string{"text/plain"}
+	ctx := context.Background()
+	results, err := c.BatchPut(ctx, []BatchFile{
+		{Name: "a.txt", Reader: strings.NewReader("aaa")},
+		{Name: "b.pdf", Reader: strings.NewReader("%PDF-1.4 data")},
+		{Name: "c.txt", Reader: strings.NewReader("ccc"), ContentType: "text/plain"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	assert.NoError(t, results[0].Err)
+	assert.ErrorIs(t, results[1].Err, ErrUnsupportedType)
+	assert.NoError(t, results[2].Err)
+	ida, idc := results[0].ID, results[2].ID
+
+	f, err := c.Get(ctx, idc)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "ccc", string(data))
+
+	errs, err := c.BatchDelete(ctx, []uint64{ida, 404})
+	assert.NoError(t, err)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], core.ErrNeedleNotFound)
+
+	stats, err := c.BatchStat(ctx, []uint64{ida, idc, 404})
+	assert.NoError(t, err)
+	assert.Len(t, stats, 3)
+	assert.NoError(t, stats[0].Err)
+	assert.True(t, stats[0].Deleted)
+	assert.Equal(t, "a.txt", stats[0].Filename)
+	assert.True(t, stats[1].Exists)
+	assert.Equal(t, uint64(3), stats[1].Size)
+	assert.Nil(t, stats[2].Stat)
+	assert.ErrorIs(t, stats[2].Err, core.ErrNeedleNotFound)
+}
+
+func TestBatchChunks(t *testing.T) {
+	// 超过 api.MaxBatchSize 个 id 时分多次请求
+	var requests atomic.Int32
+	c, _ := newTestClient(t, nil, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/files/batch-stat" {
+				requests.Add(1)
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	ctx := context.Background()
+	res, err := c.Put(ctx, "a.txt", strings.NewReader("aaa"), nil)
+	assert.NoError(t, err)
+	ids := make([]uint64, api.MaxBatchSize+1)
+	for i := range ids {
+		ids[i] = 1<<32 + uint64(i)
+	}
+	ids[api.MaxBatchSize] = res.ID
+	stats, err := c.BatchStat(ctx, ids)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Len(t, stats, len(ids))
+	assert.ErrorIs(t, stats[0].Err, core.ErrNeedleNotFound)
+	assert.True(t, stats[api.MaxBatchSize].Exists)
+
+	// 失败的批量上传可以重试
+	c, _ = newTestClient(t, nil, failFirst(1, http.StatusServiceUnavailable, nil))
+	results, err := c.BatchPut(ctx, []BatchFile{
+		{Name: "a.txt", Reader: bytes.NewReader([]byte("aaa"))},
+		{Name: "b.txt", Reader: bytes.NewReader([]byte("bbb"))},
+	}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, uint64(3), results[1].Size)
+}
@@ -0,0 +1,277 @@
+// Package client simplefs HTTP API 的 Go 客户端, 接口说明见 api/openapi.yaml.
+//
+//	c, err := client.New("http://localhost:8008", &client.Options{APIKey: "key"})
+//	res, err := c.Put(ctx, "a.png", f, nil)
+//	file, err := c.Get(ctx, res.ID)
+//	defer file.Close()
+//
+// 所有方法都可以并发调用. 网络错误和服务端暂时不可用 (429, 502, 503, 504) 时按 Options 自动重试,
+// 服务端返回的错误是 *Error, 可以用 errors.Is 和 core 中的错误比较, 比如 errors.Is(err, core.ErrNeedleNotFound).
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultRetries      = 3
+	DefaultBackoff      = 500 * time.Millisecond
+	DefaultMaxBackoff   = 10 * time.Second
+	DefaultMaxIdleConns = 16
+)
+
+// Options 创建 Client 的配置, 零值的字段使用默认值
+type Options struct {
+	APIKey string // 通过 X-API-Key 发送
+	Token  string // JWT, 通过 Authorization: Bearer 发送
+
+	// HTTPClient 不为 nil 时直接使用, 忽略 TLS, MaxIdleConns 和 Timeout
+	HTTPClient *http.Client
+	TLS        *tls.Config
+	// MaxIdleConns 连接池中保持的空闲连接数, 默认 DefaultMaxIdleConns
+	MaxIdleConns int
+	// Timeout 建立连接和等待响应 header 的超时时间, 0 表示不限制. 整个请求的超时用 context 控制
+	Timeout time.Duration
+
+	// Retries 网络错误和 429, 502, 503, 504 时的重试次数, 0 为 DefaultRetries, 负数表示不重试.
+	// 上传的 body 不是 io.Seeker 时, 已经发送了数据的请求不重试
+	Retries int
+	// Backoff 第一次重试前等待的时间, 之后每次加倍, 最多 MaxBackoff. 服务端返回 Retry-After 时按它等待
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Client simplefs HTTP API 的客户端
+type Client struct {
+	base       *url.URL
+	http       *http.Client
+	header     http.Header // 每个请求都带上的 header, 用于认证
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// New 创建访问 server (比如 http://localhost:8008) 的 Client, opt 可以为 nil
+func New(server string, opt *Options) (c *Client, err error) {
+	base, err := url.Parse(server)
+	if err != nil || base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("Wrong server address %q", server)
+	}
+	if opt == nil {
+		opt = new(Options)
+	}
+	c = &Client{
+		base:       base,
+		http:       opt.HTTPClient,
+		header:     make(http.Header),
+		retries:    opt.Retries,
+		backoff:    opt.Backoff,
+		maxBackoff: opt.MaxBackoff,
+	}
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = opt.TLS
+		transport.MaxIdleConnsPerHost = DefaultMaxIdleConns
+		if opt.MaxIdleConns > 0 {
+			transport.MaxIdleConnsPerHost = opt.MaxIdleConns
+		}
+		if opt.Timeout > 0 {
+			transport.DialContext = (&net.Dialer{Timeout: opt.Timeout, KeepAlive: 30 * time.Second}).DialContext
+			transport.TLSHandshakeTimeout = opt.Timeout
+			transport.ResponseHeaderTimeout = opt.Timeout
+		}
+		c.http = &http.Client{Transport: transport}
+	}
+	switch {
+	case c.retries == 0:
+		c.retries = DefaultRetries
+	case c.retries < 0:
+		c.retries = 0
+	}
+	if c.backoff <= 0 {
+		c.backoff = DefaultBackoff
+	}
+	if c.maxBackoff <= 0 {
+		c.maxBackoff = DefaultMaxBackoff
+	}
+	if opt.APIKey != "" {
+		c.header.Set("X-API-Key", opt.APIKey)
+	}
+	if opt.Token != "" {
+		c.header.Set("Authorization", "Bearer "+opt.Token)
+	}
+	return c, nil
+}
+
+// Close 关闭连接池中的空闲连接
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// newRequest 带上认证 header 的请求. p 是相对于服务端地址的路径, 或者服务端返回的 Location 这样的绝对路径和 URL
+func (c *Client) newRequest(ctx context.Context, method, p string, query url.Values, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		u = c.base.JoinPath(u.Path)
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// send 发送一次请求, 4xx 和 5xx 的响应转成 *Error
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+// errNotRewindable 请求的 body 已经读过并且不能回到开头, 不能重试
+var errNotRewindable = errors.New("request body can not be rewound")
+
+// do 发送 newReq 创建的请求, 可以重试时重新创建请求并重试.
+// newReq 返回 errNotRewindable 时放弃重试, 返回上一次的错误
+func (c *Client) do(ctx context.Context, newReq func() (*http.Request, error)) (resp *http.Response, err error) {
+	for n := 0; ; n++ {
+		req, e := newReq()
+		if e != nil {
+			if err != nil && errors.Is(e, errNotRewindable) {
+				return nil, err
+			}
+			return nil, e
+		}
+		resp, err = c.send(req)
+		if err == nil || n == c.retries || !c.retryable(ctx, err) {
+			return
+		}
+		if e := c.wait(ctx, n+1, err); e != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable 网络错误和服务端暂时不可用时可以重试, context 结束后不再重试
+func (c *Client) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Temporary()
+	}
+	return !errors.Is(err, errNotRewindable)
+}
+
+// wait 第 n 次重试前等待, err 带 Retry-After 时按它等待
+func (c *Client) wait(ctx context.Context, n int, err error) error {
+	d := c.backoff << (n - 1)
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	// 加上随机的抖动, 避免很多客户端同时重试
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	var e *Error
+	if errors.As(err, &e) && e.retryAfter > 0 {
+		d = min(e.retryAfter, c.maxBackoff)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryAfter 解析秒数格式的 Retry-After
+func retryAfter(resp *http.Response) time.Duration {
+	s, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
+
+// rewinder 记录读取了多少, 重试时让 body 回到开始的位置
+type rewinder struct {
+	r     io.Reader
+	start int64 // r 是 io.Seeker 时开始的位置, 否则为 -1
+	read  int64
+
+	// 用 pipe 发送 body 时, 写 pipe 的 goroutine 结束后才能回到开头
+	done chan struct{}
+}
+
+func newRewinder(r io.Reader) *rewinder {
+	rw := &rewinder{r: r, start: -1}
+	if s, ok := r.(io.Seeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			rw.start = pos
+		}
+	}
+	return rw
+}
+
+func (rw *rewinder) Read(p []byte) (n int, err error) {
+	n, err = rw.r.Read(p)
+	rw.read += int64(n)
+	return
+}
+
+// rewind 回到开始的位置, 已经读过数据并且不能 seek 时返回 errNotRewindable
+func (rw *rewinder) rewind() error {
+	if rw.done != nil {
+		<-rw.done
+		rw.done = nil
+	}
+	if rw.read == 0 {
+		return nil
+	}
+	if rw.start < 0 {
+		return errNotRewindable
+	}
+	rw.read = 0
+	_, err := rw.r.(io.Seeker).Seek(rw.start, io.SeekStart)
+	return err
+}
+
+// pipe 在 goroutine 中用 write 生成 body, 请求结束前 rewind 会等待 goroutine 结束
+func pipe(write func(w io.Writer) error, rws ...*rewinder) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	for _, rw := range rws {
+		rw.done = done
+	}
+	go func() {
+		defer close(done)
+		pw.CloseWithError(write(pw))
+	}()
+	return pr
+}
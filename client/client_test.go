@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/core"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient 运行真实 api.Server 的 httptest.Server 和访问它的 Client, wrap 不为 nil 时包装 server 的 handler
+func newTestClient(t *testing.T, opt *Options, wrap func(http.Handler) http.Handler) (*Client, *api.Server) {
+	s := api.NewServer(0, t.TempDir())
+	var h http.Handler = s.Mux
+	if wrap != nil {
+		h = wrap(h)
+	}
+	ts := httptest.NewServer(h)
+	if opt == nil {
+		opt = new(Options)
+	}
+	if opt.Backoff == 0 {
+		opt.Backoff = time.Millisecond
+	}
+	c, err := New(ts.URL, opt)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		c.Close()
+		ts.Close()
+		s.Shutdown(context.Background())
+	})
+	return c, s
+}
+
+// failFirst 每种 method 的前 n 个请求读完 body 后返回 status, 带上 header
+func failFirst(n int32, status int, header http.Header) func(http.Handler) http.Handler {
+	counts := make(map[string]*atomic.Int32)
+	return func(h http.Handler) http.Handler {
+		for _, m := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+			counts[m] = new(atomic.Int32)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if counts[r.Method].Add(1) <= n {
+				io.Copy(io.Discard, r.Body)
+				for k, v := range header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(status)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, server := range []string{"", "localhost:8008", "ftp://localhost", "http://"} {
+		_, err := New(server, nil)
+		assert.Error(t, err, server)
+	}
+	c, err := New("https://localhost:8008/prefix", &Options{Retries: -1})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c.retries)
+	assert.Equal(t, DefaultBackoff, c.backoff)
+	req, err := c.newRequest(context.Background(), "GET", "/files/1", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://localhost:8008/prefix/files/1", req.URL.String())
+	req, err = c.newRequest(context.Background(), "HEAD", "http://other/uploads/1", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://other/uploads/1", req.URL.String())
+}
+
+func TestError(t *testing.T) {
+	c, s := newTestClient(t, nil, nil)
+	ctx := context.Background()
+	_, err := c.Get(ctx, 404)
+	assert.ErrorIs(t, err, core.ErrNeedleNotFound)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusNotFound, e.StatusCode)
+	assert.Equal(t, api.CodeNotFound, e.Code)
+	assert.False(t, e.Temporary())
+
+	res, err := c.Put(ctx, "a.txt", bytes.NewReader([]byte("data")), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Volume.DelNeedle(res.ID))
+	_, err = c.Get(ctx, res.ID)
+	assert.ErrorIs(t, err, core.ErrDeleted)
+	assert.NotErrorIs(t, err, core.ErrNeedleNotFound)
+
+	s.MaxUploadSize = 10
+	_, err = c.Put(ctx, "a.txt", bytes.NewReader(bytes.Repeat([]byte("a"), 100)), nil)
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestAuth(t *testing.T) {
+	secret := []byte("secret")
+	token, err := api.NewToken(secret, "alice", api.PermRead, time.Hour)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	c, s := newTestClient(t, nil, nil)
+	s.Auth = api.Authenticators{api.APIKeys{"key": api.PermAll}, &api.JWTAuth{Secret: secret}}
+	_, _, err = c.List(ctx, nil)
+	assert.ErrorIs(t, err, api.ErrUnauthorized)
+
+	c, err = New(c.base.String(), &Options{APIKey: "key"})
+	assert.NoError(t, err)
+	res, err := c.Put(ctx, "a.txt", bytes.NewReader([]byte("data")), nil)
+	assert.NoError(t, err)
+
+	c, err = New(c.base.String(), &Options{Token: token})
+	assert.NoError(t, err)
+	_, err = c.Stat(ctx, res.ID)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, c.Delete(ctx, res.ID), api.ErrForbidden)
+}
+
+func TestRetry(t *testing.T) {
+	c, _ := newTestClient(t, nil, failFirst(2, http.StatusServiceUnavailable, nil))
+	ctx := context.Background()
+	res, err := c.Put(ctx, "a.txt", bytes.NewReader([]byte("data")), nil)
+	assert.NoError(t, err)
+	f, err := c.Get(ctx, res.ID)
+	assert.NoError(t, err)
+	f.Close()
+
+	// 不能 seek 的 body 已经发送后不重试
+	c, _ = newTestClient(t, nil, failFirst(1, http.StatusServiceUnavailable, nil))
+	_, err = c.Put(ctx, "a.txt", struct{ io.Reader }{bytes.NewReader([]byte("data"))}, nil)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusServiceUnavailable, e.StatusCode)
+
+	// 重试次数用完后返回最后一次的错误
+	c, _ = newTestClient(t, &Options{Retries: 2}, failFirst(3, http.StatusTooManyRequests, nil))
+	_, _, err = c.List(ctx, nil)
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusTooManyRequests, e.StatusCode)
+	_, _, err = c.List(ctx, nil)
+	assert.NoError(t, err)
+
+	// 4xx 不重试. 不是 JSON 的错误响应没有 Code
+	c, _ = newTestClient(t, nil, failFirst(1, http.StatusBadRequest, nil))
+	_, _, err = c.List(ctx, nil)
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusBadRequest, e.StatusCode)
+	assert.Empty(t, e.Code)
+}
+
+func TestRetryAfter(t *testing.T) {
+	c, _ := newTestClient(t, &Options{MaxBackoff: 50 * time.Millisecond}, failFirst(1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"120"}}))
+	start := time.Now()
+	_, _, err := c.List(context.Background(), nil)
+	assert.NoError(t, err)
+	// Retry-After 也受 MaxBackoff 的限制
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	c, _ = newTestClient(t, &Options{Backoff: time.Hour}, failFirst(1, http.StatusServiceUnavailable, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = c.List(ctx, nil)
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusServiceUnavailable, e.StatusCode)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestContext(t *testing.T) {
+	release := make(chan struct{})
+	c, _ := newTestClient(t, nil, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err := c.List(ctx, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
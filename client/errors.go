@@ -0,0 +1,96 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/core"
+)
+
+// 服务端错误码中没有对应 core 或 api 错误的部分
+var (
+	ErrBadRequest      = errors.New("Bad request")
+	ErrTooLarge        = errors.New("Request too large")
+	ErrUnsupportedType = errors.New("Unsupported content type")
+	ErrConflict        = errors.New("Conflict")
+	ErrInternal        = errors.New("Internal server error")
+	// ErrChanged 读取过程中文件被替换, 无法从断开的位置继续
+	ErrChanged = errors.New("File changed during read")
+)
+
+// codeErrors 错误码 -> errors.Is 可以匹配的错误
+var codeErrors = map[string]error{
+	api.CodeBadRequest:      ErrBadRequest,
+	api.CodeNotFound:        core.ErrNeedleNotFound,
+	api.CodeExpired:         core.ErrExpired,
+	api.CodeDeleted:         core.ErrDeleted,
+	api.CodeUnauthorized:    api.ErrUnauthorized,
+	api.CodeForbidden:       api.ErrForbidden,
+	api.CodeConflict:        ErrConflict,
+	api.CodeTooLarge:        ErrTooLarge,
+	api.CodeUnsupportedType: ErrUnsupportedType,
+	api.CodeNameTooLong:     core.ErrLongName,
+	api.CodeNoSpace:         core.ErrLeakSpace,
+	api.CodeChecksum:        core.ErrWrongCheckSum,
+	api.CodeInternal:        ErrInternal,
+	api.CodeUnavailable:     core.ErrClosed,
+}
+
+// Error 服务端返回的错误. errors.Is 按 Code 匹配 core 中对应的错误, 比如
+// errors.Is(err, core.ErrDeleted), 没有对应的 core 错误时匹配 api.ErrUnauthorized 或本包的 ErrTooLarge 等.
+// 批量接口中单个文件的错误 StatusCode 为 0.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+
+	retryAfter time.Duration // 响应中的 Retry-After
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+func (e *Error) Is(target error) bool {
+	err, ok := codeErrors[e.Code]
+	return ok && err == target
+}
+
+// Temporary 服务端暂时不可用或者限流, 可以重试
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// readError 读取并关闭错误响应的 body. 不是 JSON 时 (比如代理返回的错误) 没有 Code, Message 为 status
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode), retryAfter: retryAfter(resp)}
+	var body struct {
+		Error api.Error `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, &body) == nil && body.Error.Code != "" {
+		e.Code, e.Message = body.Error.Code, body.Error.Message
+	}
+	return e
+}
+
+// itemError 批量接口中单个文件的错误
+func itemError(e *api.Error) error {
+	if e == nil {
+		return nil
+	}
+	return &Error{Code: e.Code, Message: e.Message}
+}
@@ -0,0 +1,380 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/core"
+)
+
+// PutOptions 上传的参数, 可以为 nil
+type PutOptions struct {
+	// ContentType 声明的类型, 为空时由服务端按内容判断
+	ContentType string
+	// Strip 去掉 JPEG 和 PNG 中的 EXIF, XMP 等元数据
+	Strip bool
+}
+
+func (o *PutOptions) query() url.Values {
+	query := make(url.Values)
+	if o != nil && o.Strip {
+		query.Set("strip", "true")
+	}
+	return query
+}
+
+func (o *PutOptions) contentType() string {
+	if o == nil || o.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return o.ContentType
+}
+
+// fid 文件 id 在路径中的形式
+func fid(id uint64) string {
+	return "/files/" + strconv.FormatUint(id, 10)
+}
+
+func decodeJSON(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// doJSON 以 JSON 发送 in (为 nil 时没有 body), 把响应解析到 out
+func (c *Client) doJSON(ctx context.Context, method, p string, query url.Values, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		var r io.Reader
+		if in != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := c.newRequest(ctx, method, p, query, r)
+		if err == nil && in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	return decodeJSON(resp, out)
+}
+
+// Put 上传 r 中的内容, 保存的文件名为 name. 大小受服务端 max_upload_size 的限制, 更大的文件用 Upload
+func (c *Client) Put(ctx context.Context, name string, r io.Reader, opt *PutOptions) (*api.UploadResult, error) {
+	rw := newRewinder(r)
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		err := rw.rewind()
+		if err != nil {
+			return nil, err
+		}
+		boundary := multipart.NewWriter(nil).Boundary()
+		body := pipe(func(w io.Writer) error {
+			mw := multipart.NewWriter(w)
+			mw.SetBoundary(boundary)
+			return writePart(mw, name, opt.contentType(), rw)
+		}, rw)
+		req, err := c.newRequest(ctx, "POST", "/files", opt.query(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := new(api.UploadResult)
+	return res, decodeJSON(resp, res)
+}
+
+// writePart 把一个文件写到 multipart 表单的 file 字段, 然后结束表单
+func writePart(mw *multipart.Writer, name, ctype string, r io.Reader) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "file", "filename": name}))
+	h.Set("Content-Type", ctype)
+	w, err := mw.CreatePart(h)
+	if err == nil {
+		_, err = io.Copy(w, r)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	return err
+}
+
+// PutFile 把 r 中的内容保存为文件 id, 已经存在时替换它. created 表示这个 id 之前不存在.
+// 只能替换之前用 PutFile 写入的文件, 否则返回 ErrConflict
+func (c *Client) PutFile(ctx context.Context, id uint64, name string, r io.Reader, opt *PutOptions) (res *api.UploadResult, created bool, err error) {
+	rw := newRewinder(r)
+	query := opt.query()
+	query.Set("name", name)
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		err := rw.rewind()
+		if err != nil {
+			return nil, err
+		}
+		req, err := c.newRequest(ctx, "PUT", fid(id), query, io.NopCloser(rw))
+		if err == nil && opt != nil && opt.ContentType != "" {
+			req.Header.Set("Content-Type", opt.ContentType)
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	created = resp.StatusCode == http.StatusCreated
+	res = new(api.UploadResult)
+	return res, created, decodeJSON(resp, res)
+}
+
+// Delete 删除文件 id, 文件已经删除时也返回 nil
+func (c *Client) Delete(ctx context.Context, id uint64) error {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, "DELETE", fid(id), nil, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat 索引中记录的文件状态和元数据
+type Stat struct {
+	ID      uint64 `json:"id,string"`
+	Exists  bool   `json:"exists"` // 没有删除也没有过期
+	Deleted bool   `json:"deleted"`
+	Expired bool   `json:"expired"`
+	*api.FileInfo
+}
+
+func newStat(s *api.FileStat) (*Stat, error) {
+	id, err := strconv.ParseUint(s.ID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong file id %q", s.ID)
+	}
+	return &Stat{ID: id, Exists: s.Exists, Deleted: s.Deleted, Expired: s.Expired, FileInfo: s.FileInfo}, nil
+}
+
+// Stat 查询文件 id 的元数据, 不读取内容. 已删除和已过期的文件也返回元数据, 这时 Exists 为 false
+func (c *Client) Stat(ctx context.Context, id uint64) (*Stat, error) {
+	results, err := c.BatchStat(ctx, []uint64{id})
+	if err != nil {
+		return nil, err
+	}
+	return results[0].Stat, results[0].Err
+}
+
+// Query List 的条件, 见 core.Query. All 为 true 时同样返回已删除和已过期的文件
+type Query struct {
+	core.Query
+	All bool
+}
+
+func (q *Query) values() url.Values {
+	v := make(url.Values)
+	if q == nil {
+		return v
+	}
+	if q.Filename != "" {
+		v.Set("filename", q.Filename)
+	}
+	if q.Ext != "" {
+		v.Set("ext", q.Ext)
+	}
+	if !q.CreatedAfter.IsZero() {
+		v.Set("created_after", q.CreatedAfter.Format(time.RFC3339))
+	}
+	if !q.CreatedBefore.IsZero() {
+		v.Set("created_before", q.CreatedBefore.Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		v.Set("cursor", q.Cursor)
+	}
+	if q.All {
+		v.Set("all", "")
+	}
+	return v
+}
+
+// List 按 q 分页列出文件, 返回的 cursor 用于下一页, 为空表示没有下一页.
+// 服务端跳过的文件也算在 Limit 里, 所以一页可能少于 Limit
+func (c *Client) List(ctx context.Context, q *Query) (stats []*Stat, cursor string, err error) {
+	var list api.FileList
+	err = c.doJSON(ctx, "GET", "/files", q.values(), nil, &list)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range list.Files {
+		s, err := newStat(&list.Files[i])
+		if err != nil {
+			return nil, "", err
+		}
+		stats = append(stats, s)
+	}
+	return stats, list.Cursor, nil
+}
+
+// File Get 和 GetRange 返回的文件内容. 读取时连接中断会用 Range 从断开的位置继续,
+// 这期间文件被替换时返回 ErrChanged
+type File struct {
+	ID          uint64
+	Filename    string // 上传时的文件名
+	ContentType string
+	ETag        string
+	ModTime     time.Time
+	Size        int64 // 文件的大小
+	Offset      int64 // 读取的起始位置
+	Length      int64 // 读取的长度
+
+	c        *Client
+	ctx      context.Context
+	body     io.ReadCloser
+	pos      int64 // 下一个字节在文件中的位置
+	remain   int64
+	failures int
+}
+
+// Get 读取文件 id 的内容, 用完后需要 Close
+func (c *Client) Get(ctx context.Context, id uint64) (*File, error) {
+	return c.GetRange(ctx, id, 0, -1)
+}
+
+// GetRange 读取文件 id 从 offset 开始的 length 字节, length 为负数时读到结尾.
+// 超出文件大小的部分会被忽略, offset 不小于文件大小时返回 416 的 *Error
+func (c *Client) GetRange(ctx context.Context, id uint64, offset, length int64) (*File, error) {
+	if offset < 0 || length == 0 {
+		return nil, fmt.Errorf("Wrong range: offset %d, length %d", offset, length)
+	}
+	f := &File{ID: id, Offset: offset, c: c, ctx: ctx, pos: offset, remain: length}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open 请求 [pos, pos+remain) 的内容, 重新打开时用 If-Range 保证文件没有变化
+func (f *File) open() error {
+	reopen := f.body != nil
+	resp, err := f.c.do(f.ctx, func() (*http.Request, error) {
+		req, err := f.c.newRequest(f.ctx, "GET", fid(f.ID), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if f.pos > 0 || f.remain >= 0 {
+			r := "bytes=" + strconv.FormatInt(f.pos, 10) + "-"
+			if f.remain >= 0 {
+				r += strconv.FormatInt(f.pos+f.remain-1, 10)
+			}
+			req.Header.Set("Range", r)
+		}
+		if reopen {
+			req.Header.Set("If-Range", f.ETag)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if reopen && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return ErrChanged
+	}
+	f.body = resp.Body
+	if reopen {
+		return nil
+	}
+	f.ETag = resp.Header.Get("ETag")
+	f.ContentType = resp.Header.Get("Content-Type")
+	f.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		f.Filename = params["filename"]
+	}
+	f.Size = resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-99/1000
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+			f.Size, _ = strconv.ParseInt(cr[i+1:], 10, 64)
+		}
+	} else if f.pos > 0 {
+		resp.Body.Close()
+		return fmt.Errorf("server ignored the range of file %d", f.ID)
+	}
+	f.remain = resp.ContentLength
+	f.Length = resp.ContentLength
+	return nil
+}
+
+func (f *File) Read(p []byte) (n int, err error) {
+	for {
+		if f.remain == 0 {
+			return 0, io.EOF
+		}
+		if f.remain > 0 && int64(len(p)) > f.remain {
+			p = p[:f.remain]
+		}
+		n, err = f.body.Read(p)
+		f.pos += int64(n)
+		if f.remain > 0 {
+			f.remain -= int64(n)
+		}
+		if n > 0 {
+			f.failures = 0
+		}
+		switch {
+		case f.remain == 0 && n > 0:
+			return n, nil
+		case f.remain == 0:
+			return 0, io.EOF
+		case err == nil, err == io.EOF && f.remain < 0:
+			return
+		case err == io.EOF:
+			err = io.ErrUnexpectedEOF
+		}
+		// 连接中断, 从断开的位置继续
+		if f.failures >= f.c.retries || !f.c.retryable(f.ctx, err) {
+			return
+		}
+		f.failures++
+		f.body.Close()
+		if e := f.c.wait(f.ctx, f.failures, err); e != nil {
+			return n, err
+		}
+		if e := f.open(); e != nil {
+			return n, e
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (f *File) Close() error {
+	return f.body.Close()
+}
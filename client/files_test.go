@@ -0,0 +1,209 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/hmli/simplefs/core"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPutGet(t *testing.T) {
+	c, _ := newTestClient(t, nil, nil)
+	ctx := context.Background()
+	data := []byte("%PDF-1.4 " + strings.Repeat("0123456789", 100))
+	res, err := c.Put(ctx, "a.pdf", bytes.NewReader(data), nil)
+	assert.NoError(t, err)
+	assert.NotZero(t, res.ID)
+	assert.Equal(t, uint64(len(data)), res.Size)
+
+	f, err := c.Get(ctx, res.ID)
+	assert.NoError(t, err)
+	got, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, data, got)
+	assert.Equal(t, "a.pdf", f.Filename)
+	assert.Equal(t, "application/pdf", f.ContentType)
+	assert.Equal(t, int64(len(data)), f.Size)
+	assert.Equal(t, int64(len(data)), f.Length)
+	assert.NotEmpty(t, f.ETag)
+	assert.False(t, f.ModTime.IsZero())
+
+	f, err = c.GetRange(ctx, res.ID, 100, 50)
+	assert.NoError(t, err)
+	got, err = io.ReadAll(f)
+	assert.NoError(t, err)
+	f.Close()
+	assert.Equal(t, data[100:150], got)
+	assert.Equal(t, int64(len(data)), f.Size)
+	assert.Equal(t, int64(50), f.Length)
+
+	// 读到结尾, 超出的长度被忽略
+	f, err = c.GetRange(ctx, res.ID, int64(len(data))-10, 100)
+	assert.NoError(t, err)
+	got, err = io.ReadAll(f)
+	assert.NoError(t, err)
+	f.Close()
+	assert.Equal(t, data[len(data)-10:], got)
+
+	_, err = c.GetRange(ctx, res.ID, int64(len(data)), -1)
+	var e *Error
+	assert.ErrorAs(t, err, &e)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, e.StatusCode)
+	_, err = c.GetRange(ctx, res.ID, 0, 0)
+	assert.Error(t, err)
+
+	res, err = c.Put(ctx, "b.txt", strings.NewReader("text"), &PutOptions{ContentType: "text/plain"})
+	assert.NoError(t, err)
+	f, err = c.Get(ctx, res.ID)
+	assert.NoError(t, err)
+	f.Close()
+	assert.Equal(t, "text/plain", f.ContentType)
+}
+
+// truncate 没有 If-Range 的 GET 请求只返回前 n 字节就断开连接
+func truncate(n int) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.Header.Get("If-Range") != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			h.ServeHTTP(&truncatedWriter{ResponseWriter: w, remain: n}, r)
+		})
+	}
+}
+
+type truncatedWriter struct {
+	http.ResponseWriter
+	remain int
+}
+
+func (w *truncatedWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.remain {
+		w.remain -= len(p)
+		return w.ResponseWriter.Write(p)
+	}
+	w.ResponseWriter.Write(p[:w.remain])
+	w.ResponseWriter.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func TestGetResume(t *testing.T) {
+	c, _ := newTestClient(t, nil, truncate(100))
+	ctx := context.Background()
+	data := []byte(strings.Repeat("0123456789", 100))
+	res, _, err := c.PutFile(ctx, 1000, "a.txt", bytes.NewReader(data), nil)
+	assert.NoError(t, err)
+	f, err := c.Get(ctx, res.ID)
+	assert.NoError(t, err)
+	got, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	f.Close()
+	assert.Equal(t, data, got)
+
+	f, err = c.GetRange(ctx, res.ID, 50, 500)
+	assert.NoError(t, err)
+	got, err = io.ReadAll(f)
+	assert.NoError(t, err)
+	f.Close()
+	assert.Equal(t, data[50:550], got)
+
+	// 断开后文件被替换, 不能继续读
+	f, err = c.Get(ctx, res.ID)
+	assert.NoError(t, err)
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(f, buf)
+	assert.NoError(t, err)
+	_, _, err = c.PutFile(ctx, res.ID, "a.txt", strings.NewReader(strings.Repeat("x", 1000)), nil)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(f)
+	assert.ErrorIs(t, err, ErrChanged)
+	f.Close()
+
+	// 不重试时返回连接中断的错误
+	c, err = New(c.base.String(), &Options{Retries: -1})
+	assert.NoError(t, err)
+	f, err = c.Get(ctx, res.ID)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(f)
+	assert.Error(t, err)
+	f.Close()
+}
+
+func TestPutFileDelete(t *testing.T) {
+	c, _ := newTestClient(t, nil, nil)
+	ctx := context.Background()
+	res, created, err := c.PutFile(ctx, 1000, "a.txt", strings.NewReader("first"), nil)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, uint64(1000), res.ID)
+	res, created, err = c.PutFile(ctx, 1000, "b.txt", strings.NewReader("second"), &PutOptions{ContentType: "text/plain"})
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, uint64(6), res.Size)
+
+	stat, err := c.Stat(ctx, 1000)
+	assert.NoError(t, err)
+	assert.True(t, stat.Exists)
+	assert.Equal(t, "b.txt", stat.Filename)
+
+	assert.NoError(t, c.Delete(ctx, 1000))
+	assert.NoError(t, c.Delete(ctx, 1000))
+	stat, err = c.Stat(ctx, 1000)
+	assert.NoError(t, err)
+	assert.False(t, stat.Exists)
+	assert.True(t, stat.Deleted)
+	_, err = c.Get(ctx, 1000)
+	assert.ErrorIs(t, err, core.ErrDeleted)
+
+	_, err = c.Stat(ctx, 404)
+	assert.ErrorIs(t, err, core.ErrNeedleNotFound)
+	assert.ErrorIs(t, c.Delete(ctx, 404), core.ErrNeedleNotFound)
+}
+
+func TestList(t *testing.T) {
+	c, _ := newTestClient(t, nil, nil)
+	ctx := context.Background()
+	var ids []uint64
+	for _, name := range []string{"a.txt", "b.txt", "c.json", "d.txt"} {
+		res, err := c.Put(ctx, name, strings.NewReader(name), nil)
+		assert.NoError(t, err)
+		ids = append(ids, res.ID)
+	}
+	assert.NoError(t, c.Delete(ctx, ids[3]))
+
+	stats, cursor, err := c.List(ctx, nil)
+	assert.NoError(t, err)
+	assert.Len(t, stats, 3)
+	assert.Empty(t, cursor)
+	stats, _, err = c.List(ctx, &Query{All: true})
+	assert.NoError(t, err)
+	assert.Len(t, stats, 4)
+
+	var names []string
+	q := &Query{Query: core.Query{Ext: "txt", Limit: 1}}
+	for {
+		stats, cursor, err := c.List(ctx, q)
+		assert.NoError(t, err)
+		for _, s := range stats {
+			names = append(names, s.Filename)
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	assert.Equal(t, []string{"a.txt", "b.txt"}, names)
+
+	stats, _, err = c.List(ctx, &Query{Query: core.Query{CreatedBefore: time.Now().Add(-time.Hour)}})
+	assert.NoError(t, err)
+	assert.Empty(t, stats)
+	_, _, err = c.List(ctx, &Query{Query: core.Query{Cursor: "wrong"}})
+	assert.ErrorIs(t, err, ErrBadRequest)
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/hmli/simplefs/api"
+)
+
+// DefaultChunkSize Upload 每个 PATCH 请求发送的大小
+const DefaultChunkSize = 8 << 20
+
+// UploadOptions Upload 的参数, 可以为 nil
+type UploadOptions struct {
+	// ContentType 声明的类型, 为空时由服务端按内容判断
+	ContentType string
+	// ChunkSize 每个请求发送的大小, 默认 DefaultChunkSize
+	ChunkSize int64
+	// Progress 每个分块发送完成后调用, offset 是服务端已经收到的大小
+	Progress func(offset int64)
+}
+
+// Upload 用 tus 协议分块上传 r 中 size 字节的内容, 不受 max_upload_size 的限制.
+// 分块失败时从服务端记录的位置继续, 返回的结果中没有 Checksum
+func (c *Client) Upload(ctx context.Context, name string, r io.ReaderAt, size int64, opt *UploadOptions) (*api.UploadResult, error) {
+	if opt == nil {
+		opt = new(UploadOptions)
+	}
+	chunkSize := opt.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+	if opt.ContentType != "" {
+		metadata += ",filetype " + base64.StdEncoding.EncodeToString([]byte(opt.ContentType))
+	}
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := c.newRequest(ctx, "POST", "/uploads", nil, nil)
+		if err == nil {
+			req.Header.Set("Tus-Resumable", api.TusVersion)
+			req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+			req.Header.Set("Upload-Metadata", metadata)
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		return nil, err
+	}
+	offset, done := int64(0), resp.Header.Get("Content-Location")
+	failures := 0
+	for done == "" {
+		if offset == size {
+			// 长度为 0 的上传在创建时就完成了, 从 HEAD 取文件的地址
+			offset, done, err = c.uploadOffset(ctx, location.String())
+			if err != nil {
+				return nil, err
+			}
+			if done == "" {
+				return nil, errors.New("upload is not complete on the server")
+			}
+			break
+		}
+		chunk := min(size-offset, chunkSize)
+		req, err := c.newRequest(ctx, "PATCH", location.String(), nil, io.NewSectionReader(r, offset, chunk))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = chunk
+		req.Header.Set("Tus-Resumable", api.TusVersion)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		resp, err := c.send(req)
+		if err == nil {
+			resp.Body.Close()
+			offset, err = strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Wrong Upload-Offset: %q", resp.Header.Get("Upload-Offset"))
+			}
+			done = resp.Header.Get("Content-Location")
+			failures = 0
+			if opt.Progress != nil {
+				opt.Progress(offset)
+			}
+			continue
+		}
+		// 409 说明和服务端的位置不一致, 同样重新查询位置
+		if failures == c.retries || !c.retryable(ctx, err) && !errors.Is(err, ErrConflict) {
+			return nil, err
+		}
+		failures++
+		if e := c.wait(ctx, failures, err); e != nil {
+			return nil, err
+		}
+		offset, done, err = c.uploadOffset(ctx, location.String())
+		if err != nil {
+			return nil, err
+		}
+		if opt.Progress != nil {
+			opt.Progress(offset)
+		}
+	}
+	id, err := strconv.ParseUint(path.Base(done), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong Content-Location: %q", done)
+	}
+	return &api.UploadResult{ID: id, Size: uint64(size), URL: done}, nil
+}
+
+// uploadOffset 用 HEAD 查询服务端已经收到的大小, 上传完成时 done 是文件的地址
+func (c *Client) uploadOffset(ctx context.Context, location string) (offset int64, done string, err error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := c.newRequest(ctx, "HEAD", location, nil, nil)
+		if err == nil {
+			req.Header.Set("Tus-Resumable", api.TusVersion)
+		}
+		return req, err
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	offset, err = strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("Wrong Upload-Offset: %q", resp.Header.Get("Upload-Offset"))
+	}
+	return offset, resp.Header.Get("Content-Location"), nil
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpload(t *testing.T) {
+	// 第二个 PATCH 请求写入一部分后断开
+	var patches atomic.Int32
+	c, _ := newTestClient(t, nil, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PATCH" && patches.Add(1) == 2 {
+				r.Body = io.NopCloser(io.LimitReader(r.Body, 100))
+				r.ContentLength = 100
+				r.Header.Set("Content-Length", "100")
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789"), 200)
+	var progress []int64
+	res, err := c.Upload(ctx, "big.bin", bytes.NewReader(data), int64(len(data)), &UploadOptions{
+		ChunkSize: 300,
+		Progress:  func(offset int64) { progress = append(progress, offset) },
+	})
+	assert.NoError(t, err)
+	assert.NotZero(t, res.ID)
+	assert.Equal(t, uint64(len(data)), res.Size)
+	assert.Equal(t, int64(len(data)), progress[len(progress)-1])
+	assert.Contains(t, progress, int64(400))
+
+	f, err := c.Get(ctx, res.ID)
+	assert.NoError(t, err)
+	got, err := io.ReadAll(f)
+	f.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, "big.bin", f.Filename)
+
+	// 长度为 0 的上传在创建时完成
+	res, err = c.Upload(ctx, "empty.txt", bytes.NewReader(nil), 0, &UploadOptions{ContentType: "text/plain"})
+	assert.NoError(t, err)
+	stat, err := c.Stat(ctx, res.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "empty.txt", stat.Filename)
+	assert.Equal(t, uint64(0), stat.Size)
+}
+
+func TestUploadRetry(t *testing.T) {
+	c, _ := newTestClient(t, nil, failFirst(1, http.StatusServiceUnavailable, nil))
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("x"), 1000)
+	res, err := c.Upload(ctx, "big.bin", bytes.NewReader(data), int64(len(data)), &UploadOptions{ChunkSize: 300})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(data)), res.Size)
+
+	c, _ = newTestClient(t, &Options{Retries: -1}, failFirst(1, http.StatusServiceUnavailable, nil))
+	_, err = c.Upload(ctx, "big.bin", bytes.NewReader(data), int64(len(data)), nil)
+	var e *Error
+	assert.ErrorAs(t, err, &e)
+	assert.True(t, e.Temporary())
+}
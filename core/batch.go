@@ -0,0 +1,210 @@
+package core
+
+import "bytes"
+
+const (
+	checkNone   = iota
+	checkExists // id 必须存在
+	checkEqual  // id 当前的 needle 必须与 expect 相同, expect 为 nil 表示必须不存在
+)
+
+// Batch 一组要原子地写入 Directory 的修改, 通过 Directory.Write 提交.
+// 操作按加入的顺序执行, 每个检查都按前面的操作执行之后的状态进行, 所以同一个 id 的多个 CompareAndSet
+// 只有第一个能与提交前的状态比较. 任何一个检查失败则整个 Batch 都不会写入.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	id     uint64 // 要删除或检查的 id
+	del    bool
+	put    *Needle
+	check  int
+	expect *Needle
+	key    []byte // 不为 nil 时直接写入 key, value 为 nil 表示删除. 用于元数据和二级索引的维护
+	value  []byte
+}
+
+func NewBatch() *Batch {
+	return new(Batch)
+}
+
+// Put 写入 n, 已存在时覆盖
+func (b *Batch) Put(n *Needle) {
+	b.ops = append(b.ops, batchOp{put: n})
+}
+
+// Delete 删除 id, 不存在时什么都不做
+func (b *Batch) Delete(id uint64) {
+	b.ops = append(b.ops, batchOp{id: id, del: true})
+}
+
+// Update 用 n 替换已经存在的 id, id 不存在时 Write 返回 ErrNeedleNotFound
+func (b *Batch) Update(id uint64, n *Needle) {
+	b.ops = append(b.ops, batchOp{id: id, del: true, put: n, check: checkExists})
+}
+
+// CompareAndSet 只有 id 当前的 needle 与 old 相同时才把它替换成 n, 否则 Write 返回 ErrConflict.
+// old 为 nil 表示 id 必须不存在, n 为 nil 表示删除.
+func (b *Batch) CompareAndSet(id uint64, old *Needle, n *Needle) {
+	b.ops = append(b.ops, batchOp{id: id, del: true, put: n, check: checkEqual, expect: old})
+}
+
+// putRaw 直接写入一个 key, 不经过 needle 的编码和二级索引
+func (b *Batch) putRaw(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// delRaw 直接删除一个 key
+func (b *Batch) delRaw(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// kvTxn 各后端在一次原子写入中提供的读写操作
+type kvTxn interface {
+	get(key []byte) (value []byte, err error) // 不存在时返回 nil, nil
+	put(key, value []byte) (err error)
+	del(key []byte) (err error)
+}
+
+// apply 依次检查并执行每个操作, 把修改和 indexes 指定的二级索引写入 txn.
+// 检查失败时返回错误, 由调用者丢弃 txn 中已经写入的修改
+func (b *Batch) apply(txn kvTxn, indexes IndexFlag) (err error) {
+	w := &indexWriter{txn: txn, indexes: indexes, pending: make(map[uint64][]byte)}
+	for _, op := range b.ops {
+		if op.key != nil {
+			if op.value != nil {
+				err = txn.put(op.key, op.value)
+			} else {
+				err = txn.del(op.key)
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+		err = w.check(op)
+		if err != nil {
+			return
+		}
+		if op.del {
+			err = w.del(op.id)
+			if err != nil {
+				return
+			}
+		}
+		if op.put != nil {
+			err = w.put(op.put)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// indexWriter 写入 needle 时同时维护二级索引
+type indexWriter struct {
+	txn     kvTxn
+	indexes IndexFlag
+	pending map[uint64][]byte // 本次 Batch 中已经写过的 needle, nil 表示已删除
+}
+
+// current id 在写入本次 Batch 的过程中当前的值
+func (w *indexWriter) current(id uint64) (data []byte, err error) {
+	data, ok := w.pending[id]
+	if ok {
+		return data, nil
+	}
+	return w.txn.get(needleKey(id))
+}
+
+// check 按本次 Batch 中前面的操作执行之后的状态检查 op 的条件
+func (w *indexWriter) check(op batchOp) (err error) {
+	if op.check == checkNone {
+		return nil
+	}
+	cur, err := w.current(op.id)
+	if err != nil {
+		return err
+	}
+	switch op.check {
+	case checkExists:
+		if cur == nil {
+			return ErrNeedleNotFound
+		}
+	case checkEqual:
+		if op.expect == nil {
+			if cur != nil {
+				return ErrConflict
+			}
+			return nil
+		}
+		expect, err := NeedleMarshal(op.expect)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(cur, expect) {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// unindex 删掉 id 当前的二级索引
+func (w *indexWriter) unindex(id uint64) (err error) {
+	if w.indexes == 0 {
+		return
+	}
+	data, err := w.current(id)
+	if err != nil || data == nil {
+		return
+	}
+	old, err := NeedleUnmarshal(data)
+	if err != nil {
+		return
+	}
+	for _, key := range indexKeys(old, w.indexes) {
+		err = w.txn.del(key)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *indexWriter) del(id uint64) (err error) {
+	err = w.unindex(id)
+	if err != nil {
+		return
+	}
+	w.pending[id] = nil
+	return w.txn.del(needleKey(id))
+}
+
+func (w *indexWriter) put(n *Needle) (err error) {
+	data, err := NeedleMarshal(n)
+	if err != nil {
+		return
+	}
+	err = w.unindex(n.ID)
+	if err != nil {
+		return
+	}
+	for _, key := range indexKeys(n, w.indexes) {
+		err = w.txn.put(key, []byte{})
+		if err != nil {
+			return
+		}
+	}
+	w.pending[n.ID] = data
+	return w.txn.put(needleKey(n.ID), data)
+}
@@ -1,15 +1,261 @@
 package core
 
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"path/filepath"
+)
+
+// Directory 的后端类型
+const (
+	DirectoryLeveldb = "leveldb"
+	DirectoryBolt    = "bolt"
+	DirectoryPebble  = "pebble"
+)
+
 type Directory interface {
 	Get(id uint64) (n *Needle, err error)
 	New(n *Needle) (err error)
 	Has(id uint64) (has bool)
 	Del(id uint64) (err error)
 	Set(id uint64, n *Needle) (err error)
-	Iter() (iter Iterator)
+	Write(b *Batch) (err error) // 原子地写入 b 中所有的修改
+	Iter(opt *IterOptions) (iter Iterator)
+	List(q *Query) (needles []*Needle, cursor string, err error) // 按条件分页查询, cursor 为空表示没有下一页
+	Close() (err error)
 }
 
+// IterOptions 迭代的范围和方向, nil 表示按 id 从小到大遍历全部
+type IterOptions struct {
+	Start   uint64 // 起始 id, 包含
+	End     uint64 // 结束 id, 不包含. 0 表示直到最后
+	Reverse bool   // 按 id 从大到小
+}
+
+// Iterator 遍历 Directory 中的 needle. 迭代器创建时即取了快照, 之后的修改对它不可见.
+//
+//	iter := d.Iter(nil)
+//	defer iter.Release()
+//	for iter.Next() {
+//		n := iter.Needle()
+//	}
+//	err := iter.Err()
 type Iterator interface {
-	Next() (key []byte, exists bool)
+	Next() (ok bool)
+	Seek(id uint64) (ok bool) // 移到第一个 >= id 的 needle, Reverse 时为 <= id
+	Needle() (n *Needle)
+	Err() (err error)
+	Release()
+}
+
+// OpenDirectory 按 typ 在 dir 下打开对应后端的 Directory, typ 为空时使用 leveldb.
+// indexes 指定写入时要同时维护的二级索引, 和上次打开时不同时先回填新加的索引.
+// 格式版本不是 FormatVersion 时返回 ErrFormatVersion.
+func OpenDirectory(typ string, dir string, indexes IndexFlag) (d Directory, err error) {
+	switch typ {
+	case "", DirectoryLeveldb:
+		var ld *LeveldbDirectory
+		ld, err = NewLeveldbDirectory(dir)
+		if err == nil {
+			ld.indexes = indexes
+			d = ld
+		}
+	case DirectoryBolt:
+		var bd *BoltDirectory
+		bd, err = NewBoltDirectory(dir)
+		if err == nil {
+			bd.indexes = indexes
+			d = bd
+		}
+	case DirectoryPebble:
+		var pd *PebbleDirectory
+		pd, err = NewPebbleDirectory(dir)
+		if err == nil {
+			pd.indexes = indexes
+			d = pd
+		}
+	default:
+		return nil, ErrUnknownDirectory
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = initFormat(d.(kvDirectory), indexes)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// DirectoryPath 返回 typ 后端在 dir 下存放 index 的路径, typ 为空时为 leveldb
+func DirectoryPath(typ string, dir string) string {
+	switch typ {
+	case DirectoryBolt:
+		return filepath.Join(dir, "index.bolt")
+	case DirectoryPebble:
+		return filepath.Join(dir, "index.pebble")
+	}
+	return filepath.Join(dir, "index")
+}
+
+// MigrateDirectory 把 src 中所有的 needle 复制到 dst, 返回复制的数量
+func MigrateDirectory(src, dst Directory) (count int, err error) {
+	iter := src.Iter(nil)
+	defer iter.Release()
+	for iter.Next() {
+		err = dst.New(iter.Needle())
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, iter.Err()
+}
+
+// GetNeedles 在同一个快照中读取 ids 对应的 needle, 不存在的为 nil
+func GetNeedles(d Directory, ids []uint64) (needles []*Needle, err error) {
+	needles = make([]*Needle, len(ids))
+	iter := d.Iter(nil)
+	defer iter.Release()
+	for i, id := range ids {
+		if iter.Seek(id) && iter.Needle().ID == id {
+			needles[i] = iter.Needle()
+		}
+	}
+	return needles, iter.Err()
+}
+
+// needleKey needle id -> Directory 中的 key
+func needleKey(id uint64) (key []byte) {
+	key = make([]byte, 9)
+	key[0] = prefixNeedle
+	binary.BigEndian.PutUint64(key[1:], id)
+	return
+}
+
+// isNeedleKey key 是否是 needleKey 生成的
+func isNeedleKey(key []byte) bool {
+	return len(key) == 9 && key[0] == prefixNeedle
+}
+
+// rawIterator 各后端底层有序 key-value 迭代器的公共部分, 由 needleIterator 包装成 Iterator
+type rawIterator interface {
+	First() bool
+	Last() bool
+	Seek(key []byte) bool // 移到第一个 >= key 的位置
+	Next() bool
+	Prev() bool
+	Key() []byte
+	Value() []byte
+	Error() error
 	Release()
 }
+
+// needleIterator 在 rawIterator 上实现范围, 方向和 needle 解码
+type needleIterator struct {
+	raw     rawIterator
+	opt     IterOptions
+	started bool
+	needle  *Needle
+	err     error
+}
+
+func newNeedleIterator(raw rawIterator, opt *IterOptions) *needleIterator {
+	it := &needleIterator{raw: raw}
+	if opt != nil {
+		it.opt = *opt
+	}
+	return it
+}
+
+func (it *needleIterator) Next() (ok bool) {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		if it.opt.Reverse {
+			if it.opt.End == 0 {
+				return it.load(it.seekReverse(math.MaxUint64))
+			}
+			return it.load(it.seekReverse(it.opt.End - 1))
+		}
+		return it.load(it.raw.Seek(needleKey(it.opt.Start)))
+	}
+	if it.needle == nil { // 已经走出范围
+		return false
+	}
+	if it.opt.Reverse {
+		return it.load(it.raw.Prev())
+	}
+	return it.load(it.raw.Next())
+}
+
+func (it *needleIterator) Seek(id uint64) (ok bool) {
+	if it.err != nil {
+		return false
+	}
+	it.started = true
+	if it.opt.Reverse {
+		if it.opt.End != 0 && id >= it.opt.End {
+			id = it.opt.End - 1
+		}
+		return it.load(it.seekReverse(id))
+	}
+	if id < it.opt.Start {
+		id = it.opt.Start
+	}
+	return it.load(it.raw.Seek(needleKey(id)))
+}
+
+// seekReverse 移到最后一个 <= id 的位置
+func (it *needleIterator) seekReverse(id uint64) bool {
+	if !it.raw.Seek(needleKey(id)) {
+		if it.raw.Error() != nil {
+			return false
+		}
+		return it.raw.Last()
+	}
+	if bytes.Compare(it.raw.Key(), needleKey(id)) > 0 {
+		return it.raw.Prev()
+	}
+	return true
+}
+
+// load 检查当前位置是否在范围内, 并解出 needle
+func (it *needleIterator) load(ok bool) bool {
+	it.needle = nil
+	if !ok {
+		it.err = it.raw.Error()
+		return false
+	}
+	if !isNeedleKey(it.raw.Key()) { // 走到了二级索引中
+		return false
+	}
+	id := binary.BigEndian.Uint64(it.raw.Key()[1:])
+	if id < it.opt.Start || (it.opt.End != 0 && id >= it.opt.End) {
+		return false
+	}
+	n, err := NeedleUnmarshal(it.raw.Value())
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.needle = n
+	return true
+}
+
+func (it *needleIterator) Needle() (n *Needle) {
+	return it.needle
+}
+
+func (it *needleIterator) Err() (err error) {
+	return it.err
+}
+
+func (it *needleIterator) Release() {
+	it.needle = nil
+	it.raw.Release()
+}
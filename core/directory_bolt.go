@@ -0,0 +1,196 @@
+package core
+
+import (
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+var boltBucket = []byte("needles")
+
+type BoltDirectory struct {
+	db      *bbolt.DB
+	path    string // bolt 文件存放路径
+	indexes IndexFlag
+}
+
+func NewBoltDirectory(dir string) (d *BoltDirectory, err error) {
+	d = new(BoltDirectory)
+	d.path = DirectoryPath(DirectoryBolt, dir)
+	d.db, err = bbolt.Open(d.path, 0666, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = d.db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		d.db.Close()
+		return nil, err
+	}
+	return
+}
+
+func (d *BoltDirectory) Get(id uint64) (n *Needle, err error) {
+	err = d.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(boltBucket).Get(needleKey(id))
+		if data == nil {
+			return ErrNeedleNotFound
+		}
+		n, err = NeedleUnmarshal(data)
+		return err
+	})
+	return
+}
+
+func (d *BoltDirectory) New(n *Needle) (err error) {
+	b := NewBatch()
+	b.Put(n)
+	return d.Write(b)
+}
+
+func (d *BoltDirectory) Has(id uint64) (has bool) {
+	d.db.View(func(tx *bbolt.Tx) error {
+		has = tx.Bucket(boltBucket).Get(needleKey(id)) != nil
+		return nil
+	})
+	return
+}
+
+func (d *BoltDirectory) Set(id uint64, needle *Needle) (err error) {
+	b := NewBatch()
+	b.Update(id, needle)
+	return d.Write(b)
+}
+
+func (d *BoltDirectory) Del(id uint64) (err error) {
+	b := NewBatch()
+	b.Delete(id)
+	return d.Write(b)
+}
+
+// Write 在一个 bolt 读写事务里提交所有修改
+func (d *BoltDirectory) Write(b *Batch) (err error) {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		return b.apply(boltTxn{tx.Bucket(boltBucket)}, d.indexes)
+	})
+}
+
+// Iter 迭代器持有一个只读事务作为快照, 用完必须 Release.
+// bolt 扩大文件时要等所有只读事务结束, 所以不要在持有迭代器的 goroutine 中写入或者再开始读取
+func (d *BoltDirectory) Iter(opt *IterOptions) (iter Iterator) {
+	return newNeedleIterator(d.rawIter(), opt)
+}
+
+func (d *BoltDirectory) rawIter() rawIterator {
+	tx, err := d.db.Begin(false)
+	if err != nil {
+		return &boltIterator{err: err}
+	}
+	return &boltIterator{tx: tx, cursor: tx.Bucket(boltBucket).Cursor()}
+}
+
+func (d *BoltDirectory) List(q *Query) (needles []*Needle, cursor string, err error) {
+	tx, err := d.db.Begin(false)
+	if err != nil {
+		return nil, "", err
+	}
+	bucket := tx.Bucket(boltBucket)
+	raw := &boltIterator{tx: tx, cursor: bucket.Cursor()}
+	// 在同一个事务里按索引取回 needle, 嵌套的只读事务可能和等待 remap 的写入死锁
+	return listNeedles(raw, d.indexes, q, func(id uint64) (*Needle, error) {
+		data := bucket.Get(needleKey(id))
+		if data == nil {
+			return nil, ErrNeedleNotFound
+		}
+		return NeedleUnmarshal(data)
+	})
+}
+
+func (d *BoltDirectory) Close() (err error) {
+	return d.db.Close()
+}
+
+type boltTxn struct {
+	bucket *bbolt.Bucket
+}
+
+func (txn boltTxn) get(key []byte) (value []byte, err error) {
+	return txn.bucket.Get(key), nil
+}
+
+func (txn boltTxn) put(key, value []byte) (err error) {
+	return txn.bucket.Put(key, value)
+}
+
+func (txn boltTxn) del(key []byte) (err error) {
+	return txn.bucket.Delete(key)
+}
+
+// boltIterator 把 bbolt.Cursor 包装成 rawIterator
+type boltIterator struct {
+	tx     *bbolt.Tx
+	cursor *bbolt.Cursor
+	key    []byte
+	value  []byte
+	err    error
+}
+
+func (it *boltIterator) move(key, value []byte) bool {
+	it.key, it.value = key, value
+	return key != nil
+}
+
+func (it *boltIterator) First() bool {
+	if it.cursor == nil {
+		return false
+	}
+	return it.move(it.cursor.First())
+}
+
+func (it *boltIterator) Last() bool {
+	if it.cursor == nil {
+		return false
+	}
+	return it.move(it.cursor.Last())
+}
+
+func (it *boltIterator) Seek(key []byte) bool {
+	if it.cursor == nil {
+		return false
+	}
+	return it.move(it.cursor.Seek(key))
+}
+
+func (it *boltIterator) Next() bool {
+	if it.cursor == nil {
+		return false
+	}
+	return it.move(it.cursor.Next())
+}
+
+func (it *boltIterator) Prev() bool {
+	if it.cursor == nil {
+		return false
+	}
+	return it.move(it.cursor.Prev())
+}
+
+func (it *boltIterator) Key() []byte {
+	return it.key
+}
+
+func (it *boltIterator) Value() []byte {
+	return it.value
+}
+
+func (it *boltIterator) Error() error {
+	return it.err
+}
+
+func (it *boltIterator) Release() {
+	if it.tx != nil {
+		it.tx.Rollback()
+		it.tx, it.cursor = nil, nil
+	}
+}
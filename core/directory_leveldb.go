@@ -1,21 +1,21 @@
 package core
 
 import (
-	"encoding/binary"
 	"github.com/syndtr/goleveldb/leveldb"
-	"path/filepath"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"sync"
 )
 
 type LeveldbDirectory struct {
-	db   *leveldb.DB
-	path string // leveldb 文件存放路径
+	db      *leveldb.DB
+	path    string     // leveldb 文件存放路径
+	lock    sync.Mutex // leveldb 没有事务, Write 检查条件和写入期间不能有其他写入
+	indexes IndexFlag
 	//iter iterator.Iterator
 }
 
 func NewLeveldbDirectory(dir string) (d *LeveldbDirectory, err error) {
 	d = new(LeveldbDirectory)
-	d.path = filepath.Join(dir, "index") // TODO all volumes in one directory. Future: one volume one directory
+	d.path = DirectoryPath(DirectoryLeveldb, dir) // TODO all volumes in one directory. Future: one volume one directory
 	d.db, err = leveldb.OpenFile(d.path, nil)
 	if err != nil {
 		return nil, err
@@ -25,9 +25,10 @@ func NewLeveldbDirectory(dir string) (d *LeveldbDirectory, err error) {
 }
 
 func (d *LeveldbDirectory) Get(id uint64) (n *Needle, err error) {
-	key := make([]byte, 8)
-	binary.BigEndian.PutUint64(key, id)
-	data, err := d.db.Get(key, nil)
+	data, err := d.db.Get(needleKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNeedleNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -37,57 +38,76 @@ func (d *LeveldbDirectory) Get(id uint64) (n *Needle, err error) {
 }
 
 func (d *LeveldbDirectory) New(n *Needle) (err error) {
-	data, err := NeedleMarshal(n)
-	if err != nil {
-		return err
-	}
-	return d.db.Put(data[:8], data, nil)
+	b := NewBatch()
+	b.Put(n)
+	return d.Write(b)
 }
 
 func (d *LeveldbDirectory) Has(id uint64) (has bool) {
-	key := make([]byte, 8)
-	binary.BigEndian.PutUint64(key, id)
-	_, err := d.db.Get(key, nil)
+	_, err := d.db.Get(needleKey(id), nil)
 	return err == nil
 }
 
 func (d *LeveldbDirectory) Set(id uint64, needle *Needle) (err error) {
-	oldNeedle, err := d.Get(id)
-	if err != nil {
-		 return
-	}
-	err = d.Del(id)
-	if err != nil {
-		return d.New(oldNeedle)
-	}
-	return d.New(needle)
+	b := NewBatch()
+	b.Update(id, needle)
+	return d.Write(b)
 }
 
 func (d *LeveldbDirectory) Del(id uint64) (err error) {
-	key := make([]byte, 8)
-	binary.BigEndian.PutUint64(key, id)
-	return d.db.Delete(key, nil)
+	b := NewBatch()
+	b.Delete(id)
+	return d.Write(b)
 }
 
-func (d *LeveldbDirectory) Iter() (iter Iterator) {
-	it :=  d.db.NewIterator(nil, nil)
-	levelIt := &LeveldbIterator{
-		iter: it,
+// Write 用一个 leveldb.Batch 提交所有修改
+func (d *LeveldbDirectory) Write(b *Batch) (err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	txn := &leveldbTxn{db: d.db, batch: new(leveldb.Batch)}
+	err = b.apply(txn, d.indexes)
+	if err != nil {
+		return
 	}
-	return levelIt
+	return d.db.Write(txn.batch, nil)
+}
+
+// Iter leveldb 的迭代器本身就是在快照上进行的
+func (d *LeveldbDirectory) Iter(opt *IterOptions) (iter Iterator) {
+	return newNeedleIterator(d.rawIter(), opt)
 }
 
-type LeveldbIterator struct {
-	iter iterator.Iterator
+func (d *LeveldbDirectory) rawIter() rawIterator {
+	return d.db.NewIterator(nil, nil)
 }
 
+func (d *LeveldbDirectory) List(q *Query) (needles []*Needle, cursor string, err error) {
+	return listNeedles(d.db.NewIterator(nil, nil), d.indexes, q, d.Get)
+}
+
+func (d *LeveldbDirectory) Close() (err error) {
+	return d.db.Close()
+}
+
+type leveldbTxn struct {
+	db    *leveldb.DB
+	batch *leveldb.Batch
+}
 
-func (it *LeveldbIterator) Next() (key []byte, exists bool) {
-	exists = it.iter.Next()
-	key = it.iter.Key()
+func (txn *leveldbTxn) get(key []byte) (value []byte, err error) {
+	value, err = txn.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
 	return
 }
 
-func (it *LeveldbIterator) Release() {
-	it.iter.Release()
+func (txn *leveldbTxn) put(key, value []byte) (err error) {
+	txn.batch.Put(key, value)
+	return
+}
+
+func (txn *leveldbTxn) del(key []byte) (err error) {
+	txn.batch.Delete(key)
+	return
 }
@@ -7,7 +7,6 @@ import (
 	"testing"
 	"time"
 	"os"
-	"encoding/binary"
 )
 
 func TestLeveldbDirectory_leveldb(t *testing.T) {
@@ -69,16 +68,10 @@ func TestLeveldbDirectory_Iter(t *testing.T) {
 	id, err := v.NewFile([]byte("dde"), "dde1")
 	assert.NoError(t, err)
 	t.Log(id)
-	iter := v.Directory.Iter()
-	var key []byte = make([]byte, 8)
-	var exists bool = true
-	for exists {
-		key, exists = iter.Next()
-		t.Log(id, exists)
-		if exists {
-			id := binary.BigEndian.Uint64(key)
-			t.Log(id)
-		}
+	iter := v.Directory.Iter(nil)
+	for iter.Next() {
+		t.Log(iter.Needle().ID)
 	}
+	assert.NoError(t, iter.Err())
 	iter.Release()
 }
\ No newline at end of file
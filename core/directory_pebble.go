@@ -0,0 +1,170 @@
+package core
+
+import (
+	"github.com/cockroachdb/pebble"
+	"sync"
+)
+
+type PebbleDirectory struct {
+	db      *pebble.DB
+	path    string     // pebble 文件存放路径
+	lock    sync.Mutex // Write 检查条件和写入期间不能有其他写入
+	indexes IndexFlag
+}
+
+func NewPebbleDirectory(dir string) (d *PebbleDirectory, err error) {
+	d = new(PebbleDirectory)
+	d.path = DirectoryPath(DirectoryPebble, dir)
+	d.db, err = pebble.Open(d.path, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (d *PebbleDirectory) Get(id uint64) (n *Needle, err error) {
+	data, closer, err := d.db.Get(needleKey(id))
+	if err == pebble.ErrNotFound {
+		return nil, ErrNeedleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return NeedleUnmarshal(data)
+}
+
+func (d *PebbleDirectory) New(n *Needle) (err error) {
+	b := NewBatch()
+	b.Put(n)
+	return d.Write(b)
+}
+
+func (d *PebbleDirectory) Has(id uint64) (has bool) {
+	_, closer, err := d.db.Get(needleKey(id))
+	if err != nil {
+		return false
+	}
+	closer.Close()
+	return true
+}
+
+func (d *PebbleDirectory) Set(id uint64, needle *Needle) (err error) {
+	b := NewBatch()
+	b.Update(id, needle)
+	return d.Write(b)
+}
+
+func (d *PebbleDirectory) Del(id uint64) (err error) {
+	b := NewBatch()
+	b.Delete(id)
+	return d.Write(b)
+}
+
+// Write 用一个 pebble batch 提交所有修改
+func (d *PebbleDirectory) Write(b *Batch) (err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	txn := &pebbleTxn{db: d.db, batch: d.db.NewBatch()}
+	defer txn.batch.Close()
+	err = b.apply(txn, d.indexes)
+	if err != nil {
+		return
+	}
+	return txn.batch.Commit(pebble.Sync)
+}
+
+// Iter pebble 的迭代器本身就是在快照上进行的
+func (d *PebbleDirectory) Iter(opt *IterOptions) (iter Iterator) {
+	return newNeedleIterator(d.rawIter(), opt)
+}
+
+func (d *PebbleDirectory) rawIter() rawIterator {
+	it, err := d.db.NewIter(nil)
+	return &pebbleIterator{iter: it, err: err}
+}
+
+func (d *PebbleDirectory) List(q *Query) (needles []*Needle, cursor string, err error) {
+	it, err := d.db.NewIter(nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return listNeedles(&pebbleIterator{iter: it}, d.indexes, q, d.Get)
+}
+
+func (d *PebbleDirectory) Close() (err error) {
+	return d.db.Close()
+}
+
+type pebbleTxn struct {
+	db    *pebble.DB
+	batch *pebble.Batch
+}
+
+func (txn *pebbleTxn) get(key []byte) (value []byte, err error) {
+	data, closer, err := txn.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return append([]byte(nil), data...), nil
+}
+
+func (txn *pebbleTxn) put(key, value []byte) (err error) {
+	return txn.batch.Set(key, value, nil)
+}
+
+func (txn *pebbleTxn) del(key []byte) (err error) {
+	return txn.batch.Delete(key, nil)
+}
+
+// pebbleIterator 把 pebble.Iterator 包装成 rawIterator
+type pebbleIterator struct {
+	iter *pebble.Iterator
+	err  error
+}
+
+func (it *pebbleIterator) First() bool {
+	return it.iter != nil && it.iter.First()
+}
+
+func (it *pebbleIterator) Last() bool {
+	return it.iter != nil && it.iter.Last()
+}
+
+func (it *pebbleIterator) Seek(key []byte) bool {
+	return it.iter != nil && it.iter.SeekGE(key)
+}
+
+func (it *pebbleIterator) Next() bool {
+	return it.iter != nil && it.iter.Next()
+}
+
+func (it *pebbleIterator) Prev() bool {
+	return it.iter != nil && it.iter.Prev()
+}
+
+func (it *pebbleIterator) Key() []byte {
+	return it.iter.Key()
+}
+
+func (it *pebbleIterator) Value() []byte {
+	return it.iter.Value()
+}
+
+func (it *pebbleIterator) Error() error {
+	if it.iter == nil {
+		return it.err
+	}
+	return it.iter.Error()
+}
+
+func (it *pebbleIterator) Release() {
+	if it.iter != nil {
+		it.iter.Close()
+		it.iter = nil
+	}
+}
@@ -0,0 +1,348 @@
+package core
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var directoryTypes = []string{DirectoryLeveldb, DirectoryBolt, DirectoryPebble}
+
+// testDirectory 每个 Directory 实现都必须通过的测试
+func testDirectory(t *testing.T, d Directory) {
+	_, err := d.Get(1)
+	assert.Equal(t, ErrNeedleNotFound, err)
+	assert.False(t, d.Has(1))
+
+	now := time.Now()
+	for _, id := range []uint64{3, 1, 2} {
+		err = d.New(&Needle{
+			ID:        id,
+			Size:      20,
+			Offset:    60 * id,
+			FileExt:   "jpg",
+			Checksum:  uint32(id),
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+		assert.NoError(t, err)
+	}
+	n, err := d.Get(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), n.ID)
+	assert.Equal(t, uint64(20), n.Size)
+	assert.Equal(t, uint64(120), n.Offset)
+	assert.Equal(t, "jpg", n.FileExt)
+	assert.Equal(t, uint32(2), n.Checksum)
+	assert.Equal(t, now.Unix(), n.CreatedAt.Unix())
+	assert.True(t, d.Has(2))
+
+	n.Offset = 70
+	err = d.Set(2, n)
+	assert.NoError(t, err)
+	n, err = d.Get(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(70), n.Offset)
+	err = d.Set(9, n)
+	assert.Equal(t, ErrNeedleNotFound, err)
+
+	// Iter 默认按 id 从小到大
+	assert.Equal(t, []uint64{1, 2, 3}, iterIDs(t, d, nil))
+
+	err = d.Del(2)
+	assert.NoError(t, err)
+	assert.False(t, d.Has(2))
+	_, err = d.Get(2)
+	assert.Equal(t, ErrNeedleNotFound, err)
+}
+
+// testDirectoryIter Iter 的范围, 方向, Seek 和快照
+func testDirectoryIter(t *testing.T, d Directory) {
+	for id := uint64(10); id <= 50; id += 10 {
+		err := d.New(&Needle{ID: id, Size: id})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []uint64{10, 20, 30, 40, 50}, iterIDs(t, d, nil))
+	assert.Equal(t, []uint64{50, 40, 30, 20, 10}, iterIDs(t, d, &IterOptions{Reverse: true}))
+	assert.Equal(t, []uint64{20, 30}, iterIDs(t, d, &IterOptions{Start: 15, End: 40}))
+	assert.Equal(t, []uint64{30, 20}, iterIDs(t, d, &IterOptions{Start: 15, End: 40, Reverse: true}))
+	assert.Empty(t, iterIDs(t, d, &IterOptions{Start: 60}))
+
+	iter := d.Iter(nil)
+	assert.True(t, iter.Seek(25))
+	assert.Equal(t, uint64(30), iter.Needle().ID)
+	assert.True(t, iter.Next())
+	assert.Equal(t, uint64(40), iter.Needle().ID)
+	assert.False(t, iter.Seek(55))
+	assert.Nil(t, iter.Needle())
+	iter.Release()
+
+	iter = d.Iter(&IterOptions{Reverse: true})
+	assert.True(t, iter.Seek(25))
+	assert.Equal(t, uint64(20), iter.Needle().ID)
+	assert.True(t, iter.Seek(99))
+	assert.Equal(t, uint64(50), iter.Needle().ID)
+	assert.False(t, iter.Seek(5))
+	iter.Release()
+
+	// 迭代器创建后的修改对它不可见. bolt 的写入可能要等迭代器释放, 所以在另一个 goroutine 中写
+	iter = d.Iter(nil)
+	written := make(chan error)
+	go func() { written <- d.New(&Needle{ID: 35}) }()
+	var ids []uint64
+	for iter.Next() {
+		ids = append(ids, iter.Needle().ID)
+	}
+	assert.NoError(t, iter.Err())
+	iter.Release()
+	assert.NoError(t, <-written)
+	assert.Equal(t, []uint64{10, 20, 30, 40, 50}, ids)
+	assert.Equal(t, []uint64{10, 20, 30, 35, 40, 50}, iterIDs(t, d, nil))
+}
+
+// testDirectoryBatch Write 要么全部生效, 要么都不生效
+func testDirectoryBatch(t *testing.T, d Directory) {
+	b := NewBatch()
+	for id := uint64(1); id <= 3; id++ {
+		b.Put(&Needle{ID: id, Offset: id})
+	}
+	b.Delete(9)
+	assert.Equal(t, 4, b.Len())
+	err := d.Write(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3}, iterIDs(t, d, nil))
+
+	old, err := d.Get(1)
+	assert.NoError(t, err)
+	b = NewBatch()
+	b.Delete(2)
+	b.CompareAndSet(1, old, &Needle{ID: 1, Offset: 100})
+	b.CompareAndSet(3, old, &Needle{ID: 3, Offset: 300}) // 3 与 old 不同
+	err = d.Write(b)
+	assert.Equal(t, ErrConflict, err)
+	assert.Equal(t, []uint64{1, 2, 3}, iterIDs(t, d, nil))
+	n, err := d.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), n.Offset)
+
+	b = NewBatch()
+	b.Delete(2)
+	b.CompareAndSet(1, old, &Needle{ID: 1, Offset: 100})
+	b.CompareAndSet(4, nil, &Needle{ID: 4, Offset: 400})
+	err = d.Write(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 3, 4}, iterIDs(t, d, nil))
+	n, err = d.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), n.Offset)
+
+	b = NewBatch()
+	b.Delete(1)
+	b.Update(5, &Needle{ID: 5})
+	err = d.Write(b)
+	assert.Equal(t, ErrNeedleNotFound, err)
+	assert.True(t, d.Has(1))
+
+	b = NewBatch()
+	b.CompareAndSet(4, &Needle{ID: 4, Offset: 400}, nil)
+	err = d.Write(b)
+	assert.NoError(t, err)
+	assert.False(t, d.Has(4))
+
+	// 检查的是前面的操作执行后的状态
+	a, c := &Needle{ID: 3, Offset: 301}, &Needle{ID: 3, Offset: 302}
+	b = NewBatch()
+	b.CompareAndSet(3, &Needle{ID: 3, Offset: 3}, a)
+	b.CompareAndSet(3, &Needle{ID: 3, Offset: 3}, c)
+	err = d.Write(b)
+	assert.Equal(t, ErrConflict, err)
+	b = NewBatch()
+	b.CompareAndSet(3, &Needle{ID: 3, Offset: 3}, a)
+	b.CompareAndSet(3, a, c)
+	err = d.Write(b)
+	assert.NoError(t, err)
+	n, err = d.Get(3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(302), n.Offset)
+}
+
+// testDirectoryList List 的过滤, 分页以及二级索引随写入更新
+func testDirectoryList(t *testing.T, d Directory) {
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	files := []string{"a.jpg", "b.pdf", "c.jpg", "a.jpg", "d.png", "e.jpg"}
+	b := NewBatch()
+	for i, name := range files {
+		b.Put(&Needle{
+			ID:        uint64(i + 1),
+			Filename:  name,
+			FileExt:   Ext(name),
+			CreatedAt: day.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	err := d.Write(b)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, listIDs(t, d, Query{Limit: 4}))
+	assert.Equal(t, []uint64{1, 3, 4, 6}, listIDs(t, d, Query{Ext: "jpg", Limit: 3}))
+	assert.Equal(t, []uint64{1, 4}, listIDs(t, d, Query{Filename: "a.jpg"}))
+	assert.Equal(t, []uint64{4}, listIDs(t, d, Query{Filename: "a.jpg", CreatedAfter: day.Add(time.Hour)}))
+	assert.Equal(t, []uint64{2, 3}, listIDs(t, d, Query{CreatedAfter: day.Add(time.Hour), CreatedBefore: day.Add(3 * time.Hour)}))
+	assert.Equal(t, []uint64{3, 4, 6}, listIDs(t, d, Query{Ext: "jpg", CreatedAfter: day.Add(2 * time.Hour), Limit: 1}))
+
+	// 修改和删除之后索引也跟着变
+	b = NewBatch()
+	b.Update(3, &Needle{ID: 3, Filename: "c.gif", FileExt: "gif", CreatedAt: day})
+	b.Delete(6)
+	err = d.Write(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 4}, listIDs(t, d, Query{Ext: "jpg"}))
+	assert.Equal(t, []uint64{3}, listIDs(t, d, Query{Ext: "gif"}))
+	assert.Equal(t, []uint64{1, 3}, listIDs(t, d, Query{CreatedBefore: day.Add(time.Hour)}))
+	assert.Empty(t, listIDs(t, d, Query{Filename: "e.jpg"}))
+
+	_, _, err = d.List(&Query{Cursor: "!!"})
+	assert.Equal(t, ErrWrongCursor, err)
+	// 二级索引不会出现在 Iter 中
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5}, iterIDs(t, d, nil))
+	assert.Equal(t, []uint64{5, 4, 3, 2, 1}, iterIDs(t, d, &IterOptions{Reverse: true}))
+}
+
+// listIDs 按 q 翻完所有页
+func listIDs(t *testing.T, d Directory, q Query) (ids []uint64) {
+	for {
+		needles, cursor, err := d.List(&q)
+		assert.NoError(t, err)
+		assert.True(t, len(needles) <= q.Limit || q.Limit == 0)
+		for _, n := range needles {
+			ids = append(ids, n.ID)
+		}
+		if cursor == "" {
+			return
+		}
+		q.Cursor = cursor
+	}
+}
+
+func iterIDs(t *testing.T, d Directory, opt *IterOptions) (ids []uint64) {
+	iter := d.Iter(opt)
+	defer iter.Release()
+	for iter.Next() {
+		ids = append(ids, iter.Needle().ID)
+	}
+	assert.NoError(t, iter.Err())
+	return
+}
+
+func TestDirectory(t *testing.T) {
+	for _, typ := range directoryTypes {
+		t.Run(typ, func(t *testing.T) {
+			d, err := OpenDirectory(typ, t.TempDir(), 0)
+			assert.NoError(t, err)
+			defer d.Close()
+			testDirectory(t, d)
+		})
+		t.Run(typ+"/iter", func(t *testing.T) {
+			d, err := OpenDirectory(typ, t.TempDir(), 0)
+			assert.NoError(t, err)
+			defer d.Close()
+			testDirectoryIter(t, d)
+		})
+		t.Run(typ+"/batch", func(t *testing.T) {
+			d, err := OpenDirectory(typ, t.TempDir(), 0)
+			assert.NoError(t, err)
+			defer d.Close()
+			testDirectoryBatch(t, d)
+		})
+		for _, indexes := range []IndexFlag{0, IndexAll} {
+			t.Run(fmt.Sprintf("%s/list-%d", typ, indexes), func(t *testing.T) {
+				d, err := OpenDirectory(typ, t.TempDir(), indexes)
+				assert.NoError(t, err)
+				defer d.Close()
+				testDirectoryList(t, d)
+			})
+		}
+	}
+}
+
+func TestOpenDirectory_Unknown(t *testing.T) {
+	_, err := OpenDirectory("mysql", t.TempDir(), 0)
+	assert.Equal(t, ErrUnknownDirectory, err)
+}
+
+func TestMigrateDirectory(t *testing.T) {
+	dir := t.TempDir()
+	src, err := OpenDirectory(DirectoryLeveldb, dir, 0)
+	assert.NoError(t, err)
+	defer src.Close()
+	dst, err := OpenDirectory(DirectoryBolt, dir, IndexAll)
+	assert.NoError(t, err)
+	defer dst.Close()
+	for i := uint64(1); i <= 10; i++ {
+		err = src.New(&Needle{ID: i, Size: i, Offset: i * 100})
+		assert.NoError(t, err)
+	}
+	count, err := MigrateDirectory(src, dst)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, count)
+	for i := uint64(1); i <= 10; i++ {
+		n, err := dst.Get(i)
+		assert.NoError(t, err)
+		assert.Equal(t, i*100, n.Offset)
+	}
+}
+
+func TestGetNeedles(t *testing.T) {
+	for _, typ := range directoryTypes {
+		t.Run(typ, func(t *testing.T) {
+			d, err := OpenDirectory(typ, t.TempDir(), IndexAll)
+			assert.NoError(t, err)
+			defer d.Close()
+			for _, id := range []uint64{2, 4, 6} {
+				assert.NoError(t, d.New(&Needle{ID: id, Offset: id * 100, Filename: "a.txt", FileExt: "txt"}))
+			}
+			needles, err := GetNeedles(d, []uint64{6, 1, 4, 7, 4})
+			assert.NoError(t, err)
+			assert.Len(t, needles, 5)
+			for i, id := range []uint64{6, 0, 4, 0, 4} {
+				if id == 0 {
+					assert.Nil(t, needles[i])
+				} else {
+					assert.Equal(t, id*100, needles[i].Offset)
+				}
+			}
+		})
+	}
+}
+
+// 按索引查询和写入同时进行时, bolt 扩大文件不能被查询中的事务卡住
+func TestBoltDirectory_ListWhileWriting(t *testing.T) {
+	d, err := OpenDirectory(DirectoryBolt, t.TempDir(), IndexAll)
+	assert.NoError(t, err)
+	defer d.Close()
+	done := make(chan error)
+	go func() {
+		for id := uint64(1); id <= 2000; id++ {
+			err := d.New(&Needle{ID: id, Filename: fmt.Sprintf("file-%d.txt", id), FileExt: "txt", CreatedAt: time.Now()})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+			assert.Len(t, listIDs(t, d, Query{Ext: "txt", Limit: 500}), 2000)
+			return
+		case <-timeout:
+			t.Fatal("deadlock between List and New")
+		default:
+		}
+		_, _, err := d.List(&Query{Ext: "txt", Limit: 50})
+		assert.NoError(t, err)
+	}
+}
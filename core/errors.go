@@ -3,10 +3,24 @@ package core
 import "errors"
 
 var (
-	ErrNilNeedle   = errors.New("Nil needle")
-	ErrWrongLen    = errors.New("Wrong length of needle bytes ")
-	ErrLeakSpace   = errors.New("Volume leak of space")
-	ErrDeleted     = errors.New("Needle is deleted")
-	ErrSmallNeedle = errors.New("Needle's size less than data size")
-	ErrWrongCheckSum = errors.New("Checksum err")
+	ErrNilNeedle        = errors.New("Nil needle")
+	ErrWrongLen         = errors.New("Wrong length of needle bytes ")
+	ErrLeakSpace        = errors.New("Volume leak of space")
+	ErrDeleted          = errors.New("Needle is deleted")
+	ErrSmallNeedle      = errors.New("Needle's size less than data size")
+	ErrWrongCheckSum    = errors.New("Checksum err")
+	ErrNeedleNotFound   = errors.New("Needle not found")
+	ErrUnknownDirectory = errors.New("Unknown directory type")
+	ErrLongName         = errors.New("File name too long")
+	ErrUnknownIndex     = errors.New("Unknown index")
+	ErrWrongCursor      = errors.New("Wrong list cursor")
+	ErrExpired          = errors.New("Needle is expired")
+	ErrTTLMismatch      = errors.New("TTL differs from the volume's")
+	ErrWrongWhence      = errors.New("Wrong seek whence or negative position")
+	ErrConflict         = errors.New("Needle changed by others")
+	ErrClosed           = errors.New("Volume is closed")
+	ErrCorruptNeedle    = errors.New("Corrupt needle header")
+	ErrHeaderMismatch   = errors.New("Needle header differs from the index")
+	ErrNotIndexed       = errors.New("Needle not in the index")
+	ErrFormatVersion    = errors.New("Unsupported directory format")
 )
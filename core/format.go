@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// FormatVersion 当前 Directory 和 Volume 文件的格式版本, 记录在 Directory 中.
+// 版本 1 是没有记录版本号的最早格式: Directory 只有 leveldb, key 是 8 字节的 needle id,
+// header 是 44 字节的固定部分加扩展名. 见 UpgradeVolume.
+// 版本 2 的 key 见 needleKey 和 indexKeys, header 见 NeedleMarshal.
+const FormatVersion uint32 = 2
+
+// Directory 中的元数据
+var (
+	metaVersion = []byte{prefixMeta, 'v'} // FormatVersion, 4 字节
+	metaIndexes = []byte{prefixMeta, 'i'} // 已经建好的二级索引, 1 字节的 IndexFlag
+)
+
+// kvDirectory 各后端都提供的底层 key-value 迭代器, 用来读元数据和回填二级索引
+type kvDirectory interface {
+	Directory
+	rawIter() rawIterator
+}
+
+// getRaw 读取 key 的值, 不存在时返回 nil, nil
+func getRaw(d kvDirectory, key []byte) (value []byte, err error) {
+	raw := d.rawIter()
+	defer raw.Release()
+	if raw.Seek(key) && bytes.Equal(raw.Key(), key) {
+		return append([]byte{}, raw.Value()...), nil
+	}
+	return nil, raw.Error()
+}
+
+// initFormat 检查 d 的格式版本, 空的 Directory 写入当前版本. 版本不一致时返回 ErrFormatVersion.
+// 然后让二级索引与 indexes 一致: 新加的索引从已有的 needle 回填, 去掉的索引删除
+func initFormat(d kvDirectory, indexes IndexFlag) (err error) {
+	data, err := getRaw(d, metaVersion)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return stampFormat(d, indexes)
+	}
+	if len(data) != 4 {
+		return fmt.Errorf("%w: wrong version %x", ErrFormatVersion, data)
+	}
+	if version := binary.BigEndian.Uint32(data); version != FormatVersion {
+		return fmt.Errorf("%w: version %d, expect %d", ErrFormatVersion, version, FormatVersion)
+	}
+	data, err = getRaw(d, metaIndexes)
+	if err != nil {
+		return err
+	}
+	var built IndexFlag
+	if len(data) == 1 {
+		built = IndexFlag(data[0])
+	}
+	if built == indexes {
+		return nil
+	}
+	return reindex(d, built, indexes)
+}
+
+// stampFormat 给没有版本号的 Directory 写入当前版本. 已经有数据的是版本 1 或者无法识别的格式, 不能直接打开
+func stampFormat(d kvDirectory, indexes IndexFlag) (err error) {
+	raw := d.rawIter()
+	empty := !raw.First()
+	var key []byte
+	if !empty {
+		key = append(key, raw.Key()...)
+	}
+	err = raw.Error()
+	raw.Release()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		if len(key) == 8 {
+			return fmt.Errorf("%w: version 1, expect %d", ErrFormatVersion, FormatVersion)
+		}
+		return fmt.Errorf("%w: no version recorded", ErrFormatVersion)
+	}
+	b := NewBatch()
+	b.putRaw(metaVersion, binary.BigEndian.AppendUint32(nil, FormatVersion))
+	b.putRaw(metaIndexes, []byte{byte(indexes)})
+	return d.Write(b)
+}
+
+// reindex 把二级索引从 built 改成 indexes. 中途失败时元数据中仍是 built, 下次打开时重新进行
+func reindex(d kvDirectory, built, indexes IndexFlag) (err error) {
+	added, dropped := indexes&^built, built&^indexes
+	var add, del [][]byte
+	raw := d.rawIter()
+	for ok := raw.Seek([]byte{prefixIndex}); ok && raw.Key()[0] == prefixIndex; ok = raw.Next() {
+		if indexKind(raw.Key())&dropped != 0 {
+			del = append(del, append([]byte(nil), raw.Key()...))
+		}
+	}
+	err = raw.Error()
+	raw.Release()
+	if err != nil {
+		return err
+	}
+	if added != 0 {
+		iter := d.Iter(nil)
+		for iter.Next() {
+			add = append(add, indexKeys(iter.Needle(), added)...)
+		}
+		err = iter.Err()
+		iter.Release()
+		if err != nil {
+			return err
+		}
+	}
+	// 写入时不能持有迭代器, 见 BoltDirectory.Iter
+	b := NewBatch()
+	flush := func() error {
+		if b.Len() < rebuildBatchSize {
+			return nil
+		}
+		err := d.Write(b)
+		b.Reset()
+		return err
+	}
+	for _, key := range del {
+		b.delRaw(key)
+		if err = flush(); err != nil {
+			return err
+		}
+	}
+	for _, key := range add {
+		b.putRaw(key, []byte{})
+		if err = flush(); err != nil {
+			return err
+		}
+	}
+	b.putRaw(metaIndexes, []byte{byte(indexes)})
+	return d.Write(b)
+}
+
+// indexKind 二级索引的 key 属于哪种索引
+func indexKind(key []byte) IndexFlag {
+	if len(key) < 2 {
+		return 0
+	}
+	switch key[1] {
+	case indexByFilename:
+		return IndexFilename
+	case indexByExt:
+		return IndexExt
+	case indexByTime:
+		return IndexCreatedAt
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"encoding/binary"
+	"github.com/hmli/simplefs/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenDirectory_Reindex(t *testing.T) {
+	for _, typ := range directoryTypes {
+		t.Run(typ, func(t *testing.T) {
+			dir := t.TempDir()
+			d, err := OpenDirectory(typ, dir, 0)
+			assert.NoError(t, err)
+			for _, name := range []string{"a.txt", "b.txt", "c.json"} {
+				assert.NoError(t, d.New(&Needle{ID: uint64(len(name) + int(name[0])), Filename: name, FileExt: Ext(name), CreatedAt: time.Now()}))
+			}
+			assert.NoError(t, d.Close())
+
+			// 开启索引时回填已有的 needle
+			d, err = OpenDirectory(typ, dir, IndexExt)
+			assert.NoError(t, err)
+			key := stringIndexKey(indexByExt, "txt", uint64(len("a.txt")+'a'))
+			value, err := getRaw(d.(kvDirectory), key)
+			assert.NoError(t, err)
+			assert.NotNil(t, value)
+			assert.Len(t, listIDs(t, d, Query{Ext: "txt"}), 2)
+			assert.NoError(t, d.Close())
+
+			// 关闭索引时删掉
+			d, err = OpenDirectory(typ, dir, 0)
+			assert.NoError(t, err)
+			value, err = getRaw(d.(kvDirectory), key)
+			assert.NoError(t, err)
+			assert.Nil(t, value)
+			assert.Len(t, listIDs(t, d, Query{Ext: "txt"}), 2)
+
+			// 版本不同时不能打开
+			b := NewBatch()
+			b.putRaw(metaVersion, binary.BigEndian.AppendUint32(nil, FormatVersion+1))
+			assert.NoError(t, d.Write(b))
+			assert.NoError(t, d.Close())
+			_, err = OpenDirectory(typ, dir, 0)
+			assert.ErrorIs(t, err, ErrFormatVersion)
+		})
+	}
+}
+
+// writeV1Volume 在 dir 中写入一个版本 1 的 Volume, 内容为 files, key 是 id
+func writeV1Volume(t *testing.T, dir string, files map[uint64]string) {
+	db, err := leveldb.OpenFile(DirectoryPath(DirectoryLeveldb, dir), nil)
+	assert.NoError(t, err)
+	f, err := os.Create(filepath.Join(dir, "1.data"))
+	assert.NoError(t, err)
+	offset := InitIndexSize
+	for id, data := range files {
+		header := make([]byte, v1NeedleFixSize, v1NeedleFixSize+3)
+		binary.BigEndian.PutUint64(header[0:8], id)
+		binary.BigEndian.PutUint64(header[8:16], uint64(len(data)))
+		binary.BigEndian.PutUint64(header[16:24], offset)
+		binary.BigEndian.PutUint32(header[24:28], utils.Checksum([]byte(data)))
+		binary.BigEndian.PutUint64(header[28:36], uint64(time.Now().Unix()))
+		header = append(header, "txt"...)
+		_, err = f.WriteAt(append(header, data...), int64(offset))
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put(binary.BigEndian.AppendUint64(nil, id), header, nil))
+		offset += uint64(len(header) + len(data))
+	}
+	_, err = f.WriteAt(binary.BigEndian.AppendUint64(nil, offset), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, db.Close())
+}
+
+func TestUpgradeVolume(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	files := map[uint64]string{10: "first", 20: "second file", 30: ""}
+	writeV1Volume(t, dir, files)
+	_, err := NewVolume(1, dir)
+	assert.ErrorIs(t, err, ErrFormatVersion)
+
+	count, err := UpgradeVolume(dir, 1, out, DirectoryBolt, IndexExt)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	v, err := NewVolumeWithConfig(1, out, &VolumeConfig{Directory: DirectoryBolt, Indexes: IndexExt})
+	assert.NoError(t, err)
+	defer v.Close()
+	for id, data := range files {
+		n, read, err := v.ReadFile(id)
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(read))
+		assert.Equal(t, "txt", n.FileExt)
+	}
+	needles, _, err := v.Directory.List(&Query{Ext: "txt"})
+	assert.NoError(t, err)
+	assert.Len(t, needles, 3)
+	checked, problems, err := v.Verify()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, checked)
+	assert.Empty(t, problems)
+
+	// 只转换版本 1
+	_, err = UpgradeVolume(out, 1, t.TempDir(), "", 0)
+	assert.Error(t, err)
+}
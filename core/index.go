@@ -0,0 +1,198 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// IndexFlag Directory 中可选的二级索引
+type IndexFlag uint8
+
+const (
+	IndexFilename  IndexFlag = 1 << iota // 按原始文件名
+	IndexExt                             // 按扩展名
+	IndexCreatedAt                       // 按创建时间
+
+	IndexAll = IndexFilename | IndexExt | IndexCreatedAt
+)
+
+// Directory 中 key 的前缀. needle 本身存在 'n' 下, 二级索引存在 'i' 下,
+// 索引的 key 以 needle id 结尾, value 为空. 格式版本等元数据存在 'm' 下, 见 format.go
+const (
+	prefixNeedle    byte = 'n'
+	prefixIndex     byte = 'i'
+	prefixMeta      byte = 'm'
+	indexByFilename byte = 'f'
+	indexByExt      byte = 'e'
+	indexByTime     byte = 't'
+)
+
+const DefaultListLimit = 100
+
+// ParseIndexFlag 解析逗号分隔的索引名: filename, ext, created, all
+func ParseIndexFlag(s string) (flags IndexFlag, err error) {
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "filename":
+			flags |= IndexFilename
+		case "ext":
+			flags |= IndexExt
+		case "created":
+			flags |= IndexCreatedAt
+		case "all":
+			flags |= IndexAll
+		default:
+			return 0, ErrUnknownIndex
+		}
+	}
+	return
+}
+
+// Query Directory.List 的过滤条件, 零值的条件不生效
+type Query struct {
+	Filename      string
+	Ext           string
+	CreatedAfter  time.Time // 包含
+	CreatedBefore time.Time // 不包含
+	Limit         int       // 每页数量, 默认 DefaultListLimit
+	Cursor        string    // 上一页返回的 cursor, 为空表示第一页
+}
+
+func (q *Query) match(n *Needle) bool {
+	if q.Filename != "" && n.Filename != q.Filename {
+		return false
+	}
+	if q.Ext != "" && n.FileExt != q.Ext {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && n.CreatedAt.Unix() < q.CreatedAfter.Unix() {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && n.CreatedAt.Unix() >= q.CreatedBefore.Unix() {
+		return false
+	}
+	return true
+}
+
+// indexKeys n 在 flags 指定的二级索引中的 key
+func indexKeys(n *Needle, flags IndexFlag) (keys [][]byte) {
+	if flags&IndexFilename != 0 {
+		keys = append(keys, stringIndexKey(indexByFilename, n.Filename, n.ID))
+	}
+	if flags&IndexExt != 0 {
+		keys = append(keys, stringIndexKey(indexByExt, n.FileExt, n.ID))
+	}
+	if flags&IndexCreatedAt != 0 {
+		key := timeIndexPrefix(n.CreatedAt)
+		key = binary.BigEndian.AppendUint64(key, n.ID)
+		keys = append(keys, key)
+	}
+	return
+}
+
+func stringIndexKey(kind byte, value string, id uint64) (key []byte) {
+	key = stringIndexPrefix(kind, value)
+	return binary.BigEndian.AppendUint64(key, id)
+}
+
+func stringIndexPrefix(kind byte, value string) (prefix []byte) {
+	prefix = append([]byte{prefixIndex, kind}, value...)
+	return append(prefix, 0)
+}
+
+func timeIndexPrefix(t time.Time) (prefix []byte) {
+	prefix = []byte{prefixIndex, indexByTime}
+	return binary.BigEndian.AppendUint64(prefix, uint64(t.Unix()))
+}
+
+// prefixEnd 所有以 prefix 开头的 key 之后的第一个 key
+func prefixEnd(prefix []byte) (end []byte) {
+	end = append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// listNeedles 在 raw 上按 q 做一次分页查询, 有可用的二级索引时只扫描索引.
+// get 用来按索引中的 id 取回 needle.
+func listNeedles(raw rawIterator, flags IndexFlag, q *Query, get func(id uint64) (*Needle, error)) (needles []*Needle, cursor string, err error) {
+	defer raw.Release()
+	if q == nil {
+		q = new(Query)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	var start, end []byte
+	switch {
+	case q.Filename != "" && flags&IndexFilename != 0:
+		start = stringIndexPrefix(indexByFilename, q.Filename)
+		end = prefixEnd(start)
+	case q.Ext != "" && flags&IndexExt != 0:
+		start = stringIndexPrefix(indexByExt, q.Ext)
+		end = prefixEnd(start)
+	case (!q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero()) && flags&IndexCreatedAt != 0:
+		start = []byte{prefixIndex, indexByTime}
+		if !q.CreatedAfter.IsZero() {
+			start = timeIndexPrefix(q.CreatedAfter)
+		}
+		end = prefixEnd([]byte{prefixIndex, indexByTime})
+		if !q.CreatedBefore.IsZero() {
+			end = timeIndexPrefix(q.CreatedBefore)
+		}
+	default:
+		start = []byte{prefixNeedle}
+		end = prefixEnd(start)
+	}
+
+	var ok bool
+	var last []byte // 最后一个返回的 needle 对应的 key
+	if q.Cursor != "" {
+		last, err = base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || bytes.Compare(last, start) < 0 {
+			return nil, "", ErrWrongCursor
+		}
+		ok = raw.Seek(last)
+		if ok && bytes.Equal(raw.Key(), last) {
+			ok = raw.Next()
+		}
+	} else {
+		ok = raw.Seek(start)
+	}
+	for ; ok; ok = raw.Next() {
+		key := raw.Key()
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		var n *Needle
+		if key[0] == prefixNeedle {
+			n, err = NeedleUnmarshal(raw.Value())
+		} else {
+			n, err = get(binary.BigEndian.Uint64(key[len(key)-8:]))
+			if err == ErrNeedleNotFound {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if !q.match(n) {
+			continue
+		}
+		if len(needles) == limit { // 还有下一页
+			return needles, base64.RawURLEncoding.EncodeToString(last), nil
+		}
+		needles = append(needles, n)
+		last = append(last[:0], key...)
+	}
+	return needles, "", raw.Error()
+}
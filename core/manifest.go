@@ -0,0 +1,41 @@
+package core
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Manifest 大文件被切成多个 chunk needle 存储, Manifest 按顺序记录这些 chunk,
+// 本身作为一个带 FlagManifest 的 needle 存储, 它的 id 就是大文件的 id.
+type Manifest struct {
+	Size   uint64  `json:"size"` // 整个文件的大小
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Chunk 大文件的一段, 可以在任意 Volume 中
+type Chunk struct {
+	VolumeID uint64 `json:"vid"`
+	ID       uint64 `json:"id"`
+	Offset   uint64 `json:"offset"` // 在整个文件中的位置
+	Size     uint64 `json:"size"`
+}
+
+func MarshalManifest(m *Manifest) (data []byte, err error) {
+	return json.Marshal(m)
+}
+
+func UnmarshalManifest(data []byte) (m *Manifest, err error) {
+	m = new(Manifest)
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Find 返回包含文件中 offset 处的 chunk 的下标, 没有时返回 len(m.Chunks)
+func (m *Manifest) Find(offset uint64) int {
+	return sort.Search(len(m.Chunks), func(i int) bool {
+		return m.Chunks[i].Offset+m.Chunks[i].Size > offset
+	})
+}
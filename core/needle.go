@@ -3,44 +3,113 @@ package core
 import (
 	"encoding/binary"
 	"io"
+	"math"
 	"os"
 	"time"
 )
 
-// 64 * 3 +  32 + 64*2 = = 44 bytes for an needle header
-var NeedleFixSize uint64 = 44 // 不包括 len(Filename)
+// 64 * 3 +  32 + 64*3 + 8 + 16*3 + 64 + 32*2 = 75 bytes for an needle header
+var NeedleFixSize uint64 = 75 // 不包括 len(FileExt), len(Filename) 和 len(ContentType)
+
+// flags 在 header 中的位置, 删除时直接改写这一个 byte
+const needleFlagsOffset = 52
+
+// Needle.Flags
+const (
+	FlagDeleted     uint8 = 1 << iota // 已删除, 等待 Fragment 回收空间
+	FlagManifest                      // 内容是大文件的 Manifest, 而不是文件本身
+	FlagReplaceable                   // 以指定的 id 写入, 之后可以被替换, 内容不能长期缓存
+)
 
 // Needle in Haystack
 type Needle struct {
-	ID        uint64 // 唯一ID， 64
-	Size      uint64 // size of BODY
-	Offset    uint64 // points to start of header
-	File      *os.File
-	FileExt   string // 文件扩展名, 下载时用来判断 content-type
-	Checksum  uint32
-	rOffset   uint64 // 用在 Read() 函数里的
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID          uint64 // 唯一ID， 64
+	Size        uint64 // size of BODY
+	Offset      uint64 // points to start of header
+	File        *os.File
+	FileExt     string // 文件扩展名, 下载时用来判断 content-type
+	Filename    string // 上传时的原始文件名
+	ContentType string // 上传时记录的 MIME 类型, 为空时按 FileExt 判断
+	Checksum    uint32
+	rOffset     uint64 // 用在 Read() 函数里的
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ExpiresAt   time.Time // 过期时间, 零值表示永不过期
+	Flags       uint8
+	Parent      uint64 // 由哪个 needle 生成 (比如缩略图), 0 表示不是生成的. Parent 删除或替换后 Fragment 会一起回收
+	Width       uint32 // 图片的宽和高, 不是图片时为 0
+	Height      uint32
+	release     func() // 释放 GetNeedle 持有的 File 的引用, 见 Close
 }
 
+func (n *Needle) Deleted() bool {
+	return n.Flags&FlagDeleted != 0
+}
+
+// IsManifest 内容是否为 Manifest
+func (n *Needle) IsManifest() bool {
+	return n.Flags&FlagManifest != 0
+}
+
+// Replaceable 是否可以被替换, 见 FlagReplaceable
+func (n *Needle) Replaceable() bool {
+	return n.Flags&FlagReplaceable != 0
+}
+
+// Expired now 时 n 是否已经过期
+func (n *Needle) Expired(now time.Time) bool {
+	return !n.ExpiresAt.IsZero() && !now.Before(n.ExpiresAt)
+}
 
 func (n *Needle) Read(b []byte) (num int, err error) {
-	start := n.Offset + HeaderSize(uint64(len(n.FileExt))) + n.rOffset
-	end := start + n.Size
-	length := end - start
+	if n.rOffset >= n.Size {
+		return 0, io.EOF
+	}
+	start := n.Offset + n.HeaderSize() + n.rOffset
+	length := n.Size - n.rOffset
 	if uint64(len(b)) > length {
 		b = b[:length]
 	}
 	num, err = n.File.ReadAt(b, int64(start))
 	n.rOffset += uint64(num)
-	if n.rOffset > n.Size {
-		err = io.EOF
-	}
 	return
 }
 
+// Close 释放 GetNeedle 得到的 needle 对 Volume 文件的引用, 之后不能再读 needle 的内容.
+// Fragment 替换掉的老文件在所有读者 Close 之后才关闭. 可以多次调用
+func (n *Needle) Close() error {
+	if n.release != nil {
+		n.release()
+		n.release = nil
+	}
+	return nil
+}
+
+// Section 返回 needle 正文在 Volume 文件中的区间, 可以并发地读, 不影响 Read 的位置
+func (n *Needle) Section() *io.SectionReader {
+	return io.NewSectionReader(n.File, int64(n.Offset+n.HeaderSize()), int64(n.Size))
+}
+
+// Seek 移动 Read 的位置, 与 Read 一起让 Needle 成为 io.ReadSeeker
+func (n *Needle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(n.rOffset)
+	case io.SeekEnd:
+		offset += int64(n.Size)
+	default:
+		return 0, ErrWrongWhence
+	}
+	if offset < 0 {
+		return 0, ErrWrongWhence
+	}
+	n.rOffset = uint64(offset)
+	return offset, nil
+}
+
 func (n *Needle) Write(b []byte) (num int, err error) {
-	start := n.Offset + HeaderSize(uint64(len(n.FileExt))) + n.rOffset
+	start := n.Offset + n.HeaderSize() + n.rOffset
 	end := start + n.Size
 	length := end - start
 	if uint64(len(b)) > length { // 这个needle 预分配的空间不足以写入
@@ -52,27 +121,53 @@ func (n *Needle) Write(b []byte) (num int, err error) {
 	return
 }
 
+// HeaderSize Needle 中除了正文外的额外信息的大小
+func (n *Needle) HeaderSize() (size uint64) {
+	return NeedleFixSize + uint64(len(n.FileExt)) + uint64(len(n.Filename)) + uint64(len(n.ContentType))
+}
+
 // NeedleMarshal: Needle struct -> bytes
 func NeedleMarshal(n *Needle) (data []byte, err error) {
 	if n == nil {
 		err = ErrNilNeedle
 		return
 	}
-	data = make([]byte, HeaderSize(uint64(len(n.FileExt))))
+	if len(n.FileExt) > math.MaxUint16 || len(n.Filename) > math.MaxUint16 || len(n.ContentType) > math.MaxUint16 {
+		err = ErrLongName
+		return
+	}
+	data = make([]byte, n.HeaderSize())
 	binary.BigEndian.PutUint64(data[0:8], n.ID)
 	binary.BigEndian.PutUint64(data[8:16], n.Size)
 	binary.BigEndian.PutUint64(data[16:24], n.Offset)
 	binary.BigEndian.PutUint32(data[24:28], n.Checksum)
 	binary.BigEndian.PutUint64(data[28:36], uint64(n.CreatedAt.Unix()))
 	binary.BigEndian.PutUint64(data[36:44], uint64(n.UpdatedAt.Unix()))
-	//data[44] = byte(n.Flag)
-	copy(data[44:], []byte(n.FileExt))
+	if !n.ExpiresAt.IsZero() {
+		binary.BigEndian.PutUint64(data[44:52], uint64(n.ExpiresAt.Unix()))
+	}
+	data[needleFlagsOffset] = n.Flags
+	binary.BigEndian.PutUint16(data[53:55], uint16(len(n.FileExt)))
+	binary.BigEndian.PutUint16(data[55:57], uint16(len(n.Filename)))
+	binary.BigEndian.PutUint16(data[57:59], uint16(len(n.ContentType)))
+	binary.BigEndian.PutUint64(data[59:67], n.Parent)
+	binary.BigEndian.PutUint32(data[67:71], n.Width)
+	binary.BigEndian.PutUint32(data[71:75], n.Height)
+	extEnd := NeedleFixSize + uint64(len(n.FileExt))
+	nameEnd := extEnd + uint64(len(n.Filename))
+	copy(data[NeedleFixSize:extEnd], n.FileExt)
+	copy(data[extEnd:nameEnd], n.Filename)
+	copy(data[nameEnd:], n.ContentType)
 	return
 }
 
 // NeedleUnmarshal: bytes -> needle struct
 func NeedleUnmarshal(b []byte) (n *Needle, err error) {
-	if len(b) < int(NeedleFixSize) {
+	size, err := needleHeaderSize(b)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) < size {
 		return nil, ErrWrongLen
 	}
 	n = new(Needle)
@@ -82,13 +177,28 @@ func NeedleUnmarshal(b []byte) (n *Needle, err error) {
 	n.Checksum = binary.BigEndian.Uint32(b[24:28])
 	n.CreatedAt = time.Unix(int64(binary.BigEndian.Uint64(b[28:36])), 0)
 	n.UpdatedAt = time.Unix(int64(binary.BigEndian.Uint64(b[36:44])), 0)
-	//n.Flag = uint8(b[44])
-	n.FileExt = string(b[44:])
+	if expiresAt := binary.BigEndian.Uint64(b[44:52]); expiresAt != 0 {
+		n.ExpiresAt = time.Unix(int64(expiresAt), 0)
+	}
+	n.Flags = b[needleFlagsOffset]
+	n.Parent = binary.BigEndian.Uint64(b[59:67])
+	n.Width = binary.BigEndian.Uint32(b[67:71])
+	n.Height = binary.BigEndian.Uint32(b[71:75])
+	extEnd := NeedleFixSize + uint64(binary.BigEndian.Uint16(b[53:55]))
+	nameEnd := extEnd + uint64(binary.BigEndian.Uint16(b[55:57]))
+	n.FileExt = string(b[NeedleFixSize:extEnd])
+	n.Filename = string(b[extEnd:nameEnd])
+	n.ContentType = string(b[nameEnd:size])
 	return
 }
 
-
-// HeaderSize Needle 中除了正文外的额外信息的大小
-func HeaderSize(extsize uint64) (size uint64) {
-	return extsize + NeedleFixSize
+// needleHeaderSize 从 header 的固定部分算出整个 header 的大小
+func needleHeaderSize(b []byte) (size uint64, err error) {
+	if uint64(len(b)) < NeedleFixSize {
+		return 0, ErrWrongLen
+	}
+	extLen := uint64(binary.BigEndian.Uint16(b[53:55]))
+	nameLen := uint64(binary.BigEndian.Uint16(b[55:57]))
+	ctypeLen := uint64(binary.BigEndian.Uint16(b[57:59]))
+	return NeedleFixSize + extLen + nameLen + ctypeLen, nil
 }
@@ -3,6 +3,7 @@ package core
 import (
 	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"testing"
 )
 
@@ -29,6 +30,21 @@ func TestNeedleMarshal(t *testing.T) {
 	assert.Equal(t, n.ID, newN.ID)
 }
 
+func TestNeedleMarshal_Names(t *testing.T) {
+	n := &Needle{ID: 7, FileExt: "png", Filename: "a.png", ContentType: "image/png", Parent: 3, Width: 640, Height: 480}
+	data, err := NeedleMarshal(n)
+	assert.NoError(t, err)
+	assert.Equal(t, n.HeaderSize(), uint64(len(data)))
+	newN, err := NeedleUnmarshal(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", newN.FileExt)
+	assert.Equal(t, "a.png", newN.Filename)
+	assert.Equal(t, "image/png", newN.ContentType)
+	assert.Equal(t, uint64(3), newN.Parent)
+	assert.Equal(t, uint32(640), newN.Width)
+	assert.Equal(t, uint32(480), newN.Height)
+}
+
 func TestNeedle_ReadWrite(t *testing.T) {
 	v, err := NewVolume(1, "")
 	assert.NoError(t, err)
@@ -72,17 +88,62 @@ func TestNeedle_MultiReadWrite(t *testing.T) {
 	}
 }
 
-
 func TestVolume_DelNeedle(t *testing.T) {
 	v, err := NewVolume(1, "/tmp/fs")
 	assert.NoError(t, err)
-	id,  err := v.NewFile([]byte("aaa"), "1")
+	id, err := v.NewFile([]byte("aaa"), "1")
 	assert.NoError(t, err)
 	t.Log("New:", id)
 	assert.True(t, v.Directory.Has(id))
-	v.Print()
 	v.DelNeedle(id)
-	v.Print()
-	assert.False(t, v.Directory.Has(id))
+	_, err = v.GetNeedle(id)
+	assert.Equal(t, ErrDeleted, err)
+}
+
+func TestNeedle_Seek(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	id, err := v.NewFile([]byte("0123456789"), "digits.txt")
+	assert.NoError(t, err)
+	n, err := v.GetNeedle(id)
+	assert.NoError(t, err)
+
+	size, err := n.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+	_, err = n.Seek(3, io.SeekStart)
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(n, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "3456", string(b))
+	pos, err := n.Seek(-2, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), pos)
+	rest, err := io.ReadAll(n)
+	assert.NoError(t, err)
+	assert.Equal(t, "56789", string(rest))
+	_, err = n.Seek(-1, io.SeekStart)
+	assert.Equal(t, ErrWrongWhence, err)
+}
+
+func TestNeedle_Section(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	id1, err := v.NewFile([]byte("first"), "1.txt")
+	assert.NoError(t, err)
+	id2, err := v.NewFile([]byte("second"), "2.txt")
+	assert.NoError(t, err)
+	n1, err := v.GetNeedle(id1)
+	assert.NoError(t, err)
+	n2, err := v.GetNeedle(id2)
+	assert.NoError(t, err)
 
-}
\ No newline at end of file
+	data, err := io.ReadAll(n1.Section())
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+	b := make([]byte, 3)
+	_, err = n2.Section().ReadAt(b, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "con", string(b))
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/hmli/simplefs/utils"
+)
+
+// needle 在 Volume 文件中首尾相连, header 在分配空间时就已写入, 所以不经过 Directory 也能从头读出所有的 needle.
+// 这里是给离线工具用的检查和修复功能, 都不加锁, 调用时不能有其它的写入.
+
+// ReadNeedleHeader 读取 offset 处的 needle header
+func ReadNeedleHeader(r io.ReaderAt, offset uint64) (n *Needle, err error) {
+	fixed := make([]byte, NeedleFixSize)
+	_, err = r.ReadAt(fixed, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	size, err := needleHeaderSize(fixed)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, size)
+	copy(header, fixed)
+	_, err = r.ReadAt(header[NeedleFixSize:], int64(offset+NeedleFixSize))
+	if err != nil {
+		return nil, err
+	}
+	return NeedleUnmarshal(header)
+}
+
+// ScanNeedles 按顺序读出 Volume 文件中所有的 needle header, 包括已删除和被覆盖的.
+// header 损坏时返回 ErrCorruptNeedle, 之后的 needle 无法再读出
+func ScanNeedles(r io.ReaderAt, fn func(n *Needle) error) (err error) {
+	b := make([]byte, InitIndexSize)
+	_, err = r.ReadAt(b, 0)
+	if err == io.EOF {
+		return nil // 空文件
+	}
+	if err != nil {
+		return err
+	}
+	end := binary.BigEndian.Uint64(b)
+	for offset := InitIndexSize; offset < end; {
+		n, err := ReadNeedleHeader(r, offset)
+		if err != nil || n.Offset != offset || n.ID == 0 {
+			return fmt.Errorf("%w at offset %d", ErrCorruptNeedle, offset)
+		}
+		next := offset + n.HeaderSize() + n.Size
+		if next > end || next < offset {
+			return fmt.Errorf("%w at offset %d: size %d exceeds the volume", ErrCorruptNeedle, offset, n.Size)
+		}
+		err = fn(n)
+		if err != nil {
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+// rebuildBatchSize RebuildDirectory 每次写入 Directory 的 needle 数
+const rebuildBatchSize = 1000
+
+// RebuildDirectory 从 Volume 文件中的 header 重建 index, 写入 d. 同一个 id 以文件中最后出现的为准,
+// 删除标记也保留在 header 中, 所以重建后的 index 与原来一致. 返回写入 d 的 needle 数
+func RebuildDirectory(r io.ReaderAt, d Directory) (count int, err error) {
+	ids := make(map[uint64]bool)
+	b := NewBatch()
+	err = ScanNeedles(r, func(n *Needle) error {
+		ids[n.ID] = true
+		b.Put(n)
+		if b.Len() < rebuildBatchSize {
+			return nil
+		}
+		err := d.Write(b)
+		b.Reset()
+		return err
+	})
+	if err == nil && b.Len() > 0 {
+		err = d.Write(b)
+	}
+	return len(ids), err
+}
+
+// resetDirectory 让 d 与 Volume 文件一致: 按文件重建后, 再删掉文件中没有的 needle
+func resetDirectory(r io.ReaderAt, d Directory) (err error) {
+	ids := make(map[uint64]bool)
+	err = ScanNeedles(r, func(n *Needle) error {
+		ids[n.ID] = true
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	_, err = RebuildDirectory(r, d)
+	if err != nil {
+		return
+	}
+	var del []uint64
+	iter := d.Iter(nil)
+	for iter.Next() {
+		if id := iter.Needle().ID; !ids[id] {
+			del = append(del, id)
+		}
+	}
+	err = iter.Err()
+	iter.Release() // 写入时不能持有迭代器
+	if err != nil {
+		return
+	}
+	b := NewBatch()
+	for _, id := range del {
+		b.Delete(id)
+	}
+	return d.Write(b)
+}
+
+// VolumeStats Volume 的空间使用情况
+type VolumeStats struct {
+	Needles   int    // index 中的 needle 数
+	Deleted   int    // 已删除, 等待 Fragment 回收
+	Expired   int    // 已过期, 等待 Reap 或 Fragment 回收
+	Manifests int    // 大文件的 Manifest
+	Used      uint64 // 文件中已分配的空间, 即 CurrentOffset
+	Live      uint64 // 有效 needle 占用的空间, 包括 header
+}
+
+// Reclaimable Fragment 可以回收的空间
+func (s *VolumeStats) Reclaimable() uint64 {
+	return s.Used - InitIndexSize - s.Live
+}
+
+// Stats 遍历 index 统计 Volume 的空间使用情况
+func (v *Volume) Stats() (stats *VolumeStats, err error) {
+	stats = &VolumeStats{Used: v.CurrentOffset}
+	now := time.Now()
+	iter := v.Directory.Iter(nil)
+	defer iter.Release()
+	for iter.Next() {
+		n := iter.Needle()
+		stats.Needles++
+		switch {
+		case n.Deleted():
+			stats.Deleted++
+		case n.Expired(now):
+			stats.Expired++
+		default:
+			stats.Live += n.HeaderSize() + n.Size
+		}
+		if n.IsManifest() {
+			stats.Manifests++
+		}
+	}
+	return stats, iter.Err()
+}
+
+// Problem Verify 发现的一个问题
+type Problem struct {
+	ID     uint64
+	Offset uint64
+	Err    error
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("needle %d at offset %d: %v", p.ID, p.Offset, p.Err)
+}
+
+// Verify 检查 index 和 Volume 文件是否一致: index 中每个 needle 的 header 与 index 相同,
+// 未删除的 needle 正文的 checksum 正确, 文件中每个 needle 都在 index 中.
+// 上传失败留下的 needle 也会报告为 ErrNotIndexed, 它们占用的空间在 Fragment 后回收.
+// 返回检查过的 index 中的 needle 数
+func (v *Volume) Verify() (checked int, problems []Problem, err error) {
+	v.swap.RLock() // Fragment 不能在检查中途替换文件
+	defer v.swap.RUnlock()
+	latest := make(map[uint64]uint64) // 文件中每个 id 最后出现的 offset
+	err = ScanNeedles(v.File, func(n *Needle) error {
+		latest[n.ID] = n.Offset
+		return nil
+	})
+	if errors.Is(err, ErrCorruptNeedle) {
+		problems = append(problems, Problem{Err: err})
+	} else if err != nil {
+		return 0, nil, err
+	}
+	iter := v.Directory.Iter(nil)
+	for iter.Next() {
+		n := iter.Needle()
+		checked++
+		if latest[n.ID] == n.Offset {
+			delete(latest, n.ID)
+		}
+		if err := v.verifyNeedle(n); err != nil {
+			problems = append(problems, Problem{n.ID, n.Offset, err})
+		}
+	}
+	err = iter.Err()
+	iter.Release() // 下面还要读 Directory
+	if err != nil {
+		return checked, problems, err
+	}
+	var unindexed []Problem
+	for id, offset := range latest {
+		if !v.Directory.Has(id) {
+			unindexed = append(unindexed, Problem{id, offset, ErrNotIndexed})
+		}
+	}
+	sort.Slice(unindexed, func(i, j int) bool { return unindexed[i].Offset < unindexed[j].Offset })
+	return checked, append(problems, unindexed...), nil
+}
+
+// verifyNeedle 检查 index 中的 n 与文件中的 header 和正文是否一致
+func (v *Volume) verifyNeedle(n *Needle) error {
+	if n.Offset < InitIndexSize || n.Offset+n.HeaderSize()+n.Size > v.CurrentOffset {
+		return fmt.Errorf("%w: beyond the end of the volume", ErrHeaderMismatch)
+	}
+	header, err := ReadNeedleHeader(v.File, n.Offset)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrHeaderMismatch, err)
+	}
+	if header.ID != n.ID || header.Size != n.Size || header.Offset != n.Offset ||
+		header.Checksum != n.Checksum || header.Flags != n.Flags {
+		return ErrHeaderMismatch
+	}
+	if n.Deleted() {
+		return nil
+	}
+	n.File = v.File
+	h := utils.NewChecksum()
+	_, err = io.Copy(h, n.Section())
+	if err != nil {
+		return err
+	}
+	if h.Sum32() != n.Checksum {
+		return ErrWrongCheckSum
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRebuildDirectory(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	defer v.Close()
+	a, err := v.NewFile([]byte("aaa"), "a.txt")
+	assert.NoError(t, err)
+	b, err := v.NewFile([]byte("bbb"), "b.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, v.PutFile(7, []byte("old"), "c.txt", nil))
+	assert.NoError(t, v.PutFile(7, []byte("new content"), "c.txt", &FileOptions{ContentType: "text/plain"}))
+	assert.NoError(t, v.DelNeedle(b))
+
+	var scanned []uint64
+	err = ScanNeedles(v.File, func(n *Needle) error {
+		scanned = append(scanned, n.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{a, b, 7, 7}, scanned)
+
+	d, err := NewBoltDirectory(t.TempDir())
+	assert.NoError(t, err)
+	defer d.Close()
+	count, err := RebuildDirectory(v.File, d)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	for _, id := range []uint64{a, b, 7} {
+		want, err := v.Directory.Get(id)
+		assert.NoError(t, err)
+		got, err := d.Get(id)
+		assert.NoError(t, err)
+		assert.Equal(t, want.Offset, got.Offset)
+		assert.Equal(t, want.Flags, got.Flags)
+		assert.Equal(t, want.ContentType, got.ContentType)
+	}
+	n, err := d.Get(b)
+	assert.NoError(t, err)
+	assert.True(t, n.Deleted())
+}
+
+func TestScanNeedles_Corrupt(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	defer v.Close()
+	_, err = v.NewFile([]byte("aaa"), "a.txt")
+	assert.NoError(t, err)
+	id, err := v.NewFile([]byte("bbb"), "b.txt")
+	assert.NoError(t, err)
+	n, err := v.GetNeedle(id)
+	assert.NoError(t, err)
+	_, err = v.File.WriteAt(make([]byte, 8), int64(n.Offset)) // 抹掉第二个 needle 的 id
+	assert.NoError(t, err)
+
+	count := 0
+	err = ScanNeedles(v.File, func(n *Needle) error {
+		count++
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrCorruptNeedle)
+	assert.Equal(t, 1, count)
+}
+
+func TestVolume_Verify(t *testing.T) {
+	v, err := NewVolumeWithConfig(1, t.TempDir(), &VolumeConfig{TTL: time.Hour})
+	assert.NoError(t, err)
+	defer v.Close()
+	a, err := v.NewFile([]byte("aaa"), "a.txt")
+	assert.NoError(t, err)
+	b, err := v.NewFile([]byte("bbb"), "b.txt")
+	assert.NoError(t, err)
+	c, err := v.NewFile([]byte("ccc"), "c.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, v.DelNeedle(c))
+
+	checked, problems, err := v.Verify()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, checked)
+	assert.Empty(t, problems)
+
+	stats, err := v.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Needles)
+	assert.Equal(t, 1, stats.Deleted)
+	assert.Equal(t, v.CurrentOffset, stats.Used)
+	na, _ := v.GetNeedle(a)
+	assert.Equal(t, 2*(na.HeaderSize()+na.Size), stats.Live)
+	assert.Equal(t, na.HeaderSize()+na.Size, stats.Reclaimable())
+
+	// 正文损坏, needle 不在 index 中
+	_, err = v.File.WriteAt([]byte("x"), int64(na.Offset+na.HeaderSize()))
+	assert.NoError(t, err)
+	nb, _ := v.GetNeedle(b)
+	assert.NoError(t, v.Directory.Del(b))
+	checked, problems, err = v.Verify()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, checked)
+	assert.Equal(t, []Problem{{a, na.Offset, ErrWrongCheckSum}, {b, nb.Offset, ErrNotIndexed}}, problems)
+
+	// index 与 header 不一致
+	na.Size = 2
+	assert.NoError(t, v.Directory.Set(a, na))
+	_, problems, err = v.Verify()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, problems[0].Err, ErrHeaderMismatch)
+}
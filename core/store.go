@@ -2,13 +2,16 @@ package core
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"io/ioutil"
 	"github.com/hmli/simplefs/utils"
@@ -22,6 +25,30 @@ const (
 )
 
 
+// VolumeConfig 创建 Volume 时的可选配置
+type VolumeConfig struct {
+	Directory string    // Directory 后端: leveldb, bolt, pebble. 为空时使用 leveldb
+	Indexes   IndexFlag // 要维护的二级索引
+	TTL       time.Duration // 文件默认的存活时间, 0 表示永不过期
+	// DropWhenExpired 所有文件都使用 Volume 的 TTL, 全部过期后由 Reap 整个丢弃而不是逐个标记删除
+	DropWhenExpired bool
+	// SyncWrites 每次写入文件后都 fsync, 否则由操作系统或者定期调用 Sync 刷到磁盘
+	SyncWrites bool
+}
+
+// FileOptions 写入文件时的可选参数
+type FileOptions struct {
+	TTL      time.Duration // 文件的存活时间, 0 表示使用 Volume 的 TTL
+	Manifest bool          // 内容是 Manifest, 见 FlagManifest
+	// Replaceable 之后可以用同一个 id 替换, 见 FlagReplaceable
+	Replaceable bool
+	// ContentType 文件的 MIME 类型, 为空时下载时按扩展名判断
+	ContentType string
+	Parent      uint64 // 见 Needle.Parent
+	Width       uint32 // 图片的宽和高, 见 Needle.Width
+	Height      uint32
+}
+
 // TODO Compression
 // TODO Several volumes make up a Store
 type Volume struct {
@@ -31,10 +58,49 @@ type Volume struct {
 	Size          uint64
 	Path          string
 	CurrentOffset uint64 // 从文件中恢复的时候， 第一个byte就是currentoffset. 每次写入文件也要更新此offset。
+	TTL           time.Duration
+	DropWhenExpired bool
+	SyncWrites    bool // 见 VolumeConfig.SyncWrites
 	lock          sync.Mutex
+	swap          sync.RWMutex // 读 Directory 中的 offset 和 File 时持有读锁, Fragment 提交新的 offset 并替换 File 时持有写锁
+	ref           *fileRef     // File 的引用计数
+	closed        atomic.Bool // Close 之后所有操作返回 ErrClosed
+}
+
+// fileRef Volume 文件的引用计数. Volume 自己持有一个引用, GetNeedle 得到的 needle 各持有一个直到 Needle.Close.
+// Fragment 替换文件后释放 Volume 对老文件的引用, 最后一个读者 Close 时关闭老文件
+type fileRef struct {
+	file *os.File
+	refs atomic.Int64
+}
+
+func newFileRef(f *os.File) *fileRef {
+	r := &fileRef{file: f}
+	r.refs.Store(1)
+	return r
+}
+
+// acquire 增加一个引用, 返回只生效一次的释放函数
+func (r *fileRef) acquire() (release func()) {
+	r.refs.Add(1)
+	var once sync.Once
+	return func() { once.Do(r.release) }
+}
+
+func (r *fileRef) release() {
+	if r.refs.Add(-1) == 0 {
+		r.file.Close()
+	}
 }
 
 func NewVolume(id uint64, dir string) (v *Volume, err error) {
+	return NewVolumeWithConfig(id, dir, nil)
+}
+
+func NewVolumeWithConfig(id uint64, dir string, conf *VolumeConfig) (v *Volume, err error) {
+	if conf == nil {
+		conf = new(VolumeConfig)
+	}
 	if dir == "" {
 		dir = DefaultDir
 	}
@@ -45,18 +111,29 @@ func NewVolume(id uint64, dir string) (v *Volume, err error) {
 	v.Path = dir
 	v.File, err = os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
-		return nil, fmt.Errorf("Open file: ", err)
+		return nil, fmt.Errorf("Open file: %w", err)
 	}
-	v.Directory, err = NewLeveldbDirectory(dir)
+	v.Directory, err = OpenDirectory(conf.Directory, dir, conf.Indexes)
 	if err != nil {
-		return nil, fmt.Errorf("Leveldb: ", err)
+		v.File.Close()
+		return nil, fmt.Errorf("Directory: %w", err)
 	}
+	err = v.recoverFragment()
+	if err != nil {
+		v.Directory.Close()
+		v.File.Close()
+		return nil, fmt.Errorf("Recover fragment: %w", err)
+	}
+	v.ref = newFileRef(v.File)
 
 	var oldCurrentIndex []byte = make([]byte, InitIndexSize)
 	_, err = v.File.ReadAt(oldCurrentIndex, 0) // Read old current index from file
 	if err != nil && err != io.EOF{
+		v.Directory.Close()
+		v.File.Close()
 		return nil, err
 	}
+	err = nil // 新文件读不到 current index
 	oldCurrentIndexNum := binary.BigEndian.Uint64(oldCurrentIndex)
 	if oldCurrentIndexNum > InitIndexSize {
 		v.setCurrentIndex(oldCurrentIndexNum)
@@ -64,95 +141,456 @@ func NewVolume(id uint64, dir string) (v *Volume, err error) {
 		v.setCurrentIndex(InitIndexSize)
 	}
 	v.Size = MaxVolumeSize
+	v.TTL = conf.TTL
+	v.DropWhenExpired = conf.DropWhenExpired
+	v.SyncWrites = conf.SyncWrites
 	v.lock = sync.Mutex{}
 	return
 }
 
+// GetNeedle 已删除的 needle 返回 ErrDeleted, 已过期的返回 ErrExpired
 func (v *Volume) GetNeedle(id uint64) (n *Needle, err error) {
+	if v.closed.Load() {
+		return nil, ErrClosed
+	}
+	v.swap.RLock()
+	defer v.swap.RUnlock()
 	n, err = v.Directory.Get(id)
 	if err != nil {
 		return
 	}
+	if n.Deleted() {
+		return nil, ErrDeleted
+	}
+	if n.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
 	n.File = v.File
+	n.release = v.ref.acquire()
 	return
 }
 
 func (v *Volume) GetFile(id uint64) (data []byte, ext string, err error) {
-	needle, err := v.GetNeedle(id)
+	needle, data, err := v.ReadFile(id)
 	if err != nil {
-		return data, ext, fmt.Errorf("Get needle ", err)
+		return nil, "", err
 	}
-	ext = needle.FileExt
+	return data, needle.FileExt, nil
+}
+
+// ReadFile 读取文件的内容并校验 checksum
+func (v *Volume) ReadFile(id uint64) (needle *Needle, data []byte, err error) {
+	needle, err = v.GetNeedle(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Get needle: %w", err)
+	}
+	defer needle.Close()
 	data, err = ioutil.ReadAll(needle)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 	checksum := utils.Checksum(data)
 	if checksum != needle.Checksum {
-		return nil, "", ErrWrongCheckSum
+		return nil, nil, ErrWrongCheckSum
 	}
 	return
 }
 
 
 func (v *Volume) DelNeedle(id uint64) (err error) {
+	return v.DelNeedles(id)
+}
+
+// DelNeedles 原子地给多个 needle 打上删除标记, 任何一个不存在则都不删除.
+// 空间在下次 Fragment 时回收.
+func (v *Volume) DelNeedles(ids ...uint64) (err error) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
-	_, err = v.GetNeedle(id)
-	if err != nil && err != ErrDeleted{
-		return err
+	if v.closed.Load() {
+		return ErrClosed
+	}
+	b := NewBatch()
+	var deleted []*Needle
+	marked := make(map[uint64]bool) // 重复的 id 只标记一次, 否则第二次的检查会失败
+	for _, id := range ids {
+		n, err := v.Directory.Get(id)
+		if err != nil {
+			return err
+		}
+		if n.Deleted() || marked[id] {
+			continue
+		}
+		marked[id] = true
+		deleted = append(deleted, markDeleted(b, n))
+	}
+	err = v.Directory.Write(b)
+	if err != nil {
+		return
+	}
+	v.writeFlags(deleted...)
+	return
+}
+
+// DelFiles 批量删除, 和 DelNeedles 不同, 某个 id 不存在时只在 errs 中返回它的错误, 其余的 id 在一个 Batch 中删除.
+// 已经删除的 id 视为删除成功. 写 Directory 失败时返回 err, 所有 id 都不会被删除.
+func (v *Volume) DelFiles(ids []uint64) (errs []error, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed.Load() {
+		return nil, ErrClosed
+	}
+	errs = make([]error, len(ids))
+	b := NewBatch()
+	var deleted []*Needle
+	marked := make(map[uint64]bool) // 同 DelNeedles
+	for i, id := range ids {
+		n, err := v.Directory.Get(id)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if n.Deleted() || marked[id] {
+			continue
+		}
+		marked[id] = true
+		deleted = append(deleted, markDeleted(b, n))
+	}
+	err = v.Directory.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	v.writeFlags(deleted...)
+	return
+}
+
+// markDeleted 在 b 中把 n 标记为删除, 返回标记后的 needle
+func markDeleted(b *Batch, n *Needle) *Needle {
+	d := *n
+	d.Flags |= FlagDeleted
+	b.CompareAndSet(n.ID, n, &d)
+	return &d
+}
+
+// writeFlags 把 needle 的 flags 同步到 Volume 文件的 header 中
+func (v *Volume) writeFlags(needles ...*Needle) {
+	for _, n := range needles {
+		v.File.WriteAt([]byte{n.Flags}, int64(n.Offset+needleFlagsOffset))
 	}
-	return v.Directory.Del(id)
 }
 
 // NewNeedle allocate a new needle.
 func (v *Volume) NewNeedle(id uint64, data []byte, filename string) (n *Needle, err error) {
-	size := uint64(len(data))
+	return v.newNeedle(id, data, filename, nil, v.Directory.New)
+}
+
+// newNeedle 分配空间并写入 header 和 data, 写完后才用 commit 把 needle 写入 Directory,
+// 读者不会通过 Directory 读到还没写完的内容
+func (v *Volume) newNeedle(id uint64, data []byte, filename string, opt *FileOptions, commit func(n *Needle) error) (n *Needle, err error) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
-	// 1. alloc space
-	// 2. set needle's header
-	// 3. make needle
-	ext := Ext(filename)
-	offset, err := v.allocSpace(size, uint64(len(ext)))
+	if v.closed.Load() {
+		return nil, ErrClosed
+	}
+	n, err = v.allocNeedle(id, uint64(len(data)), utils.Checksum(data), filename, opt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = v.File.WriteAt(data, int64(n.Offset+n.HeaderSize()))
+	if err == nil {
+		err = v.syncWrites()
+	}
 	if err != nil {
 		return nil, err
 	}
+	err = commit(n)
+	if err != nil {
+		err = fmt.Errorf("Directory: %w", err)
+	}
+	return n, err
+}
+
+// commitNew 把用生成的 id 新写入的 n 加到 Directory 中. id 已被占用 (比如被 PUT 指定过) 时
+// 换一个 id 重写 header 后再试, 不会覆盖已有的 needle. 调用者需要持有 v.lock
+func (v *Volume) commitNew(n *Needle) (err error) {
+	for {
+		b := NewBatch()
+		b.CompareAndSet(n.ID, nil, n)
+		err = v.Directory.Write(b)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		err = v.renumber(n)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// renumber 给还没有加到 Directory 的 n 换一个新的 id, 并重写文件中的 header
+func (v *Volume) renumber(n *Needle) (err error) {
+	n.ID = utils.UniqueId()
+	err = v.writeHeader(n)
+	if err == nil {
+		err = v.syncWrites()
+	}
+	return
+}
+
+// fileTTL 按 opt 和 Volume 的配置算出文件的 TTL
+func (v *Volume) fileTTL(opt *FileOptions) (ttl time.Duration, err error) {
+	if opt == nil || opt.TTL == 0 {
+		return v.TTL, nil
+	}
+	if v.DropWhenExpired && opt.TTL != v.TTL {
+		return 0, ErrTTLMismatch
+	}
+	return opt.TTL, nil
+}
+
+// allocNeedle 分配空间并写入 needle 的 header, 不写 Directory. 调用者需要持有 v.lock
+func (v *Volume) allocNeedle(id uint64, size uint64, checksum uint32, filename string, opt *FileOptions) (n *Needle, err error) {
+	ttl, err := v.fileTTL(opt)
+	if err != nil {
+		return nil, err
+	}
+	// 1. alloc space
+	// 2. set needle's header
+	// 3. make needle
 	n = new(Needle)
 	n.ID = id
 	n.Size = size
-	n.Offset = offset
-	n.Checksum = utils.Checksum(data)
+	n.FileExt = Ext(filename)
+	n.Filename = filename
+	n.Checksum = checksum
 	now := time.Now()
 	n.CreatedAt = now
 	n.UpdatedAt = now
+	if ttl > 0 {
+		n.ExpiresAt = now.Add(ttl)
+	}
+	if opt != nil {
+		if opt.Manifest {
+			n.Flags |= FlagManifest
+		}
+		if opt.Replaceable {
+			n.Flags |= FlagReplaceable
+		}
+		n.ContentType = opt.ContentType
+		n.Parent = opt.Parent
+		n.Width = opt.Width
+		n.Height = opt.Height
+	}
 	n.File = v.File
-	n.FileExt = ext
+	_, err = NeedleMarshal(n) // 先检查 header 能否写入, 以免浪费空间
+	if err != nil {
+		return nil, err
+	}
+	n.Offset, err = v.allocSpace(n.HeaderSize() + n.Size)
+	if err != nil {
+		return nil, err
+	}
+	err = v.writeHeader(n)
+	return
+}
+
+// writeHeader 把 needle 的 header 写到 Volume 文件中
+func (v *Volume) writeHeader(n *Needle) (err error) {
 	needleData, err := NeedleMarshal(n)
 	if err != nil {
 		return
 	}
-	v.File.WriteAt(needleData, int64(n.Offset))
-	err = v.Directory.New(n)
+	_, err = v.File.WriteAt(needleData, int64(n.Offset))
+	return
+}
+
+// NewFileFromReader 从 r 读取 size 字节作为文件内容, 不需要把整个文件放在内存中.
+// r 中的数据不足 size 时返回 io.ErrUnexpectedEOF, 已分配的空间不会回收.
+func (v *Volume) NewFileFromReader(r io.Reader, size uint64, filename string, opt *FileOptions) (id uint64, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed.Load() {
+		return 0, ErrClosed
+	}
+	n, err := v.allocNeedle(utils.UniqueId(), size, 0, filename, opt)
 	if err != nil {
-		err = fmt.Errorf("Leveldb: ", err)
+		return 0, err
 	}
-	return n, err
+	h := utils.NewChecksum()
+	w := io.NewOffsetWriter(v.File, int64(n.Offset+n.HeaderSize()))
+	written, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(r, int64(size)))
+	if err != nil {
+		return 0, err
+	}
+	if uint64(written) < size {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n.Checksum = h.Sum32()
+	err = v.writeHeader(n)
+	if err == nil {
+		err = v.syncWrites()
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = v.commitNew(n)
+	if err != nil {
+		return 0, fmt.Errorf("Directory: %w", err)
+	}
+	return n.ID, nil
+}
+
+// File NewFiles 的一个文件
+type File struct {
+	Name        string
+	Data        []byte
+	ContentType string // 不为空时替换 NewFiles 的 opt 中的 ContentType
+	Width       uint32 // 不为 0 时替换 NewFiles 的 opt 中的 Width 和 Height
+	Height      uint32
+}
+
+// FileResult NewFiles 中一个文件的结果, Err 不为 nil 时 Needle 为 nil
+type FileResult struct {
+	Needle *Needle
+	Err    error
+}
+
+// NewFiles 一次写入多个文件, 所有文件的内容写完后在一个 Batch 中提交到 Directory.
+// 单个文件出错 (比如空间不足) 不影响其它文件, 提交 Directory 失败时返回 err, 所有文件都不会生效.
+func (v *Volume) NewFiles(files []File, opt *FileOptions) (results []FileResult, err error) {
+	_, err = v.fileTTL(opt)
+	if err != nil {
+		return nil, err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed.Load() {
+		return nil, ErrClosed
+	}
+	results = make([]FileResult, len(files))
+	for i, f := range files {
+		fopt := opt
+		if f.ContentType != "" || f.Width != 0 {
+			fopt = &FileOptions{}
+			if opt != nil {
+				*fopt = *opt
+			}
+			if f.ContentType != "" {
+				fopt.ContentType = f.ContentType
+			}
+			if f.Width != 0 {
+				fopt.Width, fopt.Height = f.Width, f.Height
+			}
+		}
+		n, err := v.allocNeedle(utils.UniqueId(), uint64(len(f.Data)), utils.Checksum(f.Data), f.Name, fopt)
+		if err == nil {
+			_, err = v.File.WriteAt(f.Data, int64(n.Offset+n.HeaderSize()))
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Needle = n
+	}
+	err = v.syncWrites()
+	if err != nil {
+		return nil, err
+	}
+	// 同 commitNew, 有 id 被占用时给这些 needle 换 id 后重新提交
+	for {
+		b := NewBatch()
+		for _, r := range results {
+			if r.Needle != nil {
+				b.CompareAndSet(r.Needle.ID, nil, r.Needle)
+			}
+		}
+		err = v.Directory.Write(b)
+		if !errors.Is(err, ErrConflict) {
+			break
+		}
+		for _, r := range results {
+			if r.Needle != nil && v.Directory.Has(r.Needle.ID) {
+				if err = v.renumber(r.Needle); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Directory: %w", err)
+	}
+	return
 }
 
 func (v *Volume) NewFile(data []byte, filename string) (id uint64, err error) {
-	id = utils.UniqueId()
-	//needle, err := v.NewNeedle(id, uint64(len(data)), filename)
-	needle, err := v.NewNeedle(id, data, filename)
+	return v.NewFileWithOptions(data, filename, nil)
+}
 
+// NewFileWithOptions 用生成的 id 写入文件, 返回最终使用的 id, 见 commitNew
+func (v *Volume) NewFileWithOptions(data []byte, filename string, opt *FileOptions) (id uint64, err error) {
+	n, err := v.newNeedle(utils.UniqueId(), data, filename, opt, v.commitNew)
 	if err != nil {
-		return id, fmt.Errorf("New needle : ", err)
+		return 0, fmt.Errorf("New needle: %w", err)
 	}
-	_, err = needle.Write(data)
+	return n.ID, nil
+}
+
+// PutFile 以指定的 id 写入文件, id 已存在时替换掉原来的文件
+func (v *Volume) PutFile(id uint64, data []byte, filename string, opt *FileOptions) (err error) {
+	return v.putFile(id, data, filename, opt, v.Directory.New)
+}
+
+// CompareAndPutFile 同 PutFile, 但只有 id 当前的 needle 与 old 相同时才写入, 否则返回 ErrConflict.
+// old 为 nil 表示 id 必须不存在. 检查和写入在同一个 Batch 中完成
+func (v *Volume) CompareAndPutFile(id uint64, old *Needle, data []byte, filename string, opt *FileOptions) (err error) {
+	return v.putFile(id, data, filename, opt, func(n *Needle) error {
+		b := NewBatch()
+		b.CompareAndSet(id, old, n)
+		return v.Directory.Write(b)
+	})
+}
+
+func (v *Volume) putFile(id uint64, data []byte, filename string, opt *FileOptions, commit func(n *Needle) error) (err error) {
+	_, err = v.newNeedle(id, data, filename, opt, commit)
 	if err != nil {
-		return
+		return fmt.Errorf("New needle: %w", err)
 	}
-	return id, err
+	return nil
+}
+
+// syncWrites 开启了 SyncWrites 时把写入的数据刷到磁盘
+func (v *Volume) syncWrites() (err error) {
+	if !v.SyncWrites {
+		return nil
+	}
+	return v.File.Sync()
+}
+
+// Sync 把 Volume 文件刷到磁盘
+func (v *Volume) Sync() (err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed.Load() {
+		return ErrClosed
+	}
+	return v.File.Sync()
+}
+
+// Close 把文件刷到磁盘后关闭文件和 Directory, 之后对 Volume 的所有操作都返回 ErrClosed.
+// 调用者需要先停止所有的读写
+func (v *Volume) Close() (err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed.Swap(true) {
+		return ErrClosed
+	}
+	err = v.File.Sync()
+	if e := v.File.Close(); err == nil {
+		err = e
+	}
+	if e := v.Directory.Close(); err == nil {
+		err = e
+	}
+	return
 }
 
 func (v *Volume) currentOffset() (offset uint64, err error) {
@@ -165,14 +603,14 @@ func (v *Volume) currentOffset() (offset uint64, err error) {
 	return
 }
 
-func (v *Volume) allocSpace(filesize uint64, extsize uint64) (offset uint64, err error) {
+// allocSpace 分配 totalSize (header + body) 大小的空间
+func (v *Volume) allocSpace(totalSize uint64) (offset uint64, err error) {
 	remainingSize := v.RemainingSpace()
-	totalSize := filesize + HeaderSize(extsize)
 	if remainingSize < totalSize {
 		return v.CurrentOffset, ErrLeakSpace
 	}
 	offset = v.CurrentOffset
-	v.setCurrentIndex( v.CurrentOffset + HeaderSize(extsize) + filesize)
+	v.setCurrentIndex(v.CurrentOffset + totalSize)
 	return
 }
 
@@ -188,106 +626,222 @@ func (v *Volume) RemainingSpace() (size uint64) {
 	return v.Size - v.CurrentOffset
 }
 
+// Fragment 把所有未删除, 未过期的 needle 紧凑地复制到新文件, 再替换掉老文件.
+// 所有 offset 的修改在一个 Batch 里提交, 要么全部生效, 要么都不生效.
+// 提交 offset 和替换文件之间中断时, 下次打开 Volume 由 recoverFragment 完成替换
 func (v *Volume) Fragment() (err error) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
-	newFilePath := v.File.Name() + ".temp" // filepath.Join(v.Path, strconv.FormatUint(v.ID, 10)+".temp")
-	newFile, err := os.OpenFile(newFilePath, os.O_CREATE|os.O_RDWR, 0666)
+	if v.closed.Load() {
+		return ErrClosed
+	}
+	fullpath := v.dataPath()
+	marker := fragmentMarker(fullpath)
+	if _, err = os.Stat(marker); err == nil {
+		return fmt.Errorf("unfinished fragment, reopen the volume to finish it")
+	}
+	newFilePath := fullpath + ".temp"
+	newFile, err := os.OpenFile(newFilePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	if err != nil {
-		return  fmt.Errorf("Open file: ", err)
+		return fmt.Errorf("Open file: %w", err)
+	}
+	abort := func(err error) error {
+		newFile.Close()
+		os.Remove(newFilePath)
+		return err
 	}
-	iter := v.Directory.Iter()
-	var key []byte = make([]byte, 8)
-	var exists bool = true
+	batch, undo := NewBatch(), NewBatch()
 	var currentOffset int64 = int64(InitIndexSize)
-	for exists {
-		key, exists = iter.Next()
-		if !exists {
-			break
-		}
-		id := binary.BigEndian.Uint64(key)
-		needle, err := v.GetNeedle(id) // 读取一个needle
-		if err != nil {
-			fmt.Println("Read needle err: ", err)
-			continue
-		}
+	now := time.Now()
+	drop := func(needle *Needle) { // 不再复制, 从 Directory 中去掉
+		batch.CompareAndSet(needle.ID, needle, nil)
+		undo.CompareAndSet(needle.ID, nil, needle)
+	}
+	move := func(needle *Needle) error {
 		offset := int64(needle.Offset)
-		size := int64(needle.Size) + int64(HeaderSize(uint64(len(needle.FileExt))))
+		size := int64(needle.Size) + int64(needle.HeaderSize())
 		var needleData []byte = make([]byte, size)
-		v.File.ReadAt(needleData, offset)
+		_, err := v.File.ReadAt(needleData, offset)
+		if err != nil {
+			return fmt.Errorf("Read needle %d: %w", needle.ID, err)
+		}
+		moved := *needle
+		moved.Offset = uint64(currentOffset)
+		binary.BigEndian.PutUint64(needleData[16:24], moved.Offset) // header 中的 offset
 		_, err = newFile.WriteAt(needleData, currentOffset) // 修改 offset， 并写到新文件中
-		fmt.Println("Write: ", currentOffset, needleData)
 		if err != nil {
-			fmt.Println("Write err: ",err)
-			continue
+			return fmt.Errorf("Write needle %d: %w", needle.ID, err)
 		}
-		fmt.Println("Current offset: ", currentOffset)
-		needle.Offset = uint64(currentOffset)
-		v.Directory.Set(needle.ID, needle) // 更新 needle
+		batch.CompareAndSet(needle.ID, needle, &moved)
+		undo.CompareAndSet(needle.ID, &moved, needle)
 		currentOffset += size
+		return nil
+	}
+	// 生成的 needle 要查 Parent 是否还在, 等迭代器释放后再处理, 不在迭代的同时读 Directory
+	var derived []*Needle
+	iter := v.Directory.Iter(nil)
+	for iter.Next() {
+		needle := iter.Needle() // 读取一个needle
+		switch {
+		case needle.Deleted() || needle.Expired(now):
+			drop(needle)
+		case needle.Parent != 0:
+			derived = append(derived, needle)
+		default:
+			err = move(needle)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if e := iter.Err(); err == nil && e != nil {
+		err = fmt.Errorf("Iter: %w", e)
+	}
+	iter.Release()
+	if err != nil {
+		return abort(err)
+	}
+	for _, needle := range derived {
+		if v.orphan(needle, now) {
+			drop(needle)
+		} else if err = move(needle); err != nil {
+			return abort(err)
+		}
 	}
 	var currentOffsetByte = make([]byte, InitIndexSize)
 	binary.BigEndian.PutUint64(currentOffsetByte, uint64(currentOffset))
-	newFile.WriteAt(currentOffsetByte, 0)
-	v.setCurrentIndex(uint64(currentOffset))
-	fullpath:= v.File.Name()
-	// 给老文件改名
-	delpath := fullpath + ".del"
-	fmt.Println("Old change name: ", fullpath, delpath)
-	delFile , err := os.OpenFile(delpath, os.O_CREATE|os.O_RDWR, 0666)
+	_, err = newFile.WriteAt(currentOffsetByte, 0)
+	if err == nil {
+		err = newFile.Sync()
+	}
 	if err != nil {
-		return
+		return abort(err)
 	}
-	if delFile != nil {
-		defer delFile.Close()
+	// 新文件已经完整写入, 有了标记文件之后中断时 recoverFragment 用它完成替换
+	err = writeMarker(marker)
+	if err != nil {
+		return abort(err)
 	}
-	err = os.Rename(fullpath, delpath)
+	// 新的 offset 和新文件要同时生效, 否则读者可能拿新的 offset 读老文件
+	v.swap.Lock()
+	defer v.swap.Unlock()
+	err = v.Directory.Write(batch) // 更新所有 needle 的 offset
 	if err != nil {
-		return
+		os.Remove(marker)
+		return abort(fmt.Errorf("Directory: %w", err))
 	}
 	err = os.Rename(newFilePath, fullpath)
 	if err != nil {
-		os.Rename(delpath, fullpath) // 出错， 把已经改掉的老文件的名字改回去
+		if e := v.Directory.Write(undo); e != nil { // 出错， 把 offset 改回去
+			// 改不回去时 Directory 已经指向新文件, 继续使用它, 保留标记文件, 下次打开时完成替换
+			v.swapFile(newFile, uint64(currentOffset))
+			return fmt.Errorf("Rename: %w, undo Directory: %v", err, e)
+		}
+		os.Remove(marker)
+		return abort(err)
+	}
+	v.swapFile(newFile, uint64(currentOffset))
+	os.Remove(marker) // 删除失败时下次打开会按文件重建 index, 结果是一样的
+	return
+}
+
+// swapFile 把 Volume 文件换成 f, 老文件在 GetNeedle 得到的 needle 都 Close 之后关闭. 调用者需要持有 v.swap 的写锁
+func (v *Volume) swapFile(f *os.File, currentOffset uint64) {
+	old := v.ref
+	v.File = f
+	v.ref = newFileRef(f)
+	v.CurrentOffset = currentOffset
+	old.release()
+}
+
+// dataPath Volume 文件的路径
+func (v *Volume) dataPath() string {
+	return filepath.Join(v.Path, strconv.FormatUint(v.ID, 10)+".data")
+}
+
+// fragmentMarker Fragment 正在替换 Volume 文件时存在的标记文件
+func fragmentMarker(path string) string {
+	return path + ".fragment"
+}
+
+// writeMarker 创建标记文件并刷到磁盘
+func writeMarker(path string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
 		return
 	}
-	v.File = newFile
-	v.Path = newFilePath
-	fmt.Println("New change name: ", delpath, fullpath)
-	err = os.Remove(delpath)
-	fmt.Println("Deleted: ", delpath)
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
 	return
 }
 
+// recoverFragment 完成上次中断的 Fragment: 有标记文件时新文件已经完整写入, 但 Directory 中的 offset
+// 可能是新的也可能是老的. 把新文件换到原来的位置, 再按文件中的 header 重置 Directory
+func (v *Volume) recoverFragment() (err error) {
+	fullpath := v.dataPath()
+	marker := fragmentMarker(fullpath)
+	_, err = os.Stat(marker)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	newFilePath := fullpath + ".temp"
+	_, err = os.Stat(newFilePath)
+	if err == nil {
+		err = os.Rename(newFilePath, fullpath)
+		if err != nil {
+			return
+		}
+		var f *os.File
+		f, err = os.OpenFile(fullpath, os.O_RDWR, 0666)
+		if err != nil {
+			return
+		}
+		v.File.Close()
+		v.File = f
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	err = resetDirectory(v.File, v.Directory)
+	if err != nil {
+		return
+	}
+	return os.Remove(marker)
+}
 
+// orphan n 是生成的 needle, 并且 Parent 已经不存在, 或者在 n 生成之后被替换过
+func (v *Volume) orphan(n *Needle, now time.Time) bool {
+	if n.Parent == 0 {
+		return false
+	}
+	parent, err := v.Directory.Get(n.Parent)
+	return err != nil || parent.Deleted() || parent.Expired(now) || n.CreatedAt.Before(parent.UpdatedAt)
+}
+
+// Print 把所有 needle 的 id, offset 和内容写到日志中, 调试用
 func (v *Volume) Print() {
-	iter := v.Directory.Iter()
-	var hasNext bool = true
-	for hasNext {
-		var key []byte
-		key, hasNext = iter.Next()
-		if hasNext {
-			id := binary.BigEndian.Uint64(key)
-			n, err := v.GetNeedle(id)
-			if err != nil && err != ErrDeleted  {
-				fmt.Println("Err: ", err)
-			}
-			fmt.Printf("id: %d, offset: %d \n", id, n.Offset)
-			var b []byte = make([]byte, n.Size)
-			dataOffset := n.Offset + HeaderSize(uint64(len(n.FileExt)))
-			v.File.ReadAt(b, int64(dataOffset))
-			fmt.Println("data: ", n.FileExt, string(b))
-		} else {
-			fmt.Println("-------- Finish-------")
-		}
+	iter := v.Directory.Iter(nil)
+	defer iter.Release()
+	for iter.Next() {
+		n := iter.Needle()
+		var b []byte = make([]byte, n.Size)
+		dataOffset := n.Offset + n.HeaderSize()
+		v.File.ReadAt(b, int64(dataOffset))
+		log.Printf("id: %d, offset: %d, data: %s %s", n.ID, n.Offset, n.FileExt, b)
+	}
+	if err := iter.Err(); err != nil {
+		log.Println("Err: ", err)
 	}
-	iter.Release()
 }
 
 func (v *Volume) CheckCurrentIndex() (same bool) {
 	i1 := v.CurrentOffset
 	b := make([]byte, InitIndexSize)
 	v.File.ReadAt(b, 0)
-	fmt.Println(b)
 	i2 := binary.BigEndian.Uint64(b)
 	return i1 == i2
 }
@@ -295,13 +849,12 @@ func (v *Volume) CheckCurrentIndex() (same bool) {
 func (v *Volume) ReadHeader(offset int64) (header []byte, err error) {
 	var b []byte = make([]byte, NeedleFixSize)
 	v.File.ReadAt(b, offset)
-	fmt.Println(b)
-	n, err := NeedleUnmarshal(b)
+	size, err := needleHeaderSize(b)
 	if err != nil {
 		return
 	}
-	header = make([]byte, len(b) + len(n.FileExt))
-	v.File.ReadAt(header[:len(b)], offset)
+	header = make([]byte, size)
+	copy(header, b)
 	v.File.ReadAt(header[len(b):], offset + int64(len(b)))
 	return
 }
@@ -309,7 +862,6 @@ func (v *Volume) ReadHeader(offset int64) (header []byte, err error) {
 // 从完整文件名中获取扩展名
 func Ext(filename string) (ext string) {
 	index := strings.LastIndex(filename, ".")
-	fmt.Println(index)
 	if index == -1 {
 		return ""
 	}
@@ -1,8 +1,14 @@
 package core
 
 import (
+	"github.com/hmli/simplefs/utils"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewVolume(t *testing.T) {
@@ -47,9 +53,7 @@ func TestVolume_Fragment(t *testing.T) {
 	id4, err := v.NewFile([]byte("aaa"), "a3")
 	assert.NoError(t, err)
 	t.Log(id, id2, id3, id4)
-	v.Print()
 	v.DelNeedle(id)
-	v.Print()
 	fl, _ := v.File.Stat()
 	sizeOld := fl.Size()
 	err = v.Fragment()
@@ -57,10 +61,9 @@ func TestVolume_Fragment(t *testing.T) {
 		t.Log(err)
 	}
 	assert.NoError(t, err)
-	v.Print()
 	fl, _ = v.File.Stat()
 	sizeNew := fl.Size()
-	assert.Equal(t, sizeOld-sizeNew, int64(3 + NeedleFixSize))
+	assert.Equal(t, sizeOld-sizeNew, int64(3 + NeedleFixSize + uint64(len("f0"))))
 	t.Log(sizeOld, sizeNew)
 }
 
@@ -71,4 +74,292 @@ func TestVolume_PrintFile(t *testing.T) {
 	header, err := v.ReadHeader(8)
 	assert.NoError(t, err)
 	t.Log(header, len(header))
-}
\ No newline at end of file
+}
+
+func TestVolume_DelNeedles(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	id1, err := v.NewFile([]byte("aaa"), "a")
+	assert.NoError(t, err)
+	id2, err := v.NewFile([]byte("bbb"), "b")
+	assert.NoError(t, err)
+	err = v.DelNeedles(id1, id2+100) // id2+100 不存在, 都不删除
+	assert.Equal(t, ErrNeedleNotFound, err)
+	_, err = v.GetNeedle(id1)
+	assert.NoError(t, err)
+	err = v.DelNeedles(id1, id2)
+	assert.NoError(t, err)
+	_, err = v.GetNeedle(id1)
+	assert.Equal(t, ErrDeleted, err)
+	_, err = v.GetNeedle(id2)
+	assert.Equal(t, ErrDeleted, err)
+	header, err := v.ReadHeader(int64(InitIndexSize))
+	assert.NoError(t, err)
+	n, err := NeedleUnmarshal(header)
+	assert.NoError(t, err)
+	assert.True(t, n.Deleted())
+}
+
+func TestVolume_FragmentKeepsData(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	id1, err := v.NewFile([]byte("first"), "1.txt")
+	assert.NoError(t, err)
+	id2, err := v.NewFile([]byte("second"), "2.txt")
+	assert.NoError(t, err)
+	err = v.DelNeedle(id1)
+	assert.NoError(t, err)
+	err = v.Fragment()
+	assert.NoError(t, err)
+	data, ext, err := v.GetFile(id2)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	assert.Equal(t, "txt", ext)
+	n, err := v.GetNeedle(id2)
+	assert.NoError(t, err)
+	assert.Equal(t, InitIndexSize, n.Offset)
+	assert.True(t, v.CheckCurrentIndex())
+	n.Close()
+
+	// Fragment 之前得到的 needle 仍然从老文件读, 所有读者 Close 之后老文件才关闭
+	id3, err := v.NewFile([]byte("third"), "3.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, v.DelNeedle(id2))
+	n, err = v.GetNeedle(id3)
+	assert.NoError(t, err)
+	assert.NoError(t, v.Fragment())
+	data, err = io.ReadAll(n.Section())
+	assert.NoError(t, err)
+	assert.Equal(t, "third", string(data))
+	old := n.File
+	n.Close()
+	_, err = old.Stat()
+	assert.ErrorIs(t, err, os.ErrClosed)
+	_, err = v.File.Stat()
+	assert.NoError(t, err)
+}
+
+// Fragment 提交了新的 offset, 还没有替换文件时中断, 打开时用新文件完成替换
+func TestVolume_RecoverFragment(t *testing.T) {
+	dir := t.TempDir()
+	v, err := NewVolume(1, dir)
+	assert.NoError(t, err)
+	id1, err := v.NewFile([]byte("first"), "1.txt")
+	assert.NoError(t, err)
+	id2, err := v.NewFile([]byte("second"), "2.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, v.DelNeedle(id1))
+	path := v.dataPath()
+	before, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, v.Fragment())
+	assert.NoError(t, v.Close())
+	// 还原成中断时的样子: 新文件在 .temp, 原来的位置还是老文件
+	assert.NoError(t, os.Rename(path, path+".temp"))
+	assert.NoError(t, os.WriteFile(path, before, 0666))
+	assert.NoError(t, writeMarker(fragmentMarker(path)))
+
+	v, err = NewVolume(1, dir)
+	assert.NoError(t, err)
+	defer v.Close()
+	_, data, err := v.ReadFile(id2)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	assert.False(t, v.Directory.Has(id1))
+	_, err = os.Stat(fragmentMarker(path))
+	assert.True(t, os.IsNotExist(err))
+	_, problems, err := v.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestVolume_NewFiles(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	files := []File{
+		{Name: "a.txt", Data: []byte("aaa")},
+		{Name: strings.Repeat("x", math.MaxUint16+1), Data: []byte("long")},
+		{Name: "b.png", Data: []byte("bb")},
+	}
+	results, err := v.NewFiles(files, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	assert.ErrorIs(t, results[1].Err, ErrLongName)
+	assert.Nil(t, results[1].Needle)
+	for _, i := range []int{0, 2} {
+		assert.NoError(t, results[i].Err)
+		data, ext, err := v.GetFile(results[i].Needle.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, files[i].Data, data)
+		assert.Equal(t, Ext(files[i].Name), ext)
+	}
+	assert.True(t, results[0].Needle.ID < results[2].Needle.ID)
+	assert.True(t, v.CheckCurrentIndex())
+}
+
+func TestVolume_DelFiles(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	id1, err := v.NewFile([]byte("1"), "1.txt")
+	assert.NoError(t, err)
+	id2, err := v.NewFile([]byte("2"), "2.txt")
+	assert.NoError(t, err)
+	err = v.DelNeedle(id2)
+	assert.NoError(t, err)
+	errs, err := v.DelFiles([]uint64{id1, 404, id2, id1}) // 重复的 id 只删一次
+	assert.NoError(t, err)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], ErrNeedleNotFound)
+	assert.NoError(t, errs[2])
+	assert.NoError(t, errs[3])
+	_, err = v.GetNeedle(id1)
+	assert.ErrorIs(t, err, ErrDeleted)
+}
+
+func TestVolume_NewFileFromReader(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	id, err := v.NewFileFromReader(strings.NewReader("streamed data"), 13, "s.txt", nil)
+	assert.NoError(t, err)
+	data, ext, err := v.GetFile(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "streamed data", string(data))
+	assert.Equal(t, "txt", ext)
+
+	_, err = v.NewFileFromReader(strings.NewReader("short"), 10, "s.txt", nil)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestVolume_NewFiles_ContentType(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	results, err := v.NewFiles([]File{
+		{Name: "a", Data: []byte("a"), ContentType: "text/csv"},
+		{Name: "b", Data: []byte("b")},
+		{Name: "c", Data: []byte("c"), Width: 640, Height: 480},
+	}, &FileOptions{ContentType: "text/plain"})
+	assert.NoError(t, err)
+	assert.Equal(t, "text/csv", results[0].Needle.ContentType)
+	n, err := v.GetNeedle(results[1].Needle.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", n.ContentType)
+	n, err = v.GetNeedle(results[2].Needle.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", n.ContentType)
+	assert.Equal(t, uint32(640), n.Width)
+	assert.Equal(t, uint32(480), n.Height)
+}
+
+func TestVolume_FragmentDropsOrphans(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	parent, err := v.NewFile([]byte("original"), "a.png")
+	assert.NoError(t, err)
+	err = v.PutFile(100, []byte("thumb"), "a.png", &FileOptions{Parent: parent})
+	assert.NoError(t, err)
+	n, err := v.GetNeedle(100)
+	assert.NoError(t, err)
+	assert.Equal(t, parent, n.Parent)
+
+	err = v.Fragment()
+	assert.NoError(t, err)
+	_, err = v.GetNeedle(100)
+	assert.NoError(t, err)
+
+	err = v.DelNeedle(parent)
+	assert.NoError(t, err)
+	err = v.Fragment()
+	assert.NoError(t, err)
+	_, err = v.GetNeedle(100)
+	assert.ErrorIs(t, err, ErrNeedleNotFound)
+	assert.Equal(t, InitIndexSize, v.CurrentOffset)
+
+	// Parent 在生成之后被替换的也回收
+	parent, err = v.NewFile([]byte("original"), "a.png")
+	assert.NoError(t, err)
+	assert.NoError(t, v.PutFile(100, []byte("thumb"), "a.png", &FileOptions{Parent: parent}))
+	p, err := v.Directory.Get(parent)
+	assert.NoError(t, err)
+	p.UpdatedAt = p.UpdatedAt.Add(time.Second)
+	b := NewBatch()
+	b.Put(p)
+	assert.NoError(t, v.Directory.Write(b))
+	assert.NoError(t, v.Fragment())
+	_, err = v.GetNeedle(100)
+	assert.ErrorIs(t, err, ErrNeedleNotFound)
+	_, err = v.GetNeedle(parent)
+	assert.NoError(t, err)
+}
+
+func TestVolume_CompareAndPutFile(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	defer v.Close()
+	assert.NoError(t, v.CompareAndPutFile(100, nil, []byte("first"), "a.txt", nil))
+	assert.ErrorIs(t, v.CompareAndPutFile(100, nil, []byte("second"), "a.txt", nil), ErrConflict)
+	old, err := v.Directory.Get(100)
+	assert.NoError(t, err)
+	assert.NoError(t, v.CompareAndPutFile(100, old, []byte("second"), "a.txt", nil))
+	assert.ErrorIs(t, v.CompareAndPutFile(100, old, []byte("third"), "a.txt", nil), ErrConflict)
+	_, data, err := v.ReadFile(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+}
+
+// 生成的 id 已经被 PUT 占用时换一个 id, 不覆盖原来的文件
+func TestVolume_CommitNewTakenID(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	defer v.Close()
+	id := utils.UniqueId()
+	assert.NoError(t, v.PutFile(id, []byte("put"), "put.txt", nil))
+
+	data := []byte("new")
+	v.lock.Lock()
+	n, err := v.allocNeedle(id, uint64(len(data)), utils.Checksum(data), "new.txt", nil)
+	assert.NoError(t, err)
+	_, err = v.File.WriteAt(data, int64(n.Offset+n.HeaderSize()))
+	assert.NoError(t, err)
+	assert.NoError(t, v.commitNew(n))
+	v.lock.Unlock()
+	assert.NotEqual(t, id, n.ID)
+
+	_, read, err := v.ReadFile(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "put", string(read))
+	_, read, err = v.ReadFile(n.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(read))
+	_, problems, err := v.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestVolume_Close(t *testing.T) {
+	dir := t.TempDir()
+	v, err := NewVolume(1, dir)
+	assert.NoError(t, err)
+	id, err := v.NewFile([]byte("data"), "a.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, v.Close())
+	assert.Equal(t, ErrClosed, v.Close())
+
+	_, err = v.GetNeedle(id)
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = v.NewFile([]byte("data"), "b.txt")
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, v.DelNeedle(id), ErrClosed)
+	_, err = v.NewFiles([]File{{Name: "c", Data: []byte("c")}}, nil)
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, v.Fragment(), ErrClosed)
+	_, err = v.Reap()
+	assert.ErrorIs(t, err, ErrClosed)
+
+	// 关闭后可以重新打开, 数据还在
+	v, err = NewVolume(1, dir)
+	assert.NoError(t, err)
+	_, data, err := v.ReadFile(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.NoError(t, v.Close())
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"time"
+)
+
+// Reap 给所有已过期的 needle 打上删除标记, 返回过期的数量.
+// DropWhenExpired 的 Volume 不逐个标记, 而是在所有 needle 都过期后 Drop 整个 Volume.
+func (v *Volume) Reap() (count int, err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed.Load() {
+		return 0, ErrClosed
+	}
+	now := time.Now()
+	b := NewBatch()
+	var expired []*Needle
+	live := 0
+	iter := v.Directory.Iter(nil)
+	for iter.Next() {
+		n := iter.Needle()
+		if n.Deleted() {
+			continue
+		}
+		if !n.Expired(now) {
+			live++
+			continue
+		}
+		count++
+		if v.DropWhenExpired {
+			continue
+		}
+		d := *n
+		d.Flags |= FlagDeleted
+		b.CompareAndSet(n.ID, n, &d)
+		expired = append(expired, &d)
+	}
+	err = iter.Err()
+	iter.Release()
+	if err != nil {
+		return 0, err
+	}
+	if v.DropWhenExpired {
+		if count > 0 && live == 0 {
+			err = v.drop()
+		}
+		return
+	}
+	err = v.Directory.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	v.writeFlags(expired...)
+	return
+}
+
+// Drop 丢弃 Volume 中所有的 needle 并清空文件
+func (v *Volume) Drop() (err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.closed.Load() {
+		return ErrClosed
+	}
+	return v.drop()
+}
+
+// drop 同 Drop, 调用者需要持有 v.lock. 清空文件时持有 v.swap 的写锁, 读者不会看到清空了一半的 Volume
+func (v *Volume) drop() (err error) {
+	v.swap.Lock()
+	defer v.swap.Unlock()
+	b := NewBatch()
+	iter := v.Directory.Iter(nil)
+	for iter.Next() {
+		b.Delete(iter.Needle().ID)
+	}
+	err = iter.Err()
+	iter.Release()
+	if err != nil {
+		return
+	}
+	err = v.Directory.Write(b)
+	if err != nil {
+		return
+	}
+	err = v.File.Truncate(0)
+	if err != nil {
+		return
+	}
+	return v.setCurrentIndex(InitIndexSize)
+}
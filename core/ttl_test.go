@@ -0,0 +1,68 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestVolume_TTL(t *testing.T) {
+	v, err := NewVolume(1, t.TempDir())
+	assert.NoError(t, err)
+	short, err := v.NewFileWithOptions([]byte("short"), "short.jpg", &FileOptions{TTL: time.Second})
+	assert.NoError(t, err)
+	long, err := v.NewFileWithOptions([]byte("long"), "long.jpg", &FileOptions{TTL: time.Hour})
+	assert.NoError(t, err)
+	forever, err := v.NewFile([]byte("forever"), "forever.jpg")
+	assert.NoError(t, err)
+	_, _, err = v.GetFile(short)
+	assert.NoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, _, err = v.GetFile(short)
+	assert.ErrorIs(t, err, ErrExpired)
+	_, _, err = v.GetFile(long)
+	assert.NoError(t, err)
+
+	count, err := v.Reap()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = v.GetNeedle(short)
+	assert.Equal(t, ErrDeleted, err)
+	count, err = v.Reap()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	err = v.Fragment()
+	assert.NoError(t, err)
+	assert.False(t, v.Directory.Has(short))
+	data, _, err := v.GetFile(forever)
+	assert.NoError(t, err)
+	assert.Equal(t, "forever", string(data))
+}
+
+func TestVolume_DropWhenExpired(t *testing.T) {
+	v, err := NewVolumeWithConfig(1, t.TempDir(), &VolumeConfig{TTL: time.Second, DropWhenExpired: true})
+	assert.NoError(t, err)
+	_, err = v.NewFileWithOptions([]byte("a"), "a", &FileOptions{TTL: time.Hour})
+	assert.ErrorIs(t, err, ErrTTLMismatch)
+	id1, err := v.NewFile([]byte("a"), "a")
+	assert.NoError(t, err)
+	_, err = v.NewFile([]byte("b"), "b")
+	assert.NoError(t, err)
+
+	count, err := v.Reap()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.True(t, v.CurrentOffset > InitIndexSize)
+
+	time.Sleep(1100 * time.Millisecond)
+	count, err = v.Reap()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.False(t, v.Directory.Has(id1))
+	assert.Equal(t, InitIndexSize, v.CurrentOffset)
+	fi, err := v.File.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(InitIndexSize), fi.Size())
+}
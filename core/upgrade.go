@@ -0,0 +1,110 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// v1NeedleFixSize 版本 1 的 header 中除了扩展名以外的大小, 见 FormatVersion
+const v1NeedleFixSize = 44
+
+// unmarshalV1 解出版本 1 的 header. 版本 1 没有删除标记, 删除的 needle 直接从 index 中去掉
+func unmarshalV1(b []byte) (n *Needle, err error) {
+	if len(b) < v1NeedleFixSize {
+		return nil, ErrWrongLen
+	}
+	n = new(Needle)
+	n.ID = binary.BigEndian.Uint64(b[0:8])
+	n.Size = binary.BigEndian.Uint64(b[8:16])
+	n.Offset = binary.BigEndian.Uint64(b[16:24])
+	n.Checksum = binary.BigEndian.Uint32(b[24:28])
+	n.CreatedAt = time.Unix(int64(binary.BigEndian.Uint64(b[28:36])), 0)
+	n.UpdatedAt = time.Unix(int64(binary.BigEndian.Uint64(b[36:44])), 0)
+	n.FileExt = string(b[v1NeedleFixSize:])
+	return
+}
+
+// UpgradeVolume 把 dir 中 id 为 id 的版本 1 的 Volume 转换成当前格式, 写到 out 目录中:
+// Volume 文件中只保留 index 中的 needle, 新的 index 使用 typ 后端和 indexes 指定的二级索引.
+// 原来的文件不会修改, 由调用者替换. 返回转换的 needle 数
+func UpgradeVolume(dir string, id uint64, out string, typ string, indexes IndexFlag) (count int, err error) {
+	name := strconv.FormatUint(id, 10) + ".data"
+	src, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	db, err := leveldb.OpenFile(DirectoryPath(DirectoryLeveldb, dir), &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return 0, fmt.Errorf("Directory: %w", err)
+	}
+	defer db.Close()
+	dst, err := os.OpenFile(filepath.Join(out, name), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	d, err := OpenDirectory(typ, out, indexes)
+	if err != nil {
+		return 0, fmt.Errorf("Directory: %w", err)
+	}
+	defer func() {
+		if e := d.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	offset := InitIndexSize
+	b := NewBatch()
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if len(iter.Key()) != 8 {
+			return count, fmt.Errorf("%w: key %x is not version 1", ErrFormatVersion, iter.Key())
+		}
+		n, err := unmarshalV1(iter.Value())
+		if err != nil {
+			return count, fmt.Errorf("Needle %x: %w", iter.Key(), err)
+		}
+		body := io.NewSectionReader(src, int64(n.Offset)+v1NeedleFixSize+int64(len(n.FileExt)), int64(n.Size))
+		n.Offset = offset
+		header, err := NeedleMarshal(n)
+		if err == nil {
+			_, err = dst.WriteAt(header, int64(offset))
+		}
+		if err == nil {
+			_, err = io.CopyN(io.NewOffsetWriter(dst, int64(offset+n.HeaderSize())), body, int64(n.Size))
+		}
+		if err != nil {
+			return count, fmt.Errorf("Needle %d: %w", n.ID, err)
+		}
+		offset += n.HeaderSize() + n.Size
+		b.Put(n)
+		count++
+		if b.Len() == rebuildBatchSize {
+			if err = d.Write(b); err != nil {
+				return count, err
+			}
+			b.Reset()
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return count, err
+	}
+	if err = d.Write(b); err != nil {
+		return count, err
+	}
+	err = binary.Write(io.NewOffsetWriter(dst, 0), binary.BigEndian, offset)
+	if err == nil {
+		err = dst.Sync()
+	}
+	return count, err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/client"
+)
+
+// retryBackoff 第一次重试前等待的时间, 之后每次加倍, 最多 maxBackoff
+var (
+	retryBackoff = client.DefaultBackoff
+	maxBackoff   = client.DefaultMaxBackoff
+)
+
+// clientFlags 通过 HTTP API 访问服务端的命令共用的参数
+type clientFlags struct {
+	server   string
+	apiKey   string
+	token    string
+	ca       string
+	cert     string
+	key      string
+	insecure bool
+	retries  int
+	timeout  time.Duration
+}
+
+func newClientFlags(fs *flag.FlagSet) *clientFlags {
+	f := &clientFlags{server: "http://localhost:8008"}
+	if v, ok := os.LookupEnv(envPrefix + "SERVER"); ok {
+		f.server = v
+	}
+	f.apiKey, _ = os.LookupEnv(envPrefix + "API_KEY")
+	f.token, _ = os.LookupEnv(envPrefix + "TOKEN")
+	fs.StringVar(&f.server, "server", f.server, "服务端地址, 也可以用 SIMPLEFS_SERVER 设置")
+	fs.StringVar(&f.apiKey, "api-key", f.apiKey, "API key, 也可以用 SIMPLEFS_API_KEY 设置")
+	fs.StringVar(&f.token, "token", f.token, "JWT, 也可以用 SIMPLEFS_TOKEN 设置")
+	fs.StringVar(&f.ca, "ca", "", "验证服务端证书的 CA 证书 (PEM)")
+	fs.StringVar(&f.cert, "cert", "", "客户端证书 (PEM)")
+	fs.StringVar(&f.key, "key", "", "客户端证书的私钥 (PEM)")
+	fs.BoolVar(&f.insecure, "insecure", false, "不验证服务端证书")
+	fs.IntVar(&f.retries, "retries", client.DefaultRetries, "网络错误和 429, 502, 503, 504 时的重试次数")
+	fs.DurationVar(&f.timeout, "timeout", time.Minute, "连接和等待响应 header 的超时时间")
+	return f
+}
+
+// client 按参数创建 client.Client, conns 是同时使用的连接数
+func (f *clientFlags) client(conns int) (*client.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: f.insecure}
+	if f.ca != "" {
+		pem, err := os.ReadFile(f.ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", f.ca)
+		}
+	}
+	if f.cert != "" || f.key != "" {
+		cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	retries := f.retries
+	if retries <= 0 {
+		retries = -1
+	}
+	return client.New(f.server, &client.Options{
+		APIKey:       f.apiKey,
+		Token:        f.token,
+		TLS:          config,
+		MaxIdleConns: conns,
+		Timeout:      f.timeout,
+		Retries:      retries,
+		Backoff:      retryBackoff,
+		MaxBackoff:   maxBackoff,
+	})
+}
+
+func errorCode(err error) string {
+	var e *client.Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// apiError 把 client 返回的错误转成 JSON 输出中的错误
+func apiError(err error) *api.Error {
+	if err == nil {
+		return nil
+	}
+	var e *client.Error
+	if errors.As(err, &e) && e.Code != "" {
+		return &api.Error{Code: e.Code, Message: e.Message}
+	}
+	return &api.Error{Code: api.CodeInternal, Message: err.Error()}
+}
+
+// fileStat 把 client 的查询结果转成和 batch-stat 相同的格式输出
+func fileStat(id uint64, s *client.Stat, err error) api.FileStat {
+	stat := api.FileStat{ID: strconv.FormatUint(id, 10), Error: apiError(err)}
+	if s != nil {
+		stat.Exists, stat.Deleted, stat.Expired, stat.FileInfo = s.Exists, s.Deleted, s.Expired, s.FileInfo
+	}
+	return stat
+}
+
+// uploadOptions 上传的参数
+type uploadOptions struct {
+	strip     bool // 去掉图片的元数据
+	resumable Size // 大于这个大小的文件用可续传上传
+	chunkSize Size // 可续传上传每次 PATCH 的大小
+}
+
+func newUploadOptions(fs *flag.FlagSet) *uploadOptions {
+	o := &uploadOptions{resumable: 16 << 20, chunkSize: client.DefaultChunkSize}
+	fs.BoolVar(&o.strip, "strip", false, "去掉 JPEG 和 PNG 中的 EXIF 等元数据")
+	fs.TextVar(&o.resumable, "resumable", o.resumable, "大于这个大小的文件用可续传上传 (/uploads), 应小于服务端的 max_upload_size")
+	fs.TextVar(&o.chunkSize, "chunk-size", o.chunkSize, "可续传上传每个请求的大小")
+	return o
+}
+
+// trackedFile 读取时更新进度, client 重试时 seek 回开头, 进度也随之重置
+type trackedFile struct {
+	f *os.File
+	t *tracker
+}
+
+func (r *trackedFile) Read(p []byte) (n int, err error) {
+	n, err = r.f.Read(p)
+	r.t.add(int64(n))
+	return
+}
+
+func (r *trackedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.t.reset(pos)
+	}
+	return pos, err
+}
+
+// upload 上传本地文件 file, 保存的文件名为 name. 不为 0 的 id 表示替换这个文件,
+// 它不能被替换时上传成新文件, 返回的 id 与 id 不同. 大于 opt.resumable 的文件用 /uploads 可续传上传, 这时不能指定 id.
+func upload(c *client.Client, file, name string, id uint64, opt *uploadOptions, t *tracker) (*api.UploadResult, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if info.Size() > int64(opt.resumable) {
+		if id != 0 {
+			return nil, errors.New("file too large to replace in place")
+		}
+		return c.Upload(ctx, name, f, info.Size(), &client.UploadOptions{ChunkSize: int64(opt.chunkSize), Progress: t.reset})
+	}
+	putOpt := &client.PutOptions{Strip: opt.strip}
+	r := &trackedFile{f, t}
+	if id != 0 {
+		res, _, err := c.PutFile(ctx, id, name, r, putOpt)
+		if !errors.Is(err, client.ErrConflict) {
+			return res, err
+		}
+		// 不是用 PUT 写入的文件不能替换, 和大文件一样上传成新文件
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.Put(ctx, name, r, putOpt)
+}
+
+// download 把文件 id 的内容写到 w, 返回上传时的文件名. 连接中断时 client 从断开的位置继续,
+// 文件在下载过程中被替换时, 用 reset 清空已经写入的内容后重新下载, reset 为 nil 时返回错误.
+func download(c *client.Client, id uint64, w io.Writer, reset func() error, t *tracker) (filename string, err error) {
+	for {
+		f, err := c.Get(context.Background(), id)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(w, io.TeeReader(f, t))
+		f.Close()
+		if err == nil {
+			return f.Filename, nil
+		}
+		if !errors.Is(err, client.ErrChanged) || reset == nil {
+			return "", err
+		}
+		err = reset()
+		if err != nil {
+			return "", err
+		}
+		t.reset(0)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/core"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newClientTestServer 运行真实 api.Server 的 httptest.Server, wrap 不为 nil 时包装它的 handler
+func newClientTestServer(t *testing.T, wrap func(http.Handler) http.Handler) (*httptest.Server, *api.Server) {
+	s := api.NewServer(0, t.TempDir())
+	var h http.Handler = s.Mux
+	if wrap != nil {
+		h = wrap(h)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(func() {
+		ts.Close()
+		s.Shutdown(context.Background())
+	})
+	return ts, s
+}
+
+// writeFiles 在 dir 中写入 files, key 是用 / 分隔的相对路径
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+	}
+}
+
+func putFiles(t *testing.T, server string, args ...string) map[string]putResult {
+	out, err := captureStdout(t, func() error {
+		return runPut(append([]string{"-server", server, "-json", "-q", "-resumable", "1KB", "-chunk-size", "300B"}, args...))
+	})
+	assert.NoError(t, err)
+	var results []putResult
+	assert.NoError(t, json.Unmarshal([]byte(out), &results))
+	m := make(map[string]putResult)
+	for _, res := range results {
+		m[filepath.ToSlash(res.Path)] = res
+	}
+	return m
+}
+
+func TestPutGet(t *testing.T) {
+	ts, _ := newClientTestServer(t, nil)
+	dir := t.TempDir()
+	big := strings.Repeat("0123456789", 200)
+	writeFiles(t, dir, map[string]string{"a.txt": "aaa", "sub/b.txt": "bbb", "sub/deep/big.bin": big})
+	results := putFiles(t, ts.URL, dir)
+	assert.Len(t, results, 3)
+	for name, res := range results {
+		assert.Empty(t, res.Error, name)
+		assert.NotZero(t, res.ID, name)
+	}
+	bigRes := results[filepath.ToSlash(filepath.Join(dir, "sub/deep/big.bin"))]
+	assert.Equal(t, uint64(len(big)), bigRes.Size)
+
+	// 下载到标准输出和文件
+	id := strconv.FormatUint(results[filepath.ToSlash(filepath.Join(dir, "a.txt"))].ID, 10)
+	out, err := captureStdout(t, func() error {
+		return runGet([]string{"-server", ts.URL, id})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "aaa", out)
+	file := filepath.Join(t.TempDir(), "big.bin")
+	assert.NoError(t, runGet([]string{"-server", ts.URL, "-o", file, strconv.FormatUint(bigRes.ID, 10)}))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, big, string(data))
+
+	// 多个文件下载到目录, 使用上传时的文件名
+	outDir := t.TempDir()
+	var ids []string
+	for _, res := range results {
+		ids = append(ids, strconv.FormatUint(res.ID, 10))
+	}
+	_, err = captureStdout(t, func() error {
+		return runGet(append([]string{"-server", ts.URL, "-q", "-o", outDir}, ids...))
+	})
+	assert.NoError(t, err)
+	for name, want := range map[string]string{"a.txt": "aaa", "b.txt": "bbb", "big.bin": big} {
+		data, err := os.ReadFile(filepath.Join(outDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+
+	assert.Error(t, runGet([]string{"-server", ts.URL, "-o", file, id, id}))
+	err = runGet([]string{"-server", ts.URL, "-o", file, "404"})
+	assert.Equal(t, api.CodeNotFound, errorCode(err))
+	assert.Error(t, runPut([]string{"-server", ts.URL, filepath.Join(dir, "missing")}))
+}
+
+func TestStatRmLs(t *testing.T) {
+	ts, _ := newClientTestServer(t, nil)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "aaa", "b.txt": "bbb", "c.json": "{}"})
+	results := putFiles(t, ts.URL, dir)
+	ida := strconv.FormatUint(results[filepath.ToSlash(filepath.Join(dir, "a.txt"))].ID, 10)
+	idb := strconv.FormatUint(results[filepath.ToSlash(filepath.Join(dir, "b.txt"))].ID, 10)
+
+	out, err := captureStdout(t, func() error {
+		return runStat([]string{"-server", ts.URL, ida})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "filename:     a.txt")
+	assert.Contains(t, out, "state:        exists")
+
+	out, err = captureStdout(t, func() error {
+		return runRm([]string{"-server", ts.URL, idb})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, idb+"\n", out)
+
+	out, err = captureStdout(t, func() error {
+		return runStat([]string{"-server", ts.URL, "-json", ida, idb})
+	})
+	assert.ErrorContains(t, err, "1 of 2 files do not exist")
+	var stats []api.FileStat
+	assert.NoError(t, json.Unmarshal([]byte(out), &stats))
+	assert.True(t, stats[0].Exists)
+	assert.True(t, stats[1].Deleted)
+
+	ls := func(args ...string) (files []api.FileStat) {
+		out, err := captureStdout(t, func() error {
+			return runLs(append([]string{"-server", ts.URL, "-json"}, args...))
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal([]byte(out), &files))
+		return
+	}
+	assert.Len(t, ls(), 2)
+	assert.Len(t, ls("-all"), 3)
+	assert.Len(t, ls("-n", "1"), 1)
+	files := ls("-ext", "txt")
+	assert.Len(t, files, 1)
+	assert.Equal(t, ida, files[0].ID)
+	assert.Empty(t, ls("-before", "2001-01-01"))
+
+	out, err = captureStdout(t, func() error {
+		return runLs([]string{"-server", ts.URL})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "c.json")
+	assert.Error(t, runLs([]string{"-server", ts.URL, "-after", "yesterday"}))
+}
+
+func TestSync(t *testing.T) {
+	ts, s := newClientTestServer(t, nil)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "aaa", "sub/b.txt": "bbb"})
+	syncDir := func(args ...string) (plan []syncResult) {
+		out, err := captureStdout(t, func() error {
+			return runSync(append([]string{"-server", ts.URL, "-json", "-q", dir}, args...))
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal([]byte(out), &plan))
+		return
+	}
+	plan := syncDir()
+	assert.Len(t, plan, 2)
+	assert.Equal(t, "a.txt", plan[0].Path)
+	assert.Equal(t, "upload", plan[0].Action)
+	assert.Equal(t, "sub/b.txt", plan[1].Path)
+	ida, idb := plan[0].ID, plan[1].ID
+	assert.Empty(t, syncDir())
+
+	// 上传的文件不能替换, 修改后上传成新文件并删除旧的. 删除的文件只在 -delete 时删除
+	writeFiles(t, dir, map[string]string{"a.txt": "new content"})
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "a.txt"), time.Now(), time.Now().Add(time.Hour)))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "sub", "b.txt")))
+	plan = syncDir()
+	assert.Len(t, plan, 1)
+	assert.Equal(t, "update", plan[0].Action)
+	assert.NotEqual(t, ida, plan[0].ID)
+	data, _, err := s.Volume.GetFile(plan[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "new content", string(data))
+	_, err = s.Volume.GetNeedle(ida)
+	assert.ErrorIs(t, err, core.ErrDeleted)
+	ida = plan[0].ID
+
+	plan = syncDir("-delete")
+	assert.Len(t, plan, 1)
+	assert.Equal(t, "delete", plan[0].Action)
+	assert.Equal(t, idb, plan[0].ID)
+	_, err = s.Volume.GetNeedle(idb)
+	assert.Error(t, err)
+
+	// 服务端上被删除的文件重新上传
+	assert.NoError(t, s.Volume.DelNeedle(ida))
+	plan = syncDir()
+	assert.Len(t, plan, 1)
+	assert.Equal(t, "upload", plan[0].Action)
+	assert.NotEqual(t, ida, plan[0].ID)
+
+	out, err := captureStdout(t, func() error {
+		return runSync([]string{"-server", ts.URL, "-dry-run", dir})
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestClientRetry(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = backoff }()
+	// 每个上传请求第一次都返回 503
+	var failures atomic.Int32
+	var seen sync.Map
+	ts, _ := newClientTestServer(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Method + " " + r.URL.Path + " " + r.Header.Get("Upload-Offset")
+			if r.Method != "HEAD" && r.Method != "GET" {
+				if _, ok := seen.LoadOrStore(key, true); !ok {
+					failures.Add(1)
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("x"), 2000)
+	writeFiles(t, dir, map[string]string{"small.txt": "small", "big.bin": string(big)})
+	results := putFiles(t, ts.URL, dir)
+	for name, res := range results {
+		assert.Empty(t, res.Error, name)
+	}
+	assert.GreaterOrEqual(t, failures.Load(), int32(5))
+
+	file := filepath.Join(t.TempDir(), "big.bin")
+	assert.NoError(t, runGet([]string{"-server", ts.URL, "-o", file, strconv.FormatUint(results[filepath.ToSlash(filepath.Join(dir, "big.bin"))].ID, 10)}))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, big, data)
+
+	seen.Clear()
+	_, err = captureStdout(t, func() error {
+		return runPut([]string{"-server", ts.URL, "-q", "-retries", "0", filepath.Join(dir, "small.txt")})
+	})
+	assert.ErrorContains(t, err, "1 of 1 uploads failed")
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/core"
+	"github.com/hmli/simplefs/manager"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix 环境变量的前缀, 配置项 max_upload_size 对应 SIMPLEFS_MAX_UPLOAD_SIZE
+const envPrefix = "SIMPLEFS_"
+
+// fsync 的取值, 也可以是一个时间间隔 (比如 1s) 表示定期刷盘
+const (
+	FsyncNever  = "never"  // 交给操作系统
+	FsyncAlways = "always" // 每次写入后都 fsync
+)
+
+// Config server 命令的配置. 优先级从低到高为: 默认值, 配置文件 (YAML), 环境变量, 命令行参数.
+// 每一项的命令行参数是 yaml 名字中的 _ 换成 -, 环境变量是 SIMPLEFS_ 加上大写的 yaml 名字.
+// 列表在环境变量和命令行中用逗号分隔, map 用分号分隔 key=value
+type Config struct {
+	Listen          string        `yaml:"listen" usage:"监听的地址"`
+	Dir             string        `yaml:"dir" usage:"数据目录"`
+	VolumesDir      string        `yaml:"volumes_dir" usage:"存放大文件 chunk 的 Volume 的目录, 默认为 dir/volumes"`
+	Directory       string        `yaml:"directory" usage:"index 的后端: leveldb, bolt, pebble"`
+	Indexes         string        `yaml:"indexes" usage:"要维护的二级索引: filename, ext, created, all"`
+	VolumeSize      Size          `yaml:"volume_size" usage:"Volume 的大小"`
+	ChunkSize       Size          `yaml:"chunk_size" usage:"大文件切分的 chunk 大小"`
+	Fsync           string        `yaml:"fsync" usage:"刷盘策略: never, always 或者定期刷盘的间隔 (比如 1s)"`
+	TTL             time.Duration `yaml:"ttl" usage:"文件默认的存活时间, 0 表示永不过期"`
+	DropWhenExpired bool          `yaml:"drop_when_expired" usage:"所有文件都过期后丢弃整个 Volume, 需要设置 ttl"`
+	ReapInterval    time.Duration `yaml:"reap_interval" usage:"给过期文件打删除标记的间隔, 0 表示不清理"`
+
+	MaxUploadSize    Size          `yaml:"max_upload_size" usage:"一次上传请求的大小上限, 0 表示不限制"`
+	MaxResumableSize Size          `yaml:"max_resumable_size" usage:"可续传上传的文件大小上限, 0 表示不限制"`
+	UploadTimeout    time.Duration `yaml:"upload_timeout" usage:"可续传上传没有新数据多久后被清理"`
+	AllowedTypes     []string      `yaml:"allowed_types,omitempty" usage:"允许上传的 MIME 类型, 支持 image/* 这样的通配, 为空时允许所有类型"`
+	DeniedTypes      []string      `yaml:"denied_types,omitempty" usage:"禁止上传的 MIME 类型"`
+	CacheMaxAge      time.Duration `yaml:"cache_max_age" usage:"文件的 Cache-Control max-age"`
+	CacheThumbnails  bool          `yaml:"cache_thumbnails" usage:"保存生成的缩略图"`
+	ThumbnailSizes   []string      `yaml:"thumbnail_sizes,omitempty" usage:"任何人都可以保存的缩略图尺寸, 比如 200x200, 其它尺寸只保存有写权限的请求生成的"`
+	StripMetadata    bool          `yaml:"strip_metadata" usage:"去掉所有上传的图片中的 EXIF/XMP"`
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout" usage:"退出时等待进行中的请求完成的最长时间"`
+
+	APIKeys     map[string]string `yaml:"api_keys,omitempty" usage:"API key 和它的权限 (read, write, delete, all), 比如 key1=read;key2=all"`
+	JWTSecret   string            `yaml:"jwt_secret" usage:"验证 HS256 JWT 的密钥"`
+	URLSecret   string            `yaml:"url_secret" usage:"验证预签名 URL 的密钥"`
+	ClientCerts map[string]string `yaml:"client_certs,omitempty" usage:"客户端证书的 CommonName 和它的权限, * 匹配所有证书"`
+
+	TLSCert              string `yaml:"tls_cert" usage:"HTTPS 证书文件"`
+	TLSKey               string `yaml:"tls_key" usage:"HTTPS 私钥文件"`
+	TLSClientCA          string `yaml:"tls_client_ca" usage:"验证客户端证书的 CA 文件"`
+	TLSRequireClientCert bool   `yaml:"tls_require_client_cert" usage:"拒绝没有有效客户端证书的连接"`
+}
+
+// DefaultConfig 默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:           ":8008",
+		Dir:              "data",
+		Directory:        core.DirectoryLeveldb,
+		VolumeSize:       Size(core.MaxVolumeSize),
+		ChunkSize:        Size(manager.DefaultChunkSize),
+		Fsync:            FsyncNever,
+		MaxUploadSize:    Size(api.DefaultMaxUploadSize),
+		MaxResumableSize: Size(api.DefaultMaxResumableSize),
+		UploadTimeout:    api.DefaultUploadTimeout,
+		CacheMaxAge:      api.DefaultCacheMaxAge,
+		CacheThumbnails:  true,
+		ShutdownTimeout:  api.DefaultShutdownTimeout,
+		ReapInterval:     api.DefaultReapInterval,
+	}
+}
+
+// LoadConfig 从命令行参数, 环境变量和配置文件中读取配置. 配置文件由 -config 或 SIMPLEFS_CONFIG 指定.
+// printConfig 表示命令行中带了 -print-config
+func LoadConfig(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (c *Config, printConfig bool, err error) {
+	c = DefaultConfig()
+	path, _ := lookupEnv(envPrefix + "CONFIG")
+	fs.StringVar(&path, "config", path, "配置文件 (YAML)")
+	fs.BoolVar(&printConfig, "print-config", false, "打印最终的配置后退出, 密钥会被隐藏")
+	flags := make(map[string]string)
+	fields := configFields(c)
+	for _, f := range fields {
+		fs.Var(&fieldFlag{f, flags}, f.flag, f.usage)
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("Unexpected argument: %s", fs.Arg(0))
+	}
+	if path != "" {
+		err = c.loadFile(path)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	err = c.loadEnv(lookupEnv)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, f := range fields {
+		if s, ok := flags[f.flag]; ok {
+			if err := f.set(s); err != nil {
+				return nil, false, fmt.Errorf("-%s: %w", f.flag, err)
+			}
+		}
+	}
+	return c, printConfig, c.Validate()
+}
+
+// loadFile 读取 YAML 配置文件, 不认识的配置项会报错
+func (c *Config) loadFile(path string) (err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv 用环境变量覆盖配置
+func (c *Config) loadEnv(lookupEnv func(string) (string, bool)) error {
+	for _, f := range configFields(c) {
+		if s, ok := lookupEnv(f.env); ok {
+			if err := f.set(s); err != nil {
+				return fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate 检查配置, 返回所有的错误
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, a...))
+		}
+	}
+	_, _, err := net.SplitHostPort(c.Listen)
+	check(err == nil, "listen: %v", err)
+	check(c.Dir != "", "dir is required")
+	switch c.Directory {
+	case core.DirectoryLeveldb, core.DirectoryBolt, core.DirectoryPebble:
+	default:
+		check(false, "directory: unknown backend %q", c.Directory)
+	}
+	_, err = core.ParseIndexFlag(c.Indexes)
+	check(err == nil, "indexes: %v", err)
+	check(c.VolumeSize > Size(core.InitIndexSize) && c.VolumeSize <= Size(core.MaxVolumeSize),
+		"volume_size: should be in (%s, %s]", Size(core.InitIndexSize), Size(core.MaxVolumeSize))
+	check(c.ChunkSize > 0 && c.ChunkSize < c.VolumeSize, "chunk_size: should be positive and less than volume_size")
+	_, err = c.syncInterval()
+	check(err == nil, "fsync: %v", err)
+	check(c.TTL >= 0, "ttl: should not be negative")
+	check(!c.DropWhenExpired || c.TTL > 0, "drop_when_expired requires ttl")
+	check(c.ReapInterval >= 0, "reap_interval: should not be negative")
+	check(c.UploadTimeout > 0, "upload_timeout: should be positive")
+	check(c.CacheMaxAge >= 0, "cache_max_age: should not be negative")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout: should not be negative")
+	for _, t := range append(append([]string{}, c.AllowedTypes...), c.DeniedTypes...) {
+		check(strings.Count(t, "/") == 1, "wrong MIME type: %q", t)
+	}
+	for _, size := range c.ThumbnailSizes {
+		_, _, err = api.ParseThumbnailSize(size)
+		check(err == nil, "thumbnail_sizes: %v", err)
+	}
+	for _, m := range []struct {
+		name  string
+		perms map[string]string
+	}{{"api_keys", c.APIKeys}, {"client_certs", c.ClientCerts}} {
+		for k, p := range m.perms {
+			check(k != "", "%s: empty key", m.name)
+			_, err = api.ParsePermission(p)
+			check(err == nil, "%s: %v", m.name, err)
+		}
+	}
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls_cert and tls_key should be set together")
+	check(c.TLSClientCA == "" || c.TLSCert != "", "tls_client_ca requires tls_cert")
+	check(!c.TLSRequireClientCert || c.TLSClientCA != "", "tls_require_client_cert requires tls_client_ca")
+	check(len(c.ClientCerts) == 0 || c.TLSClientCA != "", "client_certs requires tls_client_ca")
+	check(c.URLSecret == "" || c.authEnabled(), "url_secret requires api_keys, jwt_secret or client_certs")
+	return errors.Join(errs...)
+}
+
+// syncInterval fsync 为时间间隔时返回它, never 和 always 返回 0
+func (c *Config) syncInterval() (interval time.Duration, err error) {
+	switch c.Fsync {
+	case FsyncNever, FsyncAlways:
+		return 0, nil
+	}
+	interval, err = time.ParseDuration(c.Fsync)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("should be never, always or a positive duration, got %q", c.Fsync)
+	}
+	return interval, nil
+}
+
+func (c *Config) authEnabled() bool {
+	return len(c.APIKeys) > 0 || c.JWTSecret != "" || len(c.ClientCerts) > 0
+}
+
+// NewServer 按配置打开数据目录, 创建 Server
+func (c *Config) NewServer() (s *api.Server, err error) {
+	indexes, err := core.ParseIndexFlag(c.Indexes)
+	if err != nil {
+		return nil, err
+	}
+	syncInterval, err := c.syncInterval()
+	if err != nil {
+		return nil, err
+	}
+	s, err = api.NewServerWithOptions(&api.Options{
+		Dir:        c.Dir,
+		VolumesDir: c.VolumesDir,
+		Volume: &core.VolumeConfig{
+			Directory:       c.Directory,
+			Indexes:         indexes,
+			TTL:             c.TTL,
+			DropWhenExpired: c.DropWhenExpired,
+			SyncWrites:      c.Fsync == FsyncAlways,
+		},
+		VolumeSize: uint64(c.VolumeSize),
+		ChunkSize:  uint64(c.ChunkSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Addr = c.Listen
+	s.SyncInterval = syncInterval
+	s.ReapInterval = c.ReapInterval
+	s.MaxUploadSize = int64(c.MaxUploadSize)
+	s.MaxResumableSize = int64(c.MaxResumableSize)
+	s.UploadTimeout = c.UploadTimeout
+	s.AllowedTypes = c.AllowedTypes
+	s.DeniedTypes = c.DeniedTypes
+	s.CacheMaxAge = c.CacheMaxAge
+	s.CacheThumbnails = c.CacheThumbnails
+	s.ThumbnailSizes = c.ThumbnailSizes
+	s.StripMetadata = c.StripMetadata
+	s.ShutdownTimeout = c.ShutdownTimeout
+	s.Auth, err = c.authenticator()
+	if err != nil {
+		s.Shutdown(context.Background())
+		return nil, err
+	}
+	s.URLSecret = []byte(c.URLSecret)
+	if c.TLSCert != "" {
+		s.TLS = &api.TLSConfig{
+			CertFile:          c.TLSCert,
+			KeyFile:           c.TLSKey,
+			ClientCAFile:      c.TLSClientCA,
+			RequireClientCert: c.TLSRequireClientCert,
+		}
+	}
+	return s, nil
+}
+
+// authenticator 按配置组合 Authenticator, 都没有配置时返回 nil, 不检查权限
+func (c *Config) authenticator() (auth api.Authenticator, err error) {
+	var auths api.Authenticators
+	if len(c.ClientCerts) > 0 {
+		certs := make(api.ClientCerts)
+		for cn, p := range c.ClientCerts {
+			certs[cn], err = api.ParsePermission(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		auths = append(auths, certs)
+	}
+	if len(c.APIKeys) > 0 {
+		keys := make(api.APIKeys)
+		for key, p := range c.APIKeys {
+			keys[key], err = api.ParsePermission(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		auths = append(auths, keys)
+	}
+	if c.JWTSecret != "" {
+		auths = append(auths, &api.JWTAuth{Secret: []byte(c.JWTSecret), Leeway: time.Minute})
+	}
+	if len(auths) == 0 {
+		return nil, nil
+	}
+	return auths, nil
+}
+
+// Print 以 YAML 输出配置, 密钥和 API key 被隐藏
+func (c *Config) Print(w io.Writer) error {
+	printed := *c
+	printed.JWTSecret = redact(c.JWTSecret)
+	printed.URLSecret = redact(c.URLSecret)
+	if len(c.APIKeys) > 0 {
+		printed.APIKeys = make(map[string]string)
+		for key, p := range c.APIKeys {
+			printed.APIKeys[redact(key)] = p
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(&printed)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redact 隐藏密钥, 长的密钥保留开头几个字符方便辨认
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) < 16 {
+		return "******"
+	}
+	return secret[:4] + "******"
+}
+
+// configField Config 中的一项
+type configField struct {
+	value reflect.Value
+	name  string // yaml 中的名字
+	flag  string
+	env   string
+	usage string
+}
+
+func configFields(c *Config) (fields []configField) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		fields = append(fields, configField{
+			value: v.Field(i),
+			name:  name,
+			flag:  strings.ReplaceAll(name, "_", "-"),
+			env:   envPrefix + strings.ToUpper(name),
+			usage: t.Field(i).Tag.Get("usage"),
+		})
+	}
+	return
+}
+
+// set 按字段的类型解析 s
+func (f configField) set(s string) (err error) {
+	switch p := f.value.Addr().Interface().(type) {
+	case *string:
+		*p = s
+	case *bool:
+		*p, err = strconv.ParseBool(s)
+	case *Size:
+		*p, err = ParseSize(s)
+	case *time.Duration:
+		*p, err = time.ParseDuration(s)
+	case *[]string:
+		*p = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	case *map[string]string:
+		*p = make(map[string]string)
+		for _, item := range strings.Split(s, ";") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("Wrong item %q, should be key=value", item)
+			}
+			(*p)[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	default:
+		return fmt.Errorf("Unsupported config type %s", f.value.Type())
+	}
+	return err
+}
+
+// fieldFlag 命令行参数先记录下来, 读完配置文件和环境变量后再生效
+type fieldFlag struct {
+	field  configField
+	values map[string]string
+}
+
+func (f *fieldFlag) String() string {
+	if !f.field.value.IsValid() || f.field.value.IsZero() {
+		return ""
+	}
+	return fmt.Sprint(f.field.value.Interface())
+}
+
+func (f *fieldFlag) Set(s string) error {
+	err := configField{value: reflect.New(f.field.value.Type()).Elem()}.set(s)
+	if err != nil {
+		return err
+	}
+	f.values[f.field.flag] = s
+	return nil
+}
+
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.field.value.Kind() == reflect.Bool
+}
+
+// Size 字节数, 可以写成 512, 64KB, 64MB, 1GB, 1TB (按 1024 换算)
+type Size uint64
+
+var sizeUnits = []struct {
+	suffix string
+	size   Size
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func ParseSize(s string) (Size, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	unit := Size(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str, unit = strings.TrimSpace(strings.TrimSuffix(str, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseUint(str, 10, 64)
+	if err != nil || n > uint64(^Size(0)/unit) {
+		return 0, fmt.Errorf("Wrong size %q", s)
+	}
+	return Size(n) * unit, nil
+}
+
+func (s Size) String() string {
+	for _, u := range sizeUnits {
+		if s >= u.size && s%u.size == 0 {
+			return strconv.FormatUint(uint64(s/u.size), 10) + u.suffix
+		}
+	}
+	return "0"
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Size) UnmarshalText(text []byte) (err error) {
+	*s, err = ParseSize(string(text))
+	return err
+}
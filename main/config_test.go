@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/hmli/simplefs/api"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loadConfig(t *testing.T, args []string, env map[string]string) (*Config, bool, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return LoadConfig(fs, args, func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	})
+}
+
+func TestParseSize(t *testing.T) {
+	for s, size := range map[string]Size{"512": 512, "64KB": 64 << 10, "32mb": 32 << 20, "1 GB": 1 << 30, "2TB": 2 << 40, "0": 0} {
+		got, err := ParseSize(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, size, got, s)
+	}
+	for _, s := range []string{"", "MB", "1.5GB", "-1", "99999999999TB"} {
+		_, err := ParseSize(s)
+		assert.Error(t, err, s)
+	}
+	assert.Equal(t, "64MB", Size(64<<20).String())
+	assert.Equal(t, "1025B", Size(1025).String())
+	assert.Equal(t, "0", Size(0).String())
+}
+
+func TestLoadConfig(t *testing.T) {
+	conf, printConfig, err := loadConfig(t, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, printConfig)
+	assert.Equal(t, DefaultConfig(), conf)
+
+	path := filepath.Join(t.TempDir(), "simplefs.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+listen: 127.0.0.1:9000
+dir: /var/lib/simplefs
+directory: bolt
+chunk_size: 16MB
+fsync: 1s
+max_upload_size: 1GB
+allowed_types: [image/*, application/pdf]
+api_keys:
+  key1: read
+  key2: all
+`), 0600))
+	env := map[string]string{
+		"SIMPLEFS_CONFIG":           path,
+		"SIMPLEFS_LISTEN":           ":9001",
+		"SIMPLEFS_CHUNK_SIZE":       "8MB",
+		"SIMPLEFS_STRIP_METADATA":   "true",
+		"SIMPLEFS_API_KEYS":         "key3=read,write",
+		"SIMPLEFS_SHUTDOWN_TIMEOUT": "5s",
+	}
+	conf, _, err = loadConfig(t, []string{"-listen", ":9002", "-strip-metadata=false", "-denied-types", "text/html, image/svg+xml"}, env)
+	assert.NoError(t, err)
+	// 命令行 > 环境变量 > 配置文件 > 默认值
+	assert.Equal(t, ":9002", conf.Listen)
+	assert.False(t, conf.StripMetadata)
+	assert.Equal(t, Size(8<<20), conf.ChunkSize)
+	assert.Equal(t, map[string]string{"key3": "read,write"}, conf.APIKeys)
+	assert.Equal(t, 5*time.Second, conf.ShutdownTimeout)
+	assert.Equal(t, "/var/lib/simplefs", conf.Dir)
+	assert.Equal(t, "bolt", conf.Directory)
+	assert.Equal(t, "1s", conf.Fsync)
+	assert.Equal(t, Size(1<<30), conf.MaxUploadSize)
+	assert.Equal(t, Size(api.DefaultMaxResumableSize), conf.MaxResumableSize)
+	assert.Equal(t, []string{"image/*", "application/pdf"}, conf.AllowedTypes)
+	assert.Equal(t, []string{"text/html", "image/svg+xml"}, conf.DeniedTypes)
+	assert.Equal(t, api.DefaultCacheMaxAge, conf.CacheMaxAge)
+
+	// -config 优先于 SIMPLEFS_CONFIG
+	_, _, err = loadConfig(t, []string{"-config", "/not/exist.yaml"}, env)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte("chunk_sise: 16MB\n"), 0600))
+	_, _, err = loadConfig(t, []string{"-config", path}, nil)
+	assert.ErrorContains(t, err, "chunk_sise")
+
+	_, _, err = loadConfig(t, []string{"-chunk-size", "big"}, nil)
+	assert.Error(t, err)
+	_, _, err = loadConfig(t, nil, map[string]string{"SIMPLEFS_TTL": "forever"})
+	assert.ErrorContains(t, err, "SIMPLEFS_TTL")
+	_, _, err = loadConfig(t, []string{"-h"}, nil)
+	assert.ErrorIs(t, err, flag.ErrHelp)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for name, modify := range map[string]func(c *Config){
+		"listen":     func(c *Config) { c.Listen = "8008" },
+		"directory":  func(c *Config) { c.Directory = "mysql" },
+		"indexes":    func(c *Config) { c.Indexes = "size" },
+		"chunk_size": func(c *Config) { c.ChunkSize = c.VolumeSize },
+		"fsync":      func(c *Config) { c.Fsync = "sometimes" },
+		"MIME":       func(c *Config) { c.AllowedTypes = []string{"image"} },
+		"api_keys":   func(c *Config) { c.APIKeys = map[string]string{"key": "admin"} },
+		"tls_key":    func(c *Config) { c.TLSCert = "cert.pem" },
+		"tls_client_ca": func(c *Config) {
+			c.TLSRequireClientCert = true
+		},
+		"url_secret":        func(c *Config) { c.URLSecret = "secret" },
+		"drop_when_expired": func(c *Config) { c.DropWhenExpired = true },
+		"reap_interval":     func(c *Config) { c.ReapInterval = -time.Second },
+		"thumbnail_sizes":   func(c *Config) { c.ThumbnailSizes = []string{"200"} },
+	} {
+		c := DefaultConfig()
+		modify(c)
+		assert.ErrorContains(t, c.Validate(), name)
+	}
+
+	c := DefaultConfig()
+	c.Listen, c.Dir, c.Fsync = "", "", "-1s"
+	err := c.Validate()
+	assert.ErrorContains(t, err, "listen")
+	assert.ErrorContains(t, err, "dir is required")
+	assert.ErrorContains(t, err, "fsync")
+}
+
+func TestConfig_NewServer(t *testing.T) {
+	c := DefaultConfig()
+	c.Dir = t.TempDir()
+	c.Fsync = "100ms"
+	c.MaxUploadSize = 1 << 20
+	c.APIKeys = map[string]string{"key": "read"}
+	c.JWTSecret = "jwt"
+	c.URLSecret = "url"
+	s, err := c.NewServer()
+	assert.NoError(t, err)
+	defer s.Manager.Close()
+	assert.Equal(t, 100*time.Millisecond, s.SyncInterval)
+	assert.Equal(t, api.DefaultReapInterval, s.ReapInterval)
+	assert.False(t, s.Volume.SyncWrites)
+	assert.Equal(t, int64(1<<20), s.MaxUploadSize)
+	assert.Equal(t, []byte("url"), s.URLSecret)
+	auths, ok := s.Auth.(api.Authenticators)
+	assert.True(t, ok)
+	assert.Len(t, auths, 2)
+	assert.Nil(t, s.TLS)
+	s.Manager.Close()
+
+	c = DefaultConfig()
+	c.Dir = t.TempDir()
+	c.Fsync = FsyncAlways
+	c.TTL, c.DropWhenExpired, c.ReapInterval = time.Hour, true, 0
+	s, err = c.NewServer()
+	assert.NoError(t, err)
+	defer s.Manager.Close()
+	assert.True(t, s.Volume.SyncWrites)
+	assert.True(t, s.Volume.DropWhenExpired)
+	assert.Zero(t, s.ReapInterval)
+	assert.Nil(t, s.Auth)
+}
+
+func TestConfig_Print(t *testing.T) {
+	c := DefaultConfig()
+	c.APIKeys = map[string]string{"0123456789abcdef0123": "all"}
+	c.JWTSecret = "short"
+	buf := new(bytes.Buffer)
+	assert.NoError(t, c.Print(buf))
+	out := buf.String()
+	assert.Contains(t, out, "chunk_size: 64MB")
+	assert.Contains(t, out, "upload_timeout: 24h0m0s")
+	assert.Contains(t, out, "0123******: all")
+	assert.Contains(t, out, "jwt_secret: '******'")
+	assert.NotContains(t, out, "short")
+	assert.NotContains(t, out, "0123456789abcdef")
+
+	// 打印的配置可以再读回来
+	path := filepath.Join(t.TempDir(), "simplefs.yaml")
+	c.APIKeys, c.JWTSecret = nil, ""
+	buf.Reset()
+	assert.NoError(t, c.Print(buf))
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0600))
+	loaded, _, err := loadConfig(t, []string{"-config", path}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, c, loaded)
+}
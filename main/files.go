@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hmli/simplefs/api"
+	"github.com/hmli/simplefs/client"
+	"github.com/hmli/simplefs/core"
+)
+
+// 通过 HTTP API 读写文件的命令, 服务端地址和凭证见 newClientFlags
+var clientCommands = []command{
+	{"put", "上传文件, 目录会递归上传", runPut},
+	{"get", "下载文件", runGet},
+	{"rm", "删除文件", runRm},
+	{"stat", "查询文件的元数据", runStat},
+	{"ls", "列出服务端的文件", runLs},
+	{"sync", "把本地目录同步到服务端", runSync},
+}
+
+// parallel 用 n 个 goroutine 执行 fn(0) 到 fn(count-1)
+func parallel(n, count int, fn func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < max(1, min(n, count)); j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// localFile 要上传的本地文件
+type localFile struct {
+	path string
+	info fs.FileInfo
+}
+
+// collectFiles 展开 paths 中的目录, 返回所有普通文件 (包括指向普通文件的符号链接)
+func collectFiles(paths []string) (files []localFile, err error) {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() {
+				return nil, fmt.Errorf("%s is not a regular file", p)
+			}
+			files = append(files, localFile{p, info})
+			continue
+		}
+		err = filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, localFile{path, info})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// putResult put 中一个文件的结果
+type putResult struct {
+	Path string `json:"path"`
+	*api.UploadResult
+	Error string `json:"error,omitempty"`
+}
+
+func failed(count, total int, what string) error {
+	if count == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d %s failed", count, total, what)
+}
+
+func runPut(args []string) error {
+	fs := newFlagSet("put", "[flags] <file|dir>...")
+	cf := newClientFlags(fs)
+	opt := newUploadOptions(fs)
+	jobs := fs.Int("j", 4, "同时上传的文件数")
+	asJSON := fs.Bool("json", false, "以 JSON 输出每个文件的结果")
+	quiet := fs.Bool("q", false, "不输出进度, 只输出错误")
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fs.Usage()
+		return errors.New("at least one file is required")
+	}
+	files, err := collectFiles(paths)
+	if err != nil {
+		return err
+	}
+	c, err := cf.client(*jobs)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.info.Size()
+	}
+	results := make([]putResult, len(files))
+	p := newProgress(*quiet)
+	p.start(len(files), total)
+	parallel(*jobs, len(files), func(i int) {
+		f := files[i]
+		res, err := upload(c, f.path, f.info.Name(), 0, opt, p.tracker())
+		results[i] = putResult{Path: f.path, UploadResult: res}
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+		p.finish(f.path, err)
+	})
+	p.close()
+	if *asJSON {
+		err = printJSON(os.Stdout, results)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, res := range results {
+			if res.Error == "" {
+				fmt.Printf("%d\t%s\n", res.ID, res.Path)
+			}
+		}
+	}
+	return failed(p.failed, len(files), "uploads")
+}
+
+// parseIDs 解析命令行中的文件 id
+func parseIDs(args []string) (ids []uint64, err error) {
+	for _, s := range args {
+		id, err := parseID(s)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+func runGet(args []string) error {
+	fs := newFlagSet("get", "[flags] <id>...")
+	cf := newClientFlags(fs)
+	out := fs.String("o", "-", "输出的文件或目录, - 表示标准输出. 多个 id 时必须是目录, 文件名为上传时的文件名")
+	jobs := fs.Int("j", 4, "同时下载的文件数")
+	quiet := fs.Bool("q", false, "不输出进度, 只输出错误")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("at least one file id is required")
+	}
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	c, err := cf.client(*jobs)
+	if err != nil {
+		return err
+	}
+	info, statErr := os.Stat(*out)
+	toDir := statErr == nil && info.IsDir() || strings.HasSuffix(*out, string(os.PathSeparator))
+	if len(ids) > 1 && !toDir {
+		return errors.New("-o must be a directory when downloading more than one file")
+	}
+	if !toDir {
+		p := newProgress(true)
+		if *out == "-" {
+			_, err = download(c, ids[0], os.Stdout, nil, p.tracker())
+			return err
+		}
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		_, err = download(c, ids[0], f, resetFile(f), p.tracker())
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		return err
+	}
+
+	err = os.MkdirAll(*out, 0755)
+	if err != nil {
+		return err
+	}
+	d := &downloadDir{dir: *out, names: make(map[string]bool)}
+	p := newProgress(*quiet)
+	p.start(len(ids), 0)
+	parallel(*jobs, len(ids), func(i int) {
+		path, err := d.download(c, ids[i], p.tracker())
+		if err == nil && !*quiet {
+			fmt.Println(path)
+		}
+		p.finish(strconv.FormatUint(ids[i], 10), err)
+	})
+	p.close()
+	return failed(p.failed, len(ids), "downloads")
+}
+
+// resetFile 清空 f, 用于下载过程中文件被替换时重新下载
+func resetFile(f *os.File) func() error {
+	return func() error {
+		err := f.Truncate(0)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		return err
+	}
+}
+
+// downloadDir 把文件下载到目录中, 文件名为上传时的文件名, 没有文件名或重名时加上 id
+type downloadDir struct {
+	dir   string
+	lock  sync.Mutex
+	names map[string]bool
+}
+
+func (d *downloadDir) download(c *client.Client, id uint64, t *tracker) (path string, err error) {
+	f, err := os.CreateTemp(d.dir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	filename, err := download(c, id, f, resetFile(f), t)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(filename)
+	d.lock.Lock()
+	if name == "." || name == string(os.PathSeparator) || d.names[name] {
+		name = strings.TrimSuffix(strconv.FormatUint(id, 10)+"_"+name, "_.")
+	}
+	d.names[name] = true
+	d.lock.Unlock()
+	path = filepath.Join(d.dir, name)
+	return path, os.Rename(f.Name(), path)
+}
+
+func runRm(args []string) error {
+	fs := newFlagSet("rm", "[flags] <id>...")
+	cf := newClientFlags(fs)
+	asJSON := fs.Bool("json", false, "以 JSON 输出每个 id 的结果")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("at least one file id is required")
+	}
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	c, err := cf.client(1)
+	if err != nil {
+		return err
+	}
+	errs, err := c.BatchDelete(context.Background(), ids)
+	if err != nil {
+		return err
+	}
+	results := make([]api.BatchDeleteResult, len(ids))
+	count := 0
+	for i, id := range ids {
+		results[i] = api.BatchDeleteResult{ID: strconv.FormatUint(id, 10), Error: apiError(errs[i])}
+		if errs[i] != nil {
+			count++
+			if !*asJSON {
+				fmt.Fprintf(os.Stderr, "%d: %s\n", id, results[i].Error.Message)
+			}
+		} else if !*asJSON {
+			fmt.Println(id)
+		}
+	}
+	if *asJSON {
+		err = printJSON(os.Stdout, results)
+		if err != nil {
+			return err
+		}
+	}
+	return failed(count, len(ids), "deletes")
+}
+
+func printStat(w io.Writer, s *api.FileStat) {
+	fmt.Fprintf(w, "id:           %s\n", s.ID)
+	if s.FileInfo == nil {
+		fmt.Fprintf(w, "error:        %s\n", s.Error.Message)
+		return
+	}
+	state := "exists"
+	switch {
+	case s.Deleted:
+		state = "deleted"
+	case s.Expired:
+		state = "expired"
+	}
+	fmt.Fprintf(w, "state:        %s\n", state)
+	fmt.Fprintf(w, "size:         %d (%s)\n", s.Size, humanSize(s.Size))
+	fmt.Fprintf(w, "filename:     %s\n", s.Filename)
+	fmt.Fprintf(w, "content type: %s\n", s.ContentType)
+	fmt.Fprintf(w, "checksum:     %d\n", s.Checksum)
+	fmt.Fprintf(w, "created at:   %s\n", s.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "updated at:   %s\n", s.UpdatedAt.Format(time.RFC3339))
+	if s.ExpiresAt != nil {
+		fmt.Fprintf(w, "expires at:   %s\n", s.ExpiresAt.Format(time.RFC3339))
+	}
+	if s.Width != 0 {
+		fmt.Fprintf(w, "image:        %dx%d %s\n", s.Width, s.Height, s.Format)
+	}
+	if s.Error != nil {
+		fmt.Fprintf(w, "error:        %s\n", s.Error.Message)
+	}
+}
+
+func runStat(args []string) error {
+	fs := newFlagSet("stat", "[flags] <id>...")
+	cf := newClientFlags(fs)
+	asJSON := fs.Bool("json", false, "以 JSON 输出")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("at least one file id is required")
+	}
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	c, err := cf.client(1)
+	if err != nil {
+		return err
+	}
+	results, err := c.BatchStat(context.Background(), ids)
+	if err != nil {
+		return err
+	}
+	stats := make([]api.FileStat, len(ids))
+	count := 0
+	for i, res := range results {
+		stats[i] = fileStat(ids[i], res.Stat, res.Err)
+		if !stats[i].Exists {
+			count++
+		}
+		if !*asJSON {
+			if i > 0 {
+				fmt.Println()
+			}
+			printStat(os.Stdout, &stats[i])
+		}
+	}
+	if *asJSON {
+		err = printJSON(os.Stdout, stats)
+		if err != nil {
+			return err
+		}
+	}
+	if count > 0 {
+		return fmt.Errorf("%d of %d files do not exist", count, len(ids))
+	}
+	return nil
+}
+
+// parseTime 解析 RFC 3339 格式或 2006-01-02 格式 (本地时间) 的时间
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.ParseInLocation(time.DateOnly, s, time.Local)
+	}
+	if err != nil {
+		return t, fmt.Errorf("Wrong time %q, use RFC 3339 or 2006-01-02", s)
+	}
+	return t, nil
+}
+
+func runLs(args []string) error {
+	fs := newFlagSet("ls", "[flags]")
+	cf := newClientFlags(fs)
+	filename := fs.String("filename", "", "只列出这个文件名的文件")
+	ext := fs.String("ext", "", "只列出这个扩展名的文件, 不带点")
+	after := fs.String("after", "", "只列出这个时间及之后上传的文件")
+	before := fs.String("before", "", "只列出这个时间之前上传的文件")
+	limit := fs.Int("n", 0, "最多列出的文件数, 0 表示不限制")
+	all := fs.Bool("all", false, "同样列出已删除和已过期的文件")
+	asJSON := fs.Bool("json", false, "以 JSON 输出")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	q := &client.Query{Query: core.Query{Filename: *filename, Ext: strings.TrimPrefix(*ext, ".")}, All: *all}
+	if *after != "" {
+		q.CreatedAfter, err = parseTime(*after)
+		if err != nil {
+			return err
+		}
+	}
+	if *before != "" {
+		q.CreatedBefore, err = parseTime(*before)
+		if err != nil {
+			return err
+		}
+	}
+	c, err := cf.client(1)
+	if err != nil {
+		return err
+	}
+
+	files := []api.FileStat{}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for count := 0; *limit <= 0 || count < *limit; {
+		n := api.MaxBatchSize
+		if *limit > 0 {
+			n = min(n, *limit-count)
+		}
+		q.Limit = n
+		stats, cursor, err := c.List(context.Background(), q)
+		if err != nil {
+			return err
+		}
+		for _, s := range stats[:min(len(stats), n)] {
+			count++
+			f := fileStat(s.ID, s, nil)
+			if *asJSON {
+				files = append(files, f)
+				continue
+			}
+			size := humanSize(f.Size)
+			if f.Deleted {
+				size = "deleted"
+			} else if f.Expired {
+				size = "expired"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.ID, size, f.CreatedAt.Local().Format(time.DateTime), f.Filename)
+		}
+		if cursor == "" {
+			break
+		}
+		q.Cursor = cursor
+	}
+	if *asJSON {
+		return printJSON(os.Stdout, files)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+)
+
+var indexCommands = []command{
+	{"rebuild", "从 Volume 文件中的 needle header 重建 index", runIndexRebuild},
+	{"migrate", "把 index 复制到另一种后端", runIndexMigrate},
+	{"upgrade", "把版本 1 格式的 Volume 文件和 index 转换成当前格式", runIndexUpgrade},
+}
+
+func runIndexRebuild(args []string) error {
+	fs := newFlagSet("index rebuild", "[flags]")
+	vf := newVolumeFlags(fs, false)
+	partial := fs.Bool("partial", false, "Volume 文件中有损坏的 header 时, 仍然使用在它之前读出的 needle")
+	err := fs.Parse(args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	indexes, err := core.ParseIndexFlag(vf.indexes)
+	if err != nil {
+		return err
+	}
+	path, err := vf.dataFile(vf.id)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 先在临时目录中建好新的 index, 成功后再替换掉原来的
+	dir := vf.volumeDir(vf.id)
+	typ := vf.directoryType(dir)
+	tmp := filepath.Join(dir, "index-rebuild.tmp")
+	err = os.RemoveAll(tmp)
+	if err == nil {
+		err = os.Mkdir(tmp, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	d, err := core.OpenDirectory(typ, tmp, indexes)
+	if err != nil {
+		return err
+	}
+	count, err := core.RebuildDirectory(file, d)
+	if errors.Is(err, core.ErrCorruptNeedle) && *partial {
+		fmt.Fprintf(os.Stderr, "volume %d: %v, needles after it are lost\n", vf.id, err)
+		err = nil
+	}
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	old := core.DirectoryPath(typ, dir)
+	backup := ""
+	if _, err := os.Stat(old); err == nil {
+		backup = old + ".bak-" + time.Now().Format("20060102150405")
+		err = os.Rename(old, backup)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(core.DirectoryPath(typ, tmp), old)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("volume %d: rebuilt %s index with %d needles\n", vf.id, typ, count)
+	if backup != "" {
+		fmt.Printf("volume %d: old index moved to %s\n", vf.id, backup)
+	}
+	return nil
+}
+
+func runIndexMigrate(args []string) error {
+	fs := newFlagSet("index migrate", "-to bolt [flags]")
+	vf := newVolumeFlags(fs, false)
+	to := fs.String("to", "", "目标后端: leveldb, bolt, pebble")
+	out := fs.String("out", "", "新 index 的目录, 默认与 Volume 相同")
+	err := fs.Parse(args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	if *to == "" {
+		fs.Usage()
+		return errors.New("-to is required")
+	}
+	indexes, err := core.ParseIndexFlag(vf.indexes)
+	if err != nil {
+		return err
+	}
+	dir := vf.volumeDir(vf.id)
+	from := vf.directoryType(dir)
+	if *out == "" {
+		*out = dir
+	}
+	if from == *to && *out == dir {
+		return errors.New("source and destination are the same")
+	}
+	count, err := migrateIndex(dir, from, *out, *to, indexes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("volume %d: migrated %d needles from %s to %s\n", vf.id, count, from, *to)
+	if *out == dir {
+		fmt.Printf("set directory: %s in the config and remove %s before starting the server\n", *to, core.DirectoryPath(from, dir))
+	}
+	return nil
+}
+
+func migrateIndex(dir, from, out, to string, indexes core.IndexFlag) (count int, err error) {
+	src, err := core.OpenDirectory(from, dir, indexes)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := core.OpenDirectory(to, out, indexes)
+	if err != nil {
+		return 0, err
+	}
+	count, err = core.MigrateDirectory(src, dst)
+	if err != nil {
+		dst.Close()
+		return
+	}
+	return count, dst.Close()
+}
+
+func runIndexUpgrade(args []string) error {
+	fs := newFlagSet("index upgrade", "[flags]")
+	vf := newVolumeFlags(fs, false)
+	err := fs.Parse(args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	indexes, err := core.ParseIndexFlag(vf.indexes)
+	if err != nil {
+		return err
+	}
+	path, err := vf.dataFile(vf.id)
+	if err != nil {
+		return err
+	}
+	// 版本 1 只有 leveldb, 新的 index 使用 -directory 指定的后端
+	dir := vf.volumeDir(vf.id)
+	typ := vf.directory
+	if typ == "" {
+		typ = core.DirectoryLeveldb
+	}
+	tmp := filepath.Join(dir, "upgrade.tmp")
+	err = os.RemoveAll(tmp)
+	if err == nil {
+		err = os.Mkdir(tmp, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	count, err := core.UpgradeVolume(dir, vf.id, tmp, typ, indexes)
+	if err != nil {
+		return err
+	}
+
+	suffix := ".v1.bak-" + time.Now().Format("20060102150405")
+	oldIndex := core.DirectoryPath(core.DirectoryLeveldb, dir)
+	for _, p := range []string{path, oldIndex} {
+		err = os.Rename(p, p+suffix)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(filepath.Join(tmp, filepath.Base(path)), path)
+	if err == nil {
+		err = os.Rename(core.DirectoryPath(typ, tmp), core.DirectoryPath(typ, dir))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("volume %d: upgraded %d needles to format version %d with %s index\n", vf.id, count, core.FormatVersion, typ)
+	fmt.Printf("volume %d: old files moved to %s and %s\n", vf.id, path+suffix, oldIndex+suffix)
+	return nil
+}
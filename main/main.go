@@ -1,8 +1,134 @@
+// simplefs 命令行. 用法:
+//
+//	simplefs server [-config simplefs.yaml] [flags]
+//	simplefs volume inspect|verify|compact|export [flags]
+//	simplefs index rebuild|migrate|upgrade [flags]
+//	simplefs needle cat|dump [flags] [id]
+//	simplefs put|get|rm|stat|ls|sync [flags] [args]
+//
+// volume, index 和 needle 直接读写数据目录, 需要先停止 server.
+// put, get, rm, stat, ls 和 sync 通过 HTTP API 访问 -server 指定的服务端.
+// 每个子命令的参数见 simplefs <command> -h
 package main
 
-import "simplefs/api"
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// command 一个子命令, run 返回 flag.ErrHelp 表示已经打印了帮助
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"server", "启动 HTTP 服务", runServer},
+	{"volume", "离线检查, 压缩和导出 Volume", group("volume", volumeCommands)},
+	{"index", "离线重建, 迁移和升级 index", group("index", indexCommands)},
+	{"needle", "离线读取 needle 的内容和 header", group("needle", needleCommands)},
+}
+
+func init() {
+	commands = append(commands, clientCommands...)
+}
+
+func printUsage(prefix string, cmds []command) {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", prefix)
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+}
+
+// runCommand 执行 args[0] 对应的子命令, 返回的错误带上子命令的名字
+func runCommand(prefix string, cmds []command, args []string) error {
+	if len(args) == 0 {
+		printUsage(prefix, cmds)
+		return errors.New("missing command")
+	}
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		printUsage(prefix, cmds)
+		return flag.ErrHelp
+	}
+	for _, c := range cmds {
+		if c.name != args[0] {
+			continue
+		}
+		err := c.run(args[1:])
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			err = fmt.Errorf("%s: %w", c.name, err)
+		}
+		return err
+	}
+	printUsage(prefix, cmds)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// group 有子命令的命令
+func group(name string, cmds []command) func(args []string) error {
+	return func(args []string) error {
+		return runCommand("simplefs "+name, cmds, args)
+	}
+}
+
+// parseArgs 解析 args, 允许参数出现在位置参数之后, 返回所有的位置参数
+func parseArgs(fs *flag.FlagSet, args []string) (positional []string, err error) {
+	for {
+		err = fs.Parse(args)
+		if err != nil || fs.NArg() == 0 {
+			return
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
 
 func main() {
-	s := api.NewServer(8008, "")
-	s.Run()
+	err := runCommand("simplefs", commands, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simplefs %s\n", err)
+		if errors.Is(err, core.ErrFormatVersion) {
+			fmt.Fprintln(os.Stderr, "stop the server and run simplefs index upgrade to convert version 1 volumes")
+		}
+		os.Exit(1)
+	}
+}
+
+// runServer 按配置启动服务, 直到收到 SIGINT 或 SIGTERM
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("simplefs server", flag.ContinueOnError)
+	conf, printConfig, err := LoadConfig(fs, args, os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	if printConfig {
+		return conf.Print(os.Stdout)
+	}
+	s, err := conf.NewServer()
+	if err != nil {
+		return err
+	}
+	log.Printf("simplefs listening on %s, data in %s", conf.Listen, s.Volume.Path)
+	return s.Run()
+}
+
+// newFlagSet 子命令的 FlagSet, usage 是参数之外的用法说明
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet("simplefs "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: simplefs %s\n\n", strings.TrimSpace(name+" "+usage))
+		fs.PrintDefaults()
+	}
+	return fs
 }
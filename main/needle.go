@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+)
+
+var needleCommands = []command{
+	{"cat", "输出 needle 的内容, 大文件会拼接所有的 chunk", runNeedleCat},
+	{"dump", "显示 needle 的 header, 可以直接按 offset 读取, 不需要 index", runNeedleDump},
+}
+
+func parseID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("Wrong needle id %q", s)
+	}
+	return id, nil
+}
+
+func runNeedleCat(args []string) error {
+	fs := newFlagSet("needle cat", "[flags] <id>")
+	vf := newVolumeFlags(fs, false)
+	out := fs.String("o", "-", "输出的文件, - 表示标准输出")
+	raw := fs.Bool("raw", false, "大文件只输出 Manifest 本身")
+	force := fs.Bool("f", false, "同样输出已删除和已过期的 needle")
+	ids, err := parseArgs(fs, args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		fs.Usage()
+		return errors.New("one needle id is required")
+	}
+	id, err := parseID(ids[0])
+	if err != nil {
+		return err
+	}
+	m, err := vf.openManager()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	v, err := m.GetVolume(vf.id)
+	if err != nil {
+		return fmt.Errorf("volume %d: %w", vf.id, err)
+	}
+	n, err := v.GetNeedle(id)
+	if err != nil && *force && (errors.Is(err, core.ErrDeleted) || errors.Is(err, core.ErrExpired)) {
+		n, err = v.Directory.Get(id)
+		if err == nil {
+			n.File = v.File
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("needle %d: %w", id, err)
+	}
+	defer n.Close()
+	var r io.Reader = n.Section()
+	if n.IsManifest() && !*raw {
+		data, err := io.ReadAll(n.Section())
+		if err != nil {
+			return err
+		}
+		manifest, err := core.UnmarshalManifest(data)
+		if err != nil {
+			return fmt.Errorf("needle %d: %w", id, err)
+		}
+		cr, err := m.OpenManifest(manifest)
+		if err != nil {
+			return fmt.Errorf("needle %d: %w", id, err)
+		}
+		defer cr.Close()
+		r = io.NewSectionReader(cr, 0, cr.Size())
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// needleDump needle dump 的输出
+type needleDump struct {
+	needleInfo
+	Next       uint64      `json:"next"`            // 下一个 needle 的 offset
+	Index      *needleInfo `json:"index,omitempty"` // 与 header 不同时, index 中的记录
+	IndexError string      `json:"index_error,omitempty"`
+}
+
+func (d *needleDump) print(w io.Writer) {
+	n := d.needleInfo
+	fmt.Fprintf(w, "id:           %d\n", n.ID)
+	fmt.Fprintf(w, "offset:       %d\n", n.Offset)
+	fmt.Fprintf(w, "size:         %d (header %d)\n", n.Size, n.HeaderSize)
+	fmt.Fprintf(w, "next:         %d\n", d.Next)
+	fmt.Fprintf(w, "checksum:     %d\n", n.Checksum)
+	fmt.Fprintf(w, "flags:        %s\n", n.flags())
+	fmt.Fprintf(w, "filename:     %s\n", n.Filename)
+	fmt.Fprintf(w, "content type: %s\n", n.ContentType)
+	fmt.Fprintf(w, "created at:   %s\n", n.CreatedAt.Format(time.RFC3339))
+	if n.ExpiresAt != nil {
+		fmt.Fprintf(w, "expires at:   %s\n", n.ExpiresAt.Format(time.RFC3339))
+	}
+	if n.Parent != 0 {
+		fmt.Fprintf(w, "parent:       %d\n", n.Parent)
+	}
+	if n.Width != 0 || n.Height != 0 {
+		fmt.Fprintf(w, "image:        %dx%d\n", n.Width, n.Height)
+	}
+	if d.IndexError != "" {
+		fmt.Fprintf(w, "index:        %s\n", d.IndexError)
+	} else if d.Index != nil {
+		fmt.Fprintf(w, "index:        differs, offset %d, size %d, checksum %d, flags %s\n",
+			d.Index.Offset, d.Index.Size, d.Index.Checksum, d.Index.flags())
+	}
+}
+
+func runNeedleDump(args []string) error {
+	fs := newFlagSet("needle dump", "[flags] <id> | -offset <offset>")
+	vf := newVolumeFlags(fs, false)
+	offset := fs.Uint64("offset", 0, "直接读取 Volume 文件中这个位置的 header, 不打开 index")
+	body := fs.Int("body", 0, "以十六进制输出正文开头的字节数")
+	asJSON := fs.Bool("json", false, "以 JSON 输出")
+	ids, err := parseArgs(fs, args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	if (*offset == 0) == (len(ids) == 0) || len(ids) > 1 {
+		fs.Usage()
+		return errors.New("either a needle id or -offset is required")
+	}
+	path, err := vf.dataFile(vf.id)
+	if err != nil {
+		return err
+	}
+	dump := new(needleDump)
+	if *offset == 0 {
+		id, err := parseID(ids[0])
+		if err != nil {
+			return err
+		}
+		v, err := vf.open(vf.id)
+		if err != nil {
+			return err
+		}
+		indexed, err := v.Directory.Get(id)
+		v.Close()
+		if err != nil {
+			return fmt.Errorf("needle %d: %w", id, err)
+		}
+		*offset = indexed.Offset
+		info := newNeedleInfo(indexed)
+		dump.Index = &info
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := core.ReadNeedleHeader(file, *offset)
+	if err != nil {
+		return fmt.Errorf("offset %d: %w", *offset, err)
+	}
+	dump.needleInfo = newNeedleInfo(n)
+	dump.Next = n.Offset + n.HeaderSize() + n.Size
+	if dump.Index != nil {
+		i := dump.Index
+		if i.ID == n.ID && i.Offset == n.Offset && i.Size == n.Size && i.Checksum == n.Checksum && i.Deleted == n.Deleted() {
+			dump.Index = nil
+		}
+	} else if v, err := vf.open(vf.id); err != nil {
+		dump.IndexError = err.Error()
+	} else {
+		indexed, err := v.Directory.Get(n.ID)
+		v.Close()
+		switch {
+		case err != nil:
+			dump.IndexError = err.Error()
+		case indexed.Offset != n.Offset:
+			dump.IndexError = fmt.Sprintf("replaced by the needle at offset %d", indexed.Offset)
+		}
+	}
+	if *asJSON {
+		return printJSON(os.Stdout, dump)
+	}
+	dump.print(os.Stdout)
+	if *body > 0 {
+		b := make([]byte, *body)
+		if uint64(len(b)) > n.Size {
+			b = b[:n.Size]
+		}
+		_, err = file.ReadAt(b, int64(n.Offset+n.HeaderSize()))
+		if err != nil {
+			return err
+		}
+		fmt.Print(hex.Dump(b))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progress 在标准错误上报告传输的进度. 标准错误是终端时每秒刷新一行汇总,
+// 否则每个文件完成时输出一行. 出错的文件总是单独输出一行.
+type progress struct {
+	w     io.Writer
+	quiet bool // 只输出错误
+	tty   bool
+
+	lock   sync.Mutex
+	files  int   // 文件总数
+	done   int   // 完成的文件数, 包括失败的
+	failed int   // 失败的文件数
+	total  int64 // 字节总数, 未知时为 0
+	bytes  int64 // 已经传输的字节数
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newProgress(quiet bool) *progress {
+	p := &progress{w: os.Stderr, quiet: quiet}
+	if info, err := os.Stderr.Stat(); err == nil {
+		p.tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	return p
+}
+
+// start 开始传输 files 个文件, 共 total 字节
+func (p *progress) start(files int, total int64) {
+	p.files, p.total = files, total
+	if p.quiet || !p.tty {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.lock.Lock()
+				p.printLine()
+				p.lock.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *progress) printLine() {
+	fmt.Fprintf(p.w, "\r\033[K%d/%d files, %s", p.done, p.files, humanSize(uint64(p.bytes)))
+	if p.total > 0 {
+		fmt.Fprintf(p.w, "/%s (%d%%)", humanSize(uint64(p.total)), p.bytes*100/p.total)
+	}
+	if p.failed > 0 {
+		fmt.Fprintf(p.w, ", %d failed", p.failed)
+	}
+}
+
+// finish 一个文件传输完成, err 不为 nil 表示失败
+func (p *progress) finish(name string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done++
+	if err != nil {
+		p.failed++
+	}
+	switch {
+	case err != nil && p.tty && !p.quiet:
+		fmt.Fprintf(p.w, "\r\033[K%s: %v\n", name, err)
+	case err != nil:
+		fmt.Fprintf(p.w, "%s: %v\n", name, err)
+	case !p.quiet && !p.tty:
+		fmt.Fprintf(p.w, "[%d/%d] %s\n", p.done, p.files, name)
+	}
+}
+
+// close 停止刷新, 输出最后的汇总
+func (p *progress) close() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.printLine()
+	fmt.Fprintln(p.w)
+}
+
+// tracker 返回一个文件的计数器
+func (p *progress) tracker() *tracker {
+	return &tracker{p: p}
+}
+
+// tracker 记录一个文件已经传输的字节数, 重试时用 reset 回退
+type tracker struct {
+	p *progress
+	n int64
+}
+
+func (t *tracker) Write(b []byte) (int, error) {
+	t.add(int64(len(b)))
+	return len(b), nil
+}
+
+func (t *tracker) add(n int64) {
+	if t == nil {
+		return
+	}
+	t.p.lock.Lock()
+	t.n += n
+	t.p.bytes += n
+	t.p.lock.Unlock()
+}
+
+// reset 把这个文件已经传输的字节数设为 n
+func (t *tracker) reset(n int64) {
+	if t == nil {
+		return
+	}
+	t.p.lock.Lock()
+	t.p.bytes += n - t.n
+	t.n = n
+	t.p.lock.Unlock()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// syncStateFile sync 默认在目录中记录状态的文件, 同步时跳过
+const syncStateFile = ".simplefs-sync.json"
+
+// syncState sync 的状态, 记录每个本地文件上次上传的 id, 大小和修改时间
+type syncState struct {
+	Server string                `json:"server"`
+	Files  map[string]*syncEntry `json:"files"` // key 是相对于目录的路径, 用 / 分隔
+}
+
+type syncEntry struct {
+	ID      uint64    `json:"id,string"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func loadSyncState(path string) (state *syncState, err error) {
+	state = &syncState{Files: make(map[string]*syncEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*syncEntry)
+	}
+	return state, nil
+}
+
+// save 先写到临时文件再替换, 中断时不会留下不完整的状态
+func (s *syncState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	return err
+}
+
+// syncResult sync 对一个文件的操作
+type syncResult struct {
+	Path   string `json:"path"`
+	Action string `json:"action"` // upload, update 或 delete
+	ID     uint64 `json:"id,string,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	file *localFile
+}
+
+// planSync 比较本地文件和 state, 返回需要执行的操作和没有变化的文件数.
+// missing 是服务端已经不存在的 id, 对应的文件重新上传.
+func planSync(files map[string]*localFile, state *syncState, missing map[uint64]bool, del bool) (plan []*syncResult, unchanged int) {
+	for rel, f := range files {
+		entry := state.Files[rel]
+		switch {
+		case entry == nil || missing[entry.ID]:
+			plan = append(plan, &syncResult{Path: rel, Action: "upload", file: f})
+		case entry.Size != f.info.Size() || !entry.ModTime.Equal(f.info.ModTime()):
+			plan = append(plan, &syncResult{Path: rel, Action: "update", ID: entry.ID, file: f})
+		default:
+			unchanged++
+		}
+	}
+	if del {
+		for rel, entry := range state.Files {
+			if files[rel] == nil {
+				plan = append(plan, &syncResult{Path: rel, Action: "delete", ID: entry.ID})
+			}
+		}
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Path < plan[j].Path })
+	return
+}
+
+func runSync(args []string) error {
+	fs := newFlagSet("sync", "[flags] <dir>")
+	cf := newClientFlags(fs)
+	opt := newUploadOptions(fs)
+	statePath := fs.String("state", "", "状态文件, 默认为 <dir>/"+syncStateFile)
+	del := fs.Bool("delete", false, "删除服务端上对应的本地文件已经不存在的文件")
+	dryRun := fs.Bool("dry-run", false, "只输出要执行的操作")
+	jobs := fs.Int("j", 4, "同时上传的文件数")
+	asJSON := fs.Bool("json", false, "以 JSON 输出每个操作的结果")
+	quiet := fs.Bool("q", false, "不输出进度, 只输出错误")
+	dirs, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(dirs) != 1 {
+		fs.Usage()
+		return errors.New("one directory is required")
+	}
+	dir := dirs[0]
+	if *statePath == "" {
+		*statePath = filepath.Join(dir, syncStateFile)
+	}
+	state, err := loadSyncState(*statePath)
+	if err != nil {
+		return err
+	}
+	if state.Server != cf.server && len(state.Files) > 0 {
+		fmt.Fprintf(os.Stderr, "%s was synced to %s, uploading all files again\n", dir, state.Server)
+		state.Files = make(map[string]*syncEntry)
+	}
+	state.Server = cf.server
+
+	files := make(map[string]*localFile)
+	skip, _ := filepath.Abs(*statePath)
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if abs, _ := filepath.Abs(path); abs == skip || abs == skip+".tmp" {
+			return nil
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = &localFile{path, info}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c, err := cf.client(*jobs)
+	if err != nil {
+		return err
+	}
+	// 服务端上已经删除或过期的文件需要重新上传
+	ids := make([]uint64, 0, len(state.Files))
+	for _, entry := range state.Files {
+		ids = append(ids, entry.ID)
+	}
+	stats, err := c.BatchStat(context.Background(), ids)
+	if err != nil {
+		return err
+	}
+	missing := make(map[uint64]bool)
+	for i, s := range stats {
+		if s.Stat == nil || !s.Exists {
+			missing[ids[i]] = true
+		}
+	}
+	plan, unchanged := planSync(files, state, missing, *del)
+	if *dryRun {
+		for _, res := range plan {
+			fmt.Printf("%s\t%s\n", res.Action, res.Path)
+		}
+		return nil
+	}
+
+	var uploads, deletes []*syncResult
+	var total int64
+	for _, res := range plan {
+		if res.Action == "delete" {
+			deletes = append(deletes, res)
+		} else {
+			uploads = append(uploads, res)
+			total += res.file.info.Size()
+		}
+	}
+	p := newProgress(*quiet)
+	p.start(len(uploads), total)
+	// 要删除的 id 和对应的操作. 大文件更新时上传成了新文件, 旧的 id 也要删除, 这时操作为 nil
+	removes := make(map[uint64]*syncResult)
+	var lock sync.Mutex
+	parallel(*jobs, len(uploads), func(i int) {
+		res := uploads[i]
+		id := res.ID
+		if res.file.info.Size() > int64(opt.resumable) {
+			id = 0
+		}
+		up, err := upload(c, res.file.path, res.file.info.Name(), id, opt, p.tracker())
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			if res.ID != 0 && up.ID != res.ID {
+				lock.Lock()
+				removes[res.ID] = nil
+				lock.Unlock()
+			}
+			res.ID = up.ID
+		}
+		p.finish(res.Path, err)
+	})
+	p.close()
+	for _, res := range deletes {
+		removes[res.ID] = res
+	}
+	if len(removes) > 0 {
+		ids := make([]uint64, 0, len(removes))
+		for id := range removes {
+			ids = append(ids, id)
+		}
+		errs, err := c.BatchDelete(context.Background(), ids)
+		for i, id := range ids {
+			msg := ""
+			if err != nil {
+				msg = err.Error()
+			} else if errs[i] != nil && !errors.Is(errs[i], core.ErrNeedleNotFound) {
+				// 已经不存在的文件也算删除成功
+				msg = errs[i].Error()
+			}
+			if res := removes[id]; res != nil {
+				res.Error = msg
+			} else if msg != "" {
+				fmt.Fprintf(os.Stderr, "failed to delete the old version %d: %s\n", id, msg)
+			}
+		}
+	}
+
+	// 只记录成功的操作, 失败的文件下次再同步
+	count := 0
+	for _, res := range plan {
+		switch {
+		case res.Error != "":
+			count++
+		case res.Action == "delete":
+			delete(state.Files, res.Path)
+		default:
+			state.Files[res.Path] = &syncEntry{ID: res.ID, Size: res.file.info.Size(), ModTime: res.file.info.ModTime()}
+		}
+	}
+	err = state.save(*statePath)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		err = printJSON(os.Stdout, plan)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, res := range plan {
+			if res.Error == "" {
+				fmt.Printf("%s\t%d\t%s\n", res.Action, res.ID, res.Path)
+			} else if res.Action == "delete" {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", res.Path, res.Error)
+			}
+		}
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "%d changed, %d unchanged, %d failed\n", len(plan)-count, unchanged, count)
+	}
+	return failed(count, len(plan), "operations")
+}
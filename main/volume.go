@@ -0,0 +1,542 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hmli/simplefs/core"
+	"github.com/hmli/simplefs/manager"
+)
+
+var volumeCommands = []command{
+	{"inspect", "显示 Volume 的空间使用情况和其中的 needle", runVolumeInspect},
+	{"verify", "检查 index 与 Volume 文件是否一致, 正文的 checksum 是否正确", runVolumeVerify},
+	{"compact", "回收已删除和已过期的 needle 占用的空间", runVolumeCompact},
+	{"export", "把 Volume 中的文件导出为 tar", runVolumeExport},
+}
+
+// volumeFlags 离线命令定位和打开 Volume 的参数. 没有指定的参数取自 server 的配置文件和环境变量
+type volumeFlags struct {
+	config     string
+	dir        string
+	volumesDir string
+	directory  string
+	indexes    string
+	id         uint64
+	all        bool
+}
+
+// newVolumeFlags 注册参数, withAll 表示支持 -all 处理所有的 Volume
+func newVolumeFlags(fs *flag.FlagSet, withAll bool) *volumeFlags {
+	f := new(volumeFlags)
+	f.config, _ = os.LookupEnv(envPrefix + "CONFIG")
+	fs.StringVar(&f.config, "config", f.config, "server 的配置文件, 从中读取 dir, volumes_dir, directory 和 indexes")
+	fs.StringVar(&f.dir, "dir", "", "数据目录 (默认 "+DefaultConfig().Dir+")")
+	fs.StringVar(&f.volumesDir, "volumes-dir", "", "存放大文件 chunk 的 Volume 的目录, 默认为 dir/volumes")
+	fs.StringVar(&f.directory, "directory", "", "index 的后端: leveldb, bolt, pebble, 默认按目录中的文件判断")
+	fs.StringVar(&f.indexes, "indexes", "", "index 中维护的二级索引: filename, ext, created, all")
+	fs.Uint64Var(&f.id, "volume", 1, "Volume 的 id, 1 是 dir 中的主 Volume, 其它在 volumes-dir/<id> 中")
+	if withAll {
+		fs.BoolVar(&f.all, "all", false, "处理所有的 Volume")
+	}
+	return f
+}
+
+// resolve 在 Parse 之后用配置文件, 环境变量和默认值补全参数
+func (f *volumeFlags) resolve() error {
+	c := DefaultConfig()
+	if f.config != "" {
+		err := c.loadFile(f.config)
+		if err != nil {
+			return err
+		}
+	}
+	err := c.loadEnv(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	if f.dir == "" {
+		f.dir = c.Dir
+	}
+	if f.volumesDir == "" {
+		f.volumesDir = c.VolumesDir
+	}
+	if f.volumesDir == "" {
+		f.volumesDir = filepath.Join(f.dir, "volumes")
+	}
+	if f.directory == "" && f.config != "" {
+		f.directory = c.Directory
+	}
+	if f.indexes == "" {
+		f.indexes = c.Indexes
+	}
+	return nil
+}
+
+// volumeDir id 为 id 的 Volume 所在的目录, 与 api.NewServerWithOptions 和 manager.Manager 相同
+func (f *volumeFlags) volumeDir(id uint64) string {
+	if id == 1 {
+		return f.dir
+	}
+	return filepath.Join(f.volumesDir, strconv.FormatUint(id, 10))
+}
+
+// dataFile id 为 id 的 Volume 文件, 不存在时返回错误
+func (f *volumeFlags) dataFile(id uint64) (path string, err error) {
+	path = filepath.Join(f.volumeDir(id), strconv.FormatUint(id, 10)+".data")
+	_, err = os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("volume %d: %w", id, err)
+	}
+	return path, nil
+}
+
+// directoryType dir 中 index 的后端, 没有指定时按已有的文件判断
+func (f *volumeFlags) directoryType(dir string) string {
+	if f.directory != "" {
+		return f.directory
+	}
+	for _, typ := range []string{core.DirectoryLeveldb, core.DirectoryBolt, core.DirectoryPebble} {
+		if _, err := os.Stat(core.DirectoryPath(typ, dir)); err == nil {
+			return typ
+		}
+	}
+	return core.DirectoryLeveldb
+}
+
+func (f *volumeFlags) volumeConfig(dir string) (conf *core.VolumeConfig, err error) {
+	indexes, err := core.ParseIndexFlag(f.indexes)
+	if err != nil {
+		return nil, err
+	}
+	return &core.VolumeConfig{Directory: f.directoryType(dir), Indexes: indexes}, nil
+}
+
+// open 打开已经存在的 Volume
+func (f *volumeFlags) open(id uint64) (v *core.Volume, err error) {
+	_, err = f.dataFile(id)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := f.volumeConfig(f.volumeDir(id))
+	if err != nil {
+		return nil, err
+	}
+	v, err = core.NewVolumeWithConfig(id, f.volumeDir(id), conf)
+	if errors.Is(err, core.ErrFormatVersion) {
+		return nil, fmt.Errorf("volume %d: %w", id, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("volume %d: %w (is the server still running?)", id, err)
+	}
+	return v, nil
+}
+
+// ids 要处理的 Volume, -all 时为主 Volume 和 volumes-dir 中的所有 Volume
+func (f *volumeFlags) ids() (ids []uint64, err error) {
+	if !f.all {
+		return []uint64{f.id}, nil
+	}
+	ids = []uint64{1}
+	entries, err := os.ReadDir(f.volumesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		id, err := strconv.ParseUint(e.Name(), 10, 64)
+		if err == nil && e.IsDir() && id != 1 {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// eachVolume 依次打开 ids 中的 Volume 执行 fn
+func (f *volumeFlags) eachVolume(fn func(v *core.Volume) error) error {
+	ids, err := f.ids()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		v, err := f.open(id)
+		if err != nil {
+			return err
+		}
+		err = fn(v)
+		if e := v.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openManager 打开主 Volume 和 volumes-dir 中的所有 Volume, 用于读取跨 Volume 的大文件
+func (f *volumeFlags) openManager() (m *manager.Manager, err error) {
+	primary, err := f.open(1)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := f.volumeConfig(f.dir)
+	if err == nil {
+		m, err = manager.New(f.volumesDir, conf)
+	}
+	if err == nil {
+		err = m.AddVolume(primary)
+	}
+	if err != nil {
+		if m != nil {
+			m.Close()
+		}
+		primary.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// humanSize 方便阅读的大小, 比如 1.5MB
+func humanSize(size uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f, i := float64(size), 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// needleInfo needle 的 header, 用于输出
+type needleInfo struct {
+	ID          uint64     `json:"id,string"`
+	Offset      uint64     `json:"offset"`
+	Size        uint64     `json:"size"`
+	HeaderSize  uint64     `json:"header_size"`
+	Checksum    uint32     `json:"checksum"`
+	Filename    string     `json:"filename,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` // nil 表示永不过期
+	Deleted     bool       `json:"deleted,omitempty"`
+	Manifest    bool       `json:"manifest,omitempty"`
+	Parent      uint64     `json:"parent,omitempty,string"`
+	Width       uint32     `json:"width,omitempty"`
+	Height      uint32     `json:"height,omitempty"`
+}
+
+func newNeedleInfo(n *core.Needle) needleInfo {
+	info := needleInfo{
+		ID:          n.ID,
+		Offset:      n.Offset,
+		Size:        n.Size,
+		HeaderSize:  n.HeaderSize(),
+		Checksum:    n.Checksum,
+		Filename:    n.Filename,
+		ContentType: n.ContentType,
+		CreatedAt:   n.CreatedAt,
+		Deleted:     n.Deleted(),
+		Manifest:    n.IsManifest(),
+		Parent:      n.Parent,
+		Width:       n.Width,
+		Height:      n.Height,
+	}
+	if !n.ExpiresAt.IsZero() {
+		info.ExpiresAt = &n.ExpiresAt
+	}
+	return info
+}
+
+// flags 简短的状态, 用于列表
+func (n needleInfo) flags() string {
+	s := ""
+	if n.Deleted {
+		s += "D"
+	}
+	if n.ExpiresAt != nil && !time.Now().Before(*n.ExpiresAt) {
+		s += "E"
+	}
+	if n.Manifest {
+		s += "M"
+	}
+	if n.Parent != 0 {
+		s += "P"
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+// volumeInfo volume inspect 的输出
+type volumeInfo struct {
+	ID          uint64       `json:"id"`
+	File        string       `json:"file"`
+	Directory   string       `json:"directory"`
+	Capacity    uint64       `json:"capacity"`
+	FileSize    int64        `json:"file_size"`
+	Used        uint64       `json:"used"`
+	Live        uint64       `json:"live"`
+	Reclaimable uint64       `json:"reclaimable"`
+	Needles     int          `json:"needles"`
+	Deleted     int          `json:"deleted"`
+	Expired     int          `json:"expired"`
+	Manifests   int          `json:"manifests"`
+	List        []needleInfo `json:"list,omitempty"`
+}
+
+func inspectVolume(v *core.Volume, directory string, list bool) (info *volumeInfo, err error) {
+	stats, err := v.Stats()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := v.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info = &volumeInfo{
+		ID:          v.ID,
+		File:        v.File.Name(),
+		Directory:   directory,
+		Capacity:    v.Size,
+		FileSize:    fi.Size(),
+		Used:        stats.Used,
+		Live:        stats.Live,
+		Reclaimable: stats.Reclaimable(),
+		Needles:     stats.Needles,
+		Deleted:     stats.Deleted,
+		Expired:     stats.Expired,
+		Manifests:   stats.Manifests,
+	}
+	if !list {
+		return info, nil
+	}
+	iter := v.Directory.Iter(nil)
+	defer iter.Release()
+	for iter.Next() {
+		info.List = append(info.List, newNeedleInfo(iter.Needle()))
+	}
+	return info, iter.Err()
+}
+
+func (info *volumeInfo) print(w io.Writer) {
+	fmt.Fprintf(w, "volume %d: %s (%s index)\n", info.ID, info.File, info.Directory)
+	fmt.Fprintf(w, "  used:        %s of %s, file %s\n", humanSize(info.Used), humanSize(info.Capacity), humanSize(uint64(info.FileSize)))
+	fmt.Fprintf(w, "  needles:     %d (%d deleted, %d expired, %d manifests)\n", info.Needles, info.Deleted, info.Expired, info.Manifests)
+	fmt.Fprintf(w, "  live:        %s\n", humanSize(info.Live))
+	fmt.Fprintf(w, "  reclaimable: %s\n", humanSize(info.Reclaimable))
+	if len(info.List) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ID\tOFFSET\tSIZE\tFLAGS\tCREATED\tTYPE\tNAME")
+	for _, n := range info.List {
+		fmt.Fprintf(tw, "  %d\t%d\t%d\t%s\t%s\t%s\t%s\n", n.ID, n.Offset, n.Size, n.flags(),
+			n.CreatedAt.Format(time.RFC3339), n.ContentType, n.Filename)
+	}
+	tw.Flush()
+}
+
+func runVolumeInspect(args []string) error {
+	fs := newFlagSet("volume inspect", "[flags]")
+	vf := newVolumeFlags(fs, true)
+	list := fs.Bool("l", false, "列出所有的 needle, FLAGS 中 D 为已删除, E 为已过期, M 为 Manifest, P 为生成的 needle")
+	asJSON := fs.Bool("json", false, "以 JSON 输出")
+	err := fs.Parse(args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	var infos []*volumeInfo
+	err = vf.eachVolume(func(v *core.Volume) error {
+		info, err := inspectVolume(v, vf.directoryType(v.Path), *list)
+		if err != nil {
+			return err
+		}
+		if !*asJSON {
+			info.print(os.Stdout)
+		}
+		infos = append(infos, info)
+		return nil
+	})
+	if err != nil || !*asJSON {
+		return err
+	}
+	return printJSON(os.Stdout, infos)
+}
+
+func runVolumeVerify(args []string) error {
+	fs := newFlagSet("volume verify", "[flags]")
+	vf := newVolumeFlags(fs, true)
+	err := fs.Parse(args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	failed := 0
+	err = vf.eachVolume(func(v *core.Volume) error {
+		checked, problems, err := v.Verify()
+		if err != nil {
+			return err
+		}
+		errs := 0
+		for _, p := range problems {
+			if errors.Is(p.Err, core.ErrNotIndexed) {
+				fmt.Printf("volume %d: warning: %s, reclaimed by compact\n", v.ID, p)
+				continue
+			}
+			fmt.Printf("volume %d: %s\n", v.ID, p)
+			errs++
+		}
+		fmt.Printf("volume %d: checked %d needles, %d problems\n", v.ID, checked, errs)
+		failed += errs
+		return nil
+	})
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("found %d problems", failed)
+	}
+	return err
+}
+
+func runVolumeCompact(args []string) error {
+	fs := newFlagSet("volume compact", "[flags]")
+	vf := newVolumeFlags(fs, true)
+	err := fs.Parse(args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	return vf.eachVolume(func(v *core.Volume) error {
+		before := v.CurrentOffset
+		err := v.Fragment()
+		if err != nil {
+			return fmt.Errorf("volume %d: %w", v.ID, err)
+		}
+		fmt.Printf("volume %d: %s -> %s, reclaimed %s\n", v.ID,
+			humanSize(before), humanSize(v.CurrentOffset), humanSize(before-v.CurrentOffset))
+		return nil
+	})
+}
+
+func runVolumeExport(args []string) error {
+	fs := newFlagSet("volume export", "[flags]")
+	vf := newVolumeFlags(fs, false)
+	out := fs.String("o", "-", "输出的 tar 文件, - 表示标准输出")
+	err := fs.Parse(args)
+	if err == nil {
+		err = vf.resolve()
+	}
+	if err != nil {
+		return err
+	}
+	m, err := vf.openManager()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	v, err := m.GetVolume(vf.id)
+	if err != nil {
+		return fmt.Errorf("volume %d: %w", vf.id, err)
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := exportVolume(m, v, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d files from volume %d\n", count, v.ID)
+	return nil
+}
+
+// exportName needle 在 tar 中的文件名: id, 有原始文件名时加上 _文件名
+func exportName(n *core.Needle) string {
+	name := strconv.FormatUint(n.ID, 10)
+	if base := path.Base(n.Filename); n.Filename != "" && base != "." && base != "/" && base != ".." {
+		name += "_" + base
+	}
+	return name
+}
+
+// exportVolume 把 v 中未删除, 未过期的文件写成 tar, Manifest 还原成完整的大文件. 返回导出的文件数
+func exportVolume(m *manager.Manager, v *core.Volume, w io.Writer) (count int, err error) {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	iter := v.Directory.Iter(nil)
+	defer iter.Release()
+	for iter.Next() {
+		n := iter.Needle()
+		if n.Deleted() || n.Expired(now) {
+			continue
+		}
+		n.File = v.File
+		var r io.Reader = n.Section()
+		var closer io.Closer = n
+		size := int64(n.Size)
+		if n.IsManifest() {
+			// 直接读迭代到的 needle, 不在持有迭代器时再读 Directory
+			data, err := io.ReadAll(n.Section())
+			if err != nil {
+				return count, fmt.Errorf("needle %d: %w", n.ID, err)
+			}
+			manifest, err := core.UnmarshalManifest(data)
+			if err != nil {
+				return count, fmt.Errorf("needle %d: %w", n.ID, err)
+			}
+			cr, err := m.OpenManifest(manifest)
+			if err != nil {
+				return count, fmt.Errorf("needle %d: %w", n.ID, err)
+			}
+			r, size, closer = io.NewSectionReader(cr, 0, cr.Size()), cr.Size(), cr
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    exportName(n),
+			Mode:    0644,
+			Size:    size,
+			ModTime: n.UpdatedAt,
+		})
+		if err == nil {
+			_, err = io.Copy(tw, r)
+		}
+		closer.Close()
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err = iter.Err(); err != nil {
+		return count, err
+	}
+	return count, tw.Close()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"github.com/hmli/simplefs/core"
+	"github.com/hmli/simplefs/manager"
+	"github.com/hmli/simplefs/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// captureStdout 执行 fn, 返回它写到标准输出的内容
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	err = fn()
+	os.Stdout = stdout
+	w.Close()
+	return string(<-out), err
+}
+
+// newTestData 在临时目录中写入几个文件和一个大文件, 大文件的 3 个 chunk 在 Volume 2 中. 返回目录和大文件的 id
+func newTestData(t *testing.T) (dir string, big uint64, ids []uint64) {
+	dir = t.TempDir()
+	v, err := core.NewVolume(1, dir)
+	assert.NoError(t, err)
+	m, err := manager.New(filepath.Join(dir, "volumes"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.AddVolume(v))
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		id, err := v.NewFileWithOptions([]byte("data of "+name), name, &core.FileOptions{ContentType: "text/plain"})
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+	v2, err := m.NewVolume(2, filepath.Join(dir, "volumes", "2"))
+	assert.NoError(t, err)
+	manifest := &core.Manifest{Size: 10}
+	for offset, chunk := range []string{"0123", "4567", "89"} {
+		id, err := v2.NewFile([]byte(chunk), "")
+		assert.NoError(t, err)
+		manifest.Chunks = append(manifest.Chunks, core.Chunk{VolumeID: 2, ID: id, Offset: uint64(offset * 4), Size: uint64(len(chunk))})
+	}
+	data, err := core.MarshalManifest(manifest)
+	assert.NoError(t, err)
+	big, err = v.NewFileWithOptions(data, "big.bin", &core.FileOptions{Manifest: true})
+	assert.NoError(t, err)
+	assert.NoError(t, v.DelNeedle(ids[2]))
+	assert.NoError(t, m.Close())
+	return dir, big, ids
+}
+
+func TestVolumeInspect(t *testing.T) {
+	dir, _, ids := newTestData(t)
+	out, err := captureStdout(t, func() error {
+		return runVolumeInspect([]string{"-dir", dir, "-all", "-l"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "volume 1: ")
+	assert.Contains(t, out, "volume 2: ")
+	assert.Contains(t, out, "needles:     4 (1 deleted, 0 expired, 1 manifests)")
+	assert.Contains(t, out, strconv.FormatUint(ids[0], 10))
+	assert.Contains(t, out, "a.txt")
+
+	out, err = captureStdout(t, func() error {
+		return runVolumeInspect([]string{"-dir", dir, "-json"})
+	})
+	assert.NoError(t, err)
+	var infos []volumeInfo
+	assert.NoError(t, json.Unmarshal([]byte(out), &infos))
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "leveldb", infos[0].Directory)
+	assert.Equal(t, 1, infos[0].Deleted)
+	assert.Greater(t, infos[0].Reclaimable, uint64(0))
+
+	err = runVolumeInspect([]string{"-dir", dir, "-volume", "9"})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestVolumeVerifyCompact(t *testing.T) {
+	dir, _, ids := newTestData(t)
+	out, err := captureStdout(t, func() error {
+		return runVolumeVerify([]string{"-dir", dir, "-all"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "volume 1: checked 4 needles, 0 problems")
+
+	out, err = captureStdout(t, func() error {
+		return runVolumeCompact([]string{"-dir", dir})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "volume 1: ")
+	assert.Contains(t, out, "reclaimed")
+
+	// 损坏一个 needle 的正文
+	v, err := core.NewVolume(1, dir)
+	assert.NoError(t, err)
+	n, err := v.GetNeedle(ids[0])
+	assert.NoError(t, err)
+	_, err = v.File.WriteAt([]byte("X"), int64(n.Offset+n.HeaderSize()))
+	assert.NoError(t, err)
+	assert.NoError(t, v.Close())
+	out, err = captureStdout(t, func() error {
+		return runVolumeVerify([]string{"-dir", dir})
+	})
+	assert.ErrorContains(t, err, "found 1 problems")
+	assert.Contains(t, out, core.ErrWrongCheckSum.Error())
+}
+
+func TestVolumeExport(t *testing.T) {
+	dir, big, ids := newTestData(t)
+	out := filepath.Join(t.TempDir(), "out.tar")
+	assert.NoError(t, runVolumeExport([]string{"-dir", dir, "-o", out}))
+
+	f, err := os.Open(out)
+	assert.NoError(t, err)
+	defer f.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		files[h.Name] = string(b)
+	}
+	assert.Equal(t, map[string]string{
+		strconv.FormatUint(ids[0], 10) + "_a.txt": "data of a.txt",
+		strconv.FormatUint(ids[1], 10) + "_b.txt": "data of b.txt",
+		strconv.FormatUint(big, 10) + "_big.bin":  "0123456789",
+	}, files)
+}
+
+func TestIndexRebuild(t *testing.T) {
+	dir, big, ids := newTestData(t)
+	assert.NoError(t, os.RemoveAll(core.DirectoryPath(core.DirectoryLeveldb, dir)))
+	out, err := captureStdout(t, func() error {
+		return runIndexRebuild([]string{"-dir", dir})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "rebuilt leveldb index with 4 needles")
+
+	v, err := core.NewVolume(1, dir)
+	assert.NoError(t, err)
+	_, data, err := v.ReadFile(ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "data of b.txt", string(data))
+	_, err = v.GetNeedle(ids[2])
+	assert.ErrorIs(t, err, core.ErrDeleted)
+	n, err := v.GetNeedle(big)
+	assert.NoError(t, err)
+	assert.True(t, n.IsManifest())
+	assert.NoError(t, v.Close())
+
+	// 再次重建时保留原来的 index
+	out, err = captureStdout(t, func() error {
+		return runIndexRebuild([]string{"-dir", dir})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "old index moved to")
+	backups, err := filepath.Glob(core.DirectoryPath(core.DirectoryLeveldb, dir) + ".bak-*")
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+}
+
+func TestIndexMigrate(t *testing.T) {
+	dir, _, ids := newTestData(t)
+	out, err := captureStdout(t, func() error {
+		return runIndexMigrate([]string{"-dir", dir, "-to", "bolt"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "migrated 4 needles from leveldb to bolt")
+	assert.NoError(t, os.RemoveAll(core.DirectoryPath(core.DirectoryLeveldb, dir)))
+
+	out, err = captureStdout(t, func() error {
+		return runNeedleCat([]string{"-dir", dir, strconv.FormatUint(ids[0], 10)})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "data of a.txt", out)
+
+	assert.Error(t, runIndexMigrate([]string{"-dir", dir, "-to", "bolt"}))
+}
+
+func TestIndexUpgrade(t *testing.T) {
+	// 版本 1 的 Volume: 8 字节的 key, 44 字节的 header 加扩展名
+	dir := t.TempDir()
+	db, err := leveldb.OpenFile(core.DirectoryPath(core.DirectoryLeveldb, dir), nil)
+	assert.NoError(t, err)
+	header := make([]byte, 44, 47)
+	binary.BigEndian.PutUint64(header[0:8], 7)
+	binary.BigEndian.PutUint64(header[8:16], 4)
+	binary.BigEndian.PutUint64(header[16:24], core.InitIndexSize)
+	binary.BigEndian.PutUint32(header[24:28], utils.Checksum([]byte("data")))
+	header = append(header, "txt"...)
+	assert.NoError(t, db.Put(binary.BigEndian.AppendUint64(nil, 7), header, nil))
+	assert.NoError(t, db.Close())
+	file := binary.BigEndian.AppendUint64(nil, core.InitIndexSize+uint64(len(header))+4)
+	file = append(append(file, header...), "data"...)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "1.data"), file, 0666))
+
+	assert.ErrorIs(t, runNeedleCat([]string{"-dir", dir, "7"}), core.ErrFormatVersion)
+	out, err := captureStdout(t, func() error {
+		return runIndexUpgrade([]string{"-dir", dir})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "upgraded 1 needles to format version 2")
+	out, err = captureStdout(t, func() error {
+		return runNeedleCat([]string{"-dir", dir, "7"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "data", out)
+	backups, err := filepath.Glob(filepath.Join(dir, "*.v1.bak-*"))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+}
+
+func TestNeedleCat(t *testing.T) {
+	dir, big, ids := newTestData(t)
+	cat := func(args ...string) (string, error) {
+		return captureStdout(t, func() error {
+			return runNeedleCat(append([]string{"-dir", dir}, args...))
+		})
+	}
+	out, err := cat(strconv.FormatUint(big, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", out)
+	out, err = cat(strconv.FormatUint(big, 10), "-raw")
+	assert.NoError(t, err)
+	assert.Contains(t, out, `"chunks"`)
+
+	_, err = cat(strconv.FormatUint(ids[2], 10))
+	assert.ErrorIs(t, err, core.ErrDeleted)
+	out, err = cat("-f", strconv.FormatUint(ids[2], 10))
+	assert.NoError(t, err)
+	assert.Equal(t, "data of c.txt", out)
+
+	_, err = cat()
+	assert.Error(t, err)
+	_, err = cat("abc")
+	assert.Error(t, err)
+}
+
+func TestNeedleDump(t *testing.T) {
+	dir, _, ids := newTestData(t)
+	out, err := captureStdout(t, func() error {
+		return runNeedleDump([]string{"-dir", dir, "-json", strconv.FormatUint(ids[1], 10)})
+	})
+	assert.NoError(t, err)
+	var dump needleDump
+	assert.NoError(t, json.Unmarshal([]byte(out), &dump))
+	assert.Equal(t, ids[1], dump.ID)
+	assert.Equal(t, "b.txt", dump.Filename)
+	assert.Equal(t, "text/plain", dump.ContentType)
+	assert.Nil(t, dump.Index)
+
+	// 按 offset 读取, 从第一个 needle 走到下一个
+	out, err = captureStdout(t, func() error {
+		return runNeedleDump([]string{"-dir", dir, "-offset", strconv.FormatUint(core.InitIndexSize, 10), "-body", "4"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out, "id:           "+strconv.FormatUint(ids[0], 10))
+	assert.Contains(t, out, "next:         "+strconv.FormatUint(dump.Offset, 10))
+	assert.Contains(t, out, "data")
+
+	_, err = captureStdout(t, func() error {
+		return runNeedleDump([]string{"-dir", dir, "-offset", "9"})
+	})
+	assert.Error(t, err)
+	assert.Error(t, runNeedleDump([]string{"-dir", dir}))
+}
+
+func TestRunCommand(t *testing.T) {
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	var got []string
+	cmds := []command{{"a", "", func(args []string) error {
+		got = args
+		return nil
+	}}}
+	assert.NoError(t, runCommand("test", cmds, []string{"a", "-x", "y"}))
+	assert.Equal(t, []string{"-x", "y"}, got)
+	assert.Error(t, runCommand("test", cmds, []string{"b"}))
+	assert.Error(t, runCommand("test", cmds, nil))
+	assert.ErrorIs(t, runCommand("test", cmds, []string{"-h"}), flag.ErrHelp)
+}
@@ -0,0 +1,317 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/hmli/simplefs/core"
+)
+
+// NewFile 从 r 读取 size 字节存为文件, 返回的 id 在 v 中.
+// 不超过 ChunkSize 并且 v 放得下时直接存到 v 中, 否则切成多个 chunk 存到有空间的 Volume 中,
+// 再把 Manifest 存到 v 中. 出错时已经写入的 chunk 会被删除.
+func (m *Manager) NewFile(v *core.Volume, r io.Reader, size uint64, filename string, opt *core.FileOptions) (id uint64, err error) {
+	if m.fits(v, size, filename, opt) {
+		return v.NewFileFromReader(r, size, filename, opt)
+	}
+	manifest, err := m.writeChunks(r, size, opt)
+	if err != nil {
+		return 0, err
+	}
+	return m.writeManifest(manifest, opt, func(data []byte, mopt *core.FileOptions) (uint64, error) {
+		return v.NewFileWithOptions(data, filename, mopt)
+	})
+}
+
+// CompareAndPutFile 以指定的 id 写入文件, 只有 id 当前的 needle 与 old 相同时才写入, 否则返回 core.ErrConflict.
+// old 为 nil 表示 id 必须不存在. 和 NewFile 一样放不下时切成 chunk. 替换掉的 Manifest 的 chunk 会被删除
+func (m *Manager) CompareAndPutFile(v *core.Volume, id uint64, old *core.Needle, data []byte, filename string, opt *core.FileOptions) (err error) {
+	var replaced *core.Manifest
+	if old != nil && old.IsManifest() && !old.Deleted() {
+		replaced, err = m.readReplaced(v, old)
+		if err != nil {
+			return err
+		}
+	}
+	size := uint64(len(data))
+	if m.fits(v, size, filename, opt) {
+		err = v.CompareAndPutFile(id, old, data, filename, opt)
+	} else {
+		var manifest *core.Manifest
+		manifest, err = m.writeChunks(bytes.NewReader(data), size, opt)
+		if err != nil {
+			return err
+		}
+		_, err = m.writeManifest(manifest, opt, func(data []byte, mopt *core.FileOptions) (uint64, error) {
+			return id, v.CompareAndPutFile(id, old, data, filename, mopt)
+		})
+	}
+	if err == nil && replaced != nil {
+		m.delChunks(replaced.Chunks)
+	}
+	return
+}
+
+// readReplaced 读取要被替换的 Manifest old. id 当前已经不是 old 时返回 core.ErrConflict,
+// old 已经过期时返回 nil, 它的 chunk 也一起过期了
+func (m *Manager) readReplaced(v *core.Volume, old *core.Needle) (manifest *core.Manifest, err error) {
+	n, data, err := v.ReadFile(old.ID)
+	switch {
+	case errors.Is(err, core.ErrExpired):
+		return nil, nil
+	case errors.Is(err, core.ErrNeedleNotFound) || errors.Is(err, core.ErrDeleted) || err == nil && n.Offset != old.Offset:
+		return nil, core.ErrConflict
+	case err != nil:
+		return nil, err
+	}
+	return core.UnmarshalManifest(data)
+}
+
+// NewFiles 一次写入多个文件, 返回值同 core.Volume.NewFiles.
+// v 放得下的文件在一个 Batch 中写入 v, 其余的 (包括因为同一批的其它文件用掉空间而放不下的) 逐个用 NewFile 写入
+func (m *Manager) NewFiles(v *core.Volume, files []core.File, opt *core.FileOptions) (results []core.FileResult, err error) {
+	results = make([]core.FileResult, len(files))
+	var small []core.File
+	var index []int
+	for i, f := range files {
+		if uint64(len(f.Data)) <= m.ChunkSize {
+			small = append(small, f)
+			index = append(index, i)
+		}
+	}
+	smallResults, err := v.NewFiles(small, opt)
+	if err != nil {
+		return nil, err
+	}
+	spilled := make([]bool, len(files))
+	for i := range files {
+		spilled[i] = true
+	}
+	for j, res := range smallResults {
+		if errors.Is(res.Err, core.ErrLeakSpace) {
+			continue
+		}
+		results[index[j]] = res
+		spilled[index[j]] = false
+	}
+	for i, f := range files {
+		if !spilled[i] {
+			continue
+		}
+		id, err := m.NewFile(v, bytes.NewReader(f.Data), uint64(len(f.Data)), f.Name, fileOptions(opt, f))
+		if err == nil {
+			results[i].Needle, err = v.GetNeedle(id)
+		}
+		if err == nil {
+			results[i].Needle.Close() // 只返回 header
+		}
+		results[i].Err = err
+	}
+	return results, nil
+}
+
+// fileOptions 用 f 中的 ContentType 和宽高替换 opt 中的, 同 core.Volume.NewFiles
+func fileOptions(opt *core.FileOptions, f core.File) *core.FileOptions {
+	fopt := new(core.FileOptions)
+	if opt != nil {
+		*fopt = *opt
+	}
+	if f.ContentType != "" {
+		fopt.ContentType = f.ContentType
+	}
+	if f.Width != 0 {
+		fopt.Width, fopt.Height = f.Width, f.Height
+	}
+	return fopt
+}
+
+// fits 文件不超过 ChunkSize 并且 v 的剩余空间放得下
+func (m *Manager) fits(v *core.Volume, size uint64, filename string, opt *core.FileOptions) bool {
+	header := &core.Needle{FileExt: core.Ext(filename), Filename: filename}
+	if opt != nil {
+		header.ContentType = opt.ContentType
+	}
+	return size <= m.ChunkSize && v.RemainingSpace() >= header.HeaderSize()+size
+}
+
+// writeChunks 从 r 读取 size 字节切成 chunk 写到有空间的 Volume 中. 出错时已经写入的 chunk 会被删除
+func (m *Manager) writeChunks(r io.Reader, size uint64, opt *core.FileOptions) (manifest *core.Manifest, err error) {
+	chunkOpt := new(core.FileOptions)
+	if opt != nil {
+		chunkOpt.TTL = opt.TTL
+	}
+	manifest = &core.Manifest{Size: size}
+	for offset := uint64(0); offset < size; offset += m.ChunkSize {
+		chunk := core.Chunk{Offset: offset, Size: m.ChunkSize}
+		if offset+chunk.Size > size {
+			chunk.Size = size - offset
+		}
+		chunk.VolumeID, chunk.ID, err = m.newChunk(io.LimitReader(r, int64(chunk.Size)), chunk.Size, chunkOpt)
+		if err != nil {
+			m.delChunks(manifest.Chunks)
+			return nil, err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+	}
+	return manifest, nil
+}
+
+// writeManifest 用 write 保存 manifest, 除了 Manifest 标记外使用 opt 中的选项. 出错时删除 manifest 的 chunk
+func (m *Manager) writeManifest(manifest *core.Manifest, opt *core.FileOptions, write func(data []byte, opt *core.FileOptions) (uint64, error)) (id uint64, err error) {
+	data, err := core.MarshalManifest(manifest)
+	if err == nil {
+		mopt := new(core.FileOptions)
+		if opt != nil {
+			*mopt = *opt
+		}
+		mopt.Manifest = true
+		id, err = write(data, mopt)
+	}
+	if err != nil {
+		m.delChunks(manifest.Chunks)
+		return 0, err
+	}
+	return id, nil
+}
+
+// newChunk 把一个 chunk 写到有空间的 Volume 中. 其它写入抢先用掉空间时换一个 Volume 重试
+func (m *Manager) newChunk(r io.Reader, size uint64, opt *core.FileOptions) (vid uint64, id uint64, err error) {
+	for {
+		v, err := m.pickVolume(core.NeedleFixSize + size)
+		if err != nil {
+			return 0, 0, err
+		}
+		id, err = v.NewFileFromReader(r, size, "", opt)
+		if errors.Is(err, core.ErrLeakSpace) {
+			continue
+		}
+		return v.ID, id, err
+	}
+}
+
+// ReadManifest 读取 Manifest needle 的内容
+func (m *Manager) ReadManifest(v *core.Volume, id uint64) (manifest *core.Manifest, err error) {
+	n, data, err := v.ReadFile(id)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsManifest() {
+		return nil, ErrNotManifest
+	}
+	return core.UnmarshalManifest(data)
+}
+
+// ChunkReader 把 Manifest 中的 chunk 拼成一个完整的文件
+type ChunkReader struct {
+	manifest *core.Manifest
+	needles  []*core.Needle
+}
+
+// OpenManifest 打开 Manifest 中的所有 chunk, 任何一个 chunk 不存在时返回 ErrChunkMissing
+func (m *Manager) OpenManifest(manifest *core.Manifest) (r *ChunkReader, err error) {
+	r = &ChunkReader{manifest: manifest, needles: make([]*core.Needle, len(manifest.Chunks))}
+	var size uint64
+	for i, c := range manifest.Chunks {
+		if c.Offset != size {
+			r.Close()
+			return nil, ErrWrongManifest
+		}
+		size += c.Size
+		v, err := m.GetVolume(c.VolumeID)
+		if err != nil {
+			return nil, ErrChunkMissing
+		}
+		n, err := v.GetNeedle(c.ID)
+		if err == nil && n.Size != c.Size {
+			n.Close()
+			err = ErrChunkMissing
+		}
+		if err != nil {
+			r.Close()
+			return nil, ErrChunkMissing
+		}
+		r.needles[i] = n
+	}
+	if size != manifest.Size {
+		r.Close()
+		return nil, ErrWrongManifest
+	}
+	return r, nil
+}
+
+// Close 释放所有 chunk, 之后不能再读
+func (r *ChunkReader) Close() error {
+	for _, n := range r.needles {
+		if n != nil {
+			n.Close()
+		}
+	}
+	return nil
+}
+
+func (r *ChunkReader) Size() int64 {
+	return int64(r.manifest.Size)
+}
+
+// ReadAt 实现 io.ReaderAt, 可以跨越多个 chunk
+func (r *ChunkReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, core.ErrWrongWhence
+	}
+	for i := r.manifest.Find(uint64(off)); n < len(p) && i < len(r.needles); i++ {
+		c := r.manifest.Chunks[i]
+		read, err := r.needles[i].Section().ReadAt(p[n:], off+int64(n)-int64(c.Offset))
+		n += read
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// DelFiles 删除 v 中的文件, 其中的 Manifest 的 chunk 也一起删除. 返回值同 core.Volume.DelFiles
+func (m *Manager) DelFiles(v *core.Volume, ids []uint64) (errs []error, err error) {
+	var manifests []*core.Manifest
+	for _, id := range ids {
+		n, err := v.GetNeedle(id)
+		if err != nil {
+			continue
+		}
+		n.Close()
+		if !n.IsManifest() {
+			continue
+		}
+		manifest, err := m.ReadManifest(v, id)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	errs, err = v.DelFiles(ids)
+	if err != nil {
+		return
+	}
+	for _, manifest := range manifests {
+		m.delChunks(manifest.Chunks)
+	}
+	return
+}
+
+// delChunks 按 Volume 分组删除 chunk, 找不到的 chunk 忽略
+func (m *Manager) delChunks(chunks []core.Chunk) {
+	ids := make(map[uint64][]uint64)
+	for _, c := range chunks {
+		ids[c.VolumeID] = append(ids[c.VolumeID], c.ID)
+	}
+	for vid, chunkIDs := range ids {
+		v, err := m.GetVolume(vid)
+		if err != nil {
+			continue
+		}
+		v.DelFiles(chunkIDs)
+	}
+}
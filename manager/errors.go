@@ -1,8 +1,11 @@
 package manager
 
-import "github.com/kataras/iris/errors"
+import "errors"
 
 var (
-	ErrVidRepeat = errors.New("Volume id repeated")
-	ErrNoVolume = errors.New("No this volume")
+	ErrVidRepeat     = errors.New("Volume id repeated")
+	ErrNoVolume      = errors.New("No this volume")
+	ErrNotManifest   = errors.New("Needle is not a manifest")
+	ErrChunkMissing  = errors.New("Chunk of the file is missing")
+	ErrWrongManifest = errors.New("Manifest size mismatch")
 )
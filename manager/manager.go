@@ -1,27 +1,97 @@
 package manager
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/hmli/simplefs/core"
 )
 
+// DefaultChunkSize 大文件切分的 chunk 大小
+const DefaultChunkSize uint64 = 64 << 20 // 64MB
+
+// Manager 管理单机上的多个 Volume, 每个 Volume 在 Dir 下自己的目录中
 type Manager struct {
-	volumes map[uint64]*core.Volume
+	Dir        string
+	ChunkSize  uint64 // 超过这个大小的文件会被切成多个 chunk
+	VolumeSize uint64 // 新建 Volume 的大小, 0 表示 core.MaxVolumeSize
+	conf       *core.VolumeConfig
+	volumes    map[uint64]*core.Volume
+	lock       sync.Mutex
+}
+
+// New 打开 dir 下已有的所有 Volume, conf 用于打开和新建 Volume
+func New(dir string, conf *core.VolumeConfig) (m *Manager, err error) {
+	m = &Manager{
+		Dir:       dir,
+		ChunkSize: DefaultChunkSize,
+		conf:      conf,
+		volumes:   make(map[uint64]*core.Volume),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		id, err := strconv.ParseUint(e.Name(), 10, 64)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		_, err = m.NewVolume(id, m.volumeDir(id))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Manager) volumeDir(id uint64) string {
+	return filepath.Join(m.Dir, strconv.FormatUint(id, 10))
 }
 
+// NewVolume 打开或新建 dir 中 id 为 id 的 Volume
 func (m *Manager) NewVolume(id uint64, dir string) (volume *core.Volume, err error) {
-	volume, err = core.NewVolume(id, dir)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.newVolume(id, dir)
+}
+
+func (m *Manager) newVolume(id uint64, dir string) (volume *core.Volume, err error) {
+	if _, exists := m.volumes[id]; exists {
+		return nil, ErrVidRepeat
+	}
+	volume, err = core.NewVolumeWithConfig(id, dir, m.conf)
 	if err != nil {
 		return
 	}
-	_, exists := m.volumes[id]
-	if exists {
-		return nil, ErrVidRepeat
+	if m.VolumeSize > 0 {
+		volume.Size = m.VolumeSize
 	}
 	m.volumes[id] = volume
 	return
 }
 
+// AddVolume 加入已经打开的 Volume
+func (m *Manager) AddVolume(volume *core.Volume) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.volumes[volume.ID]; exists {
+		return ErrVidRepeat
+	}
+	m.volumes[volume.ID] = volume
+	return nil
+}
+
 func (m *Manager) GetVolume(id uint64) (volume *core.Volume, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	volume, exists := m.volumes[id]
 	if !exists {
 		return nil, ErrNoVolume
@@ -29,4 +99,106 @@ func (m *Manager) GetVolume(id uint64) (volume *core.Volume, err error) {
 	return
 }
 
+// Volumes 按 id 排序的所有 Volume
+func (m *Manager) Volumes() (volumes []*core.Volume) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range m.volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return
+}
+
+// pickVolume 找一个剩余空间能放下 size 字节的 Volume, 都放不下时新建一个
+func (m *Manager) pickVolume(size uint64) (volume *core.Volume, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var maxID uint64
+	for id, v := range m.volumes {
+		if v.RemainingSpace() >= size && (volume == nil || id < volume.ID) {
+			volume = v
+		}
+		if id > maxID {
+			maxID = id
+		}
+	}
+	if volume != nil {
+		return volume, nil
+	}
+	volumeSize := m.VolumeSize
+	if volumeSize == 0 {
+		volumeSize = core.MaxVolumeSize
+	}
+	if size > volumeSize-core.InitIndexSize {
+		return nil, core.ErrLeakSpace
+	}
+	return m.newVolume(maxID+1, m.volumeDir(maxID+1))
+}
 
+// Close 关闭所有的 Volume, 之后对它们的操作都返回 core.ErrClosed. 返回遇到的所有错误
+func (m *Manager) Close() (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var errs []error
+	for id, v := range m.volumes {
+		if e := v.Close(); e != nil && e != core.ErrClosed {
+			errs = append(errs, fmt.Errorf("Close volume %d: %w", id, e))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartSyncer 每隔 interval 把所有的 Volume 刷到磁盘, 调用返回的 stop 停止并等待正在进行的一次完成
+func (m *Manager) StartSyncer(interval time.Duration) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, v := range m.Volumes() {
+					if err := v.Sync(); err != nil && err != core.ErrClosed {
+						log.Printf("Sync volume %d err: %v", v.ID, err)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// StartReaper 每隔 interval 对所有的 Volume 执行一次 core.Volume.Reap, 调用返回的 stop 停止并等待正在进行的一次完成
+func (m *Manager) StartReaper(interval time.Duration) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, v := range m.Volumes() {
+					if _, err := v.Reap(); err != nil && err != core.ErrClosed {
+						log.Printf("Reap volume %d err: %v", v.ID, err)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
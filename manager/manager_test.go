@@ -0,0 +1,160 @@
+package manager
+
+import (
+	"bytes"
+	"github.com/hmli/simplefs/core"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T) (m *Manager, v *core.Volume) {
+	dir := t.TempDir()
+	m, err := New(filepath.Join(dir, "volumes"), nil)
+	assert.NoError(t, err)
+	v, err = core.NewVolume(1, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, m.AddVolume(v))
+	return m, v
+}
+
+func TestManager_Volumes(t *testing.T) {
+	m, v := newTestManager(t)
+	assert.Equal(t, ErrVidRepeat, m.AddVolume(v))
+	_, err := m.GetVolume(2)
+	assert.Equal(t, ErrNoVolume, err)
+	v2, err := m.NewVolume(2, m.volumeDir(2))
+	assert.NoError(t, err)
+	_, err = m.NewVolume(2, m.volumeDir(2))
+	assert.Equal(t, ErrVidRepeat, err)
+	assert.Equal(t, []*core.Volume{v, v2}, m.Volumes())
+}
+
+func TestManager_NewFile_Chunks(t *testing.T) {
+	dir := t.TempDir()
+	m, err := New(filepath.Join(dir, "volumes"), nil)
+	assert.NoError(t, err)
+	// Manifest 单独存放, chunk 都在 m 新建的 Volume 中
+	v, err := core.NewVolume(100, dir)
+	assert.NoError(t, err)
+	m.ChunkSize = 4
+	// 每个新 Volume 只放得下两个 chunk
+	m.VolumeSize = core.InitIndexSize + 2*(core.NeedleFixSize+4)
+	data := []byte("0123456789abcdefghij")
+	id, err := m.NewFile(v, bytes.NewReader(data), uint64(len(data)), "big.bin", nil)
+	assert.NoError(t, err)
+	n, err := v.GetNeedle(id)
+	assert.NoError(t, err)
+	assert.True(t, n.IsManifest())
+	assert.Equal(t, "big.bin", n.Filename)
+
+	manifest, err := m.ReadManifest(v, id)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(len(data)), manifest.Size)
+	assert.Len(t, manifest.Chunks, 5)
+	vids := make(map[uint64]bool)
+	for _, c := range manifest.Chunks {
+		vids[c.VolumeID] = true
+	}
+	assert.Len(t, vids, 3)
+	assert.Len(t, m.Volumes(), 3)
+
+	r, err := m.OpenManifest(manifest)
+	assert.NoError(t, err)
+	read, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+	p := make([]byte, 7)
+	_, err = r.ReadAt(p, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "3456789", string(p))
+	_, err = r.ReadAt(p, 18)
+	assert.Equal(t, io.EOF, err)
+
+	errs, err := m.DelFiles(v, []uint64{id})
+	assert.NoError(t, err)
+	assert.NoError(t, errs[0])
+	for _, c := range manifest.Chunks {
+		cv, err := m.GetVolume(c.VolumeID)
+		assert.NoError(t, err)
+		_, err = cv.GetNeedle(c.ID)
+		assert.Equal(t, core.ErrDeleted, err)
+	}
+	_, err = m.OpenManifest(manifest)
+	assert.Equal(t, ErrChunkMissing, err)
+}
+
+func TestManager_NewFile_Small(t *testing.T) {
+	m, v := newTestManager(t)
+	id, err := m.NewFile(v, bytes.NewReader([]byte("small")), 5, "a.txt", nil)
+	assert.NoError(t, err)
+	n, err := v.GetNeedle(id)
+	assert.NoError(t, err)
+	assert.False(t, n.IsManifest())
+	_, err = m.ReadManifest(v, id)
+	assert.Equal(t, ErrNotManifest, err)
+	assert.Len(t, m.Volumes(), 1)
+}
+
+func TestManager_CompareAndPutFile(t *testing.T) {
+	m, v := newTestManager(t)
+	m.ChunkSize = 4
+	data := []byte("0123456789")
+	assert.NoError(t, m.CompareAndPutFile(v, 100, nil, data, "big.bin", nil))
+	assert.ErrorIs(t, m.CompareAndPutFile(v, 100, nil, data, "big.bin", nil), core.ErrConflict)
+	manifest, err := m.ReadManifest(v, 100)
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Chunks, 3)
+
+	// 替换掉的 Manifest 的 chunk 被删除
+	old, err := v.Directory.Get(100)
+	assert.NoError(t, err)
+	assert.NoError(t, m.CompareAndPutFile(v, 100, old, []byte("new"), "a.txt", nil))
+	for _, c := range manifest.Chunks {
+		cv, err := m.GetVolume(c.VolumeID)
+		assert.NoError(t, err)
+		_, err = cv.GetNeedle(c.ID)
+		assert.ErrorIs(t, err, core.ErrDeleted)
+	}
+	_, read, err := v.ReadFile(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(read))
+
+	// 检查失败时新写入的 chunk 也被删除, 原来的文件不变
+	assert.ErrorIs(t, m.CompareAndPutFile(v, 100, old, data, "big.bin", nil), core.ErrConflict)
+	_, read, err = v.ReadFile(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(read))
+}
+
+func TestManager_Close(t *testing.T) {
+	m, v := newTestManager(t)
+	m.ChunkSize = 4
+	_, err := m.NewFile(v, bytes.NewReader([]byte("0123456789")), 10, "a.txt", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Close())
+	for _, v := range m.Volumes() {
+		_, err = v.GetNeedle(1)
+		assert.ErrorIs(t, err, core.ErrClosed)
+	}
+	assert.NoError(t, m.Close())
+
+	// 关闭后可以重新打开
+	v, err = core.NewVolume(1, v.Path)
+	assert.NoError(t, err)
+	assert.NoError(t, v.Close())
+}
+
+func TestManager_StartReaper(t *testing.T) {
+	m, v := newTestManager(t)
+	id, err := v.NewFileWithOptions([]byte("a"), "a", &core.FileOptions{TTL: time.Second})
+	assert.NoError(t, err)
+	stop := m.StartReaper(100 * time.Millisecond)
+	defer stop()
+	assert.Eventually(t, func() bool {
+		_, err := v.GetNeedle(id)
+		return err == core.ErrDeleted
+	}, 3*time.Second, 50*time.Millisecond)
+}
@@ -1,7 +1,16 @@
 package utils
 
-import "github.com/klauspost/crc32"
+import (
+	"hash"
+
+	"github.com/klauspost/crc32"
+)
 
 func Checksum(data []byte) uint32 {
 	return crc32.ChecksumIEEE(data)
 }
+
+// NewChecksum 流式计算 Checksum
+func NewChecksum() hash.Hash32 {
+	return crc32.NewIEEE()
+}
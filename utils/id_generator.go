@@ -1,7 +1,22 @@
 package utils
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
+var lastId uint64
+
+// UniqueId 基于当前时间的 id, 同一纳秒内多次调用时依次加一, 保证单调递增
 func UniqueId() (id uint64) {
-	return uint64(time.Now().UnixNano())
+	for {
+		last := atomic.LoadUint64(&lastId)
+		id = uint64(time.Now().UnixNano())
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&lastId, last, id) {
+			return
+		}
+	}
 }